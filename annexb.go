@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// H.264 NAL unit types
+const (
+	h264NALSlice = 1
+	h264NALIDR   = 5
+	h264NALSEI   = 6
+	h264NALSPS   = 7
+	h264NALPPS   = 8
+	h264NALAUD   = 9
+)
+
+// H.265 NAL unit types
+const (
+	h265NALIRAPFirst = 16 // BLA, IDR and CRA pictures, which decoding can start from
+	h265NALIRAPLast  = 23
+	h265NALVPS       = 32
+	h265NALSPS       = 33
+	h265NALPPS       = 34
+	h265NALAUD       = 35
+	h265NALPrefixSEI = 39
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x01}
+
+// splitNALUnits returns the NAL units of an Annex-B byte stream, without
+// their start codes. Anything before the first start code is ignored.
+func splitNALUnits(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1 // offset of the current NAL unit
+	pos := 0
+	for {
+		i := bytes.Index(data[pos:], annexBStartCode)
+		if i < 0 {
+			break
+		}
+		i += pos
+		if start >= 0 {
+			nalus = appendNALUnit(nalus, data[start:i])
+		}
+		start = i + len(annexBStartCode)
+		pos = start
+	}
+	if start >= 0 {
+		nalus = appendNALUnit(nalus, data[start:])
+	}
+	return nalus
+}
+
+// maxNALSize bounds the NAL units nalReader will buffer
+const maxNALSize = 16 << 20
+
+// nalReader reads the NAL units of an Annex-B byte stream one at a time, so
+// memory use doesn't grow with the length of the stream. Anything before the
+// first start code is ignored.
+type nalReader struct {
+	r     io.Reader
+	buf   []byte
+	start int // of the current NAL unit in buf, or -1 before the first start code
+	scan  int // where to look for the next start code
+	eof   bool
+}
+
+// newNALReader creates a reader of the NAL units in r
+func newNALReader(r io.Reader) *nalReader {
+	return &nalReader{r: r, buf: make([]byte, 0, 64*1024), start: -1}
+}
+
+// Next returns the next NAL unit without its start code, or io.EOF at the
+// end of the stream. The NAL unit is only valid until the next call.
+func (n *nalReader) Next() ([]byte, error) {
+	for {
+		if i := bytes.Index(n.buf[n.scan:], annexBStartCode); i >= 0 {
+			i += n.scan
+			nal := []byte(nil)
+			if n.start >= 0 {
+				nal = bytes.TrimRight(n.buf[n.start:i], "\x00")
+			}
+			n.start = i + len(annexBStartCode)
+			n.scan = n.start
+			if len(nal) > 0 {
+				return nal, nil
+			}
+			continue
+		}
+
+		if n.eof {
+			nal := []byte(nil)
+			if n.start >= 0 && n.start < len(n.buf) {
+				nal = bytes.TrimRight(n.buf[n.start:], "\x00")
+			}
+			n.start = len(n.buf)
+			n.scan = n.start
+			if len(nal) > 0 {
+				return nal, nil
+			}
+			return nil, io.EOF
+		}
+
+		// Drop what's been returned, or the junk before the first start
+		// code, keeping the last two bytes in case they begin a start code
+		drop := n.start
+		if drop < 0 {
+			drop = max(len(n.buf)-2, 0)
+		}
+		n.buf = append(n.buf[:0], n.buf[drop:]...)
+		if n.start >= 0 {
+			n.start = 0
+		}
+		n.scan = max(len(n.buf)-2, n.start, 0)
+		if len(n.buf) > maxNALSize {
+			return nil, fmt.Errorf("NAL unit is larger than %d bytes", maxNALSize)
+		}
+
+		if len(n.buf) == cap(n.buf) {
+			n.buf = append(n.buf, make([]byte, cap(n.buf))...)[:len(n.buf)]
+		}
+		read, err := n.r.Read(n.buf[len(n.buf):cap(n.buf)])
+		n.buf = n.buf[:len(n.buf)+read]
+		if errors.Is(err, io.EOF) {
+			n.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// appendNALUnit appends a NAL unit, trimming the zero bytes that belong to
+// a following four-byte start code or pad the stream
+func appendNALUnit(nalus [][]byte, nal []byte) [][]byte {
+	nal = bytes.TrimRight(nal, "\x00")
+	if len(nal) == 0 {
+		return nalus
+	}
+	return append(nalus, nal)
+}
+
+// nalHeaderSize returns the size of a NAL unit header for the codec
+func nalHeaderSize(codec string) int {
+	if codec == "hevc" {
+		return 2
+	}
+	return 1
+}
+
+// nalType returns the type of a NAL unit, which must be at least a header long
+func nalType(codec string, nal []byte) int {
+	if codec == "hevc" {
+		return int(nal[0]>>1) & 0x3f
+	}
+	return int(nal[0] & 0x1f)
+}
+
+// isVCL reports whether a NAL unit type holds picture data
+func isVCL(codec string, typ int) bool {
+	if codec == "hevc" {
+		return typ < 32
+	}
+	return typ >= h264NALSlice && typ <= h264NALIDR
+}
+
+// isKeyframeNAL reports whether a NAL unit type holds a picture that
+// decoding can start from
+func isKeyframeNAL(codec string, typ int) bool {
+	if codec == "hevc" {
+		return typ >= h265NALIRAPFirst && typ <= h265NALIRAPLast
+	}
+	return typ == h264NALIDR
+}
+
+// isParameterSet reports whether a NAL unit type is a VPS, SPS or PPS
+func isParameterSet(codec string, typ int) bool {
+	if codec == "hevc" {
+		return typ == h265NALVPS || typ == h265NALSPS || typ == h265NALPPS
+	}
+	return typ == h264NALSPS || typ == h264NALPPS
+}
+
+// isAUD reports whether a NAL unit type is an access unit delimiter
+func isAUD(codec string, typ int) bool {
+	if codec == "hevc" {
+		return typ == h265NALAUD
+	}
+	return typ == h264NALAUD
+}
+
+// startsAccessUnit reports whether a NAL unit begins a new access unit once
+// the current one has picture data: a delimiter, parameter set or SEI, or
+// the first slice of a new picture
+func startsAccessUnit(codec string, nal []byte) bool {
+	typ := nalType(codec, nal)
+	if isAUD(codec, typ) || isParameterSet(codec, typ) {
+		return true
+	}
+	if codec == "hevc" {
+		if typ == h265NALPrefixSEI {
+			return true
+		}
+		// first_slice_segment_in_pic_flag
+		return isVCL(codec, typ) && len(nal) > 2 && nal[2]&0x80 != 0
+	}
+	if typ == h264NALSEI {
+		return true
+	}
+	// first_mb_in_slice is 0, coded as a single 1 bit
+	return isVCL(codec, typ) && len(nal) > 1 && nal[1]&0x80 != 0
+}
+
+// accessUnit is the NAL units making up one picture, with the time it's
+// presented at in 90 kHz ticks
+type accessUnit struct {
+	nalus    [][]byte
+	time     int64
+	keyframe bool
+}
+
+// accessUnitBuilder groups a stream of NAL units into access units, calling
+// emit with each one that has picture data
+type accessUnitBuilder struct {
+	codec  string
+	emit   func(accessUnit) error
+	cur    accessUnit
+	hasVCL bool
+}
+
+// newAccessUnitBuilder creates a builder for "h264" or "hevc" NAL units
+func newAccessUnitBuilder(codec string, emit func(accessUnit) error) *accessUnitBuilder {
+	return &accessUnitBuilder{codec: codec, emit: emit}
+}
+
+// Push adds a NAL unit, received at time, to the stream. The NAL unit is
+// copied, so its buffer can be reused. An access unit is presented at the
+// time its first NAL unit was received.
+func (b *accessUnitBuilder) Push(nal []byte, time int64) error {
+	if len(nal) < nalHeaderSize(b.codec) {
+		return nil
+	}
+	if b.hasVCL && startsAccessUnit(b.codec, nal) {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(b.cur.nalus) == 0 {
+		b.cur.time = time
+	}
+	b.cur.nalus = append(b.cur.nalus, append([]byte(nil), nal...))
+	if typ := nalType(b.codec, nal); isVCL(b.codec, typ) {
+		b.hasVCL = true
+		if isKeyframeNAL(b.codec, typ) {
+			b.cur.keyframe = true
+		}
+	}
+	return nil
+}
+
+// Flush emits the access unit being built, if it has picture data
+func (b *accessUnitBuilder) Flush() error {
+	au, hasVCL := b.cur, b.hasVCL
+	b.cur, b.hasVCL = accessUnit{}, false
+	if !hasVCL {
+		return nil
+	}
+	return b.emit(au)
+}
+
+// unescapeRBSP removes the emulation prevention bytes from a NAL unit
+func unescapeRBSP(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+var errShortRBSP = errors.New("parameter set is truncated")
+
+// bitReader reads the bit fields of a parameter set. Reading past the end
+// yields zeros and sets err.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+// bits reads an n-bit unsigned field, n <= 64
+func (r *bitReader) bits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errShortRBSP
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v
+}
+
+// flag reads a one-bit flag
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+// skip skips n bits
+func (r *bitReader) skip(n int) {
+	r.bits(n)
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint64 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil || zeros >= 32 {
+			r.err = errShortRBSP
+			return 0
+		}
+		zeros++
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int64 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int64(v+1) / 2
+	}
+	return -int64(v / 2)
+}
+
+// videoParams is what the MP4 sample description needs from a sequence
+// parameter set
+type videoParams struct {
+	width, height    int
+	chromaFormat     int
+	bitDepthLuma     int
+	bitDepthChroma   int
+	profileTierLevel []byte // H.265 only: the 12 bytes of general profile, tier and level
+	maxSubLayers     int    // H.265 only
+	temporalNesting  bool   // H.265 only
+}
+
+// h264HasChromaFormat reports whether an H.264 SPS of the given profile
+// (High and above) carries the chroma format and bit depths, which are then
+// repeated in the avcC record
+func h264HasChromaFormat(profile byte) bool {
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+// parseH264SPS reads the picture size and format from an H.264 SPS
+func parseH264SPS(nal []byte) (videoParams, error) {
+	rbsp := unescapeRBSP(nal)
+	if len(rbsp) < 4 {
+		return videoParams{}, errShortRBSP
+	}
+	r := &bitReader{data: rbsp, pos: 8}
+	profile := byte(r.bits(8))
+	r.skip(16) // constraint flags, level
+	r.ue()     // seq_parameter_set_id
+
+	p := videoParams{chromaFormat: 1, bitDepthLuma: 8, bitDepthChroma: 8}
+	separateColourPlanes := false
+	if h264HasChromaFormat(profile) {
+		p.chromaFormat = int(r.ue())
+		if p.chromaFormat == 3 {
+			separateColourPlanes = r.flag()
+		}
+		p.bitDepthLuma = int(r.ue()) + 8
+		p.bitDepthChroma = int(r.ue()) + 8
+		r.skip(1)     // qpprime_y_zero_transform_bypass_flag
+		if r.flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if p.chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		for i := uint64(0); i < cycle && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMBs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMBsOnly := r.flag()
+	if !frameMBsOnly {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+
+	fieldFactor := 1
+	if !frameMBsOnly {
+		fieldFactor = 2
+	}
+	p.width = widthMBs * 16
+	p.height = heightMapUnits * 16 * fieldFactor
+	if r.flag() { // frame_cropping_flag
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, fieldFactor
+		if p.chromaFormat != 0 && !separateColourPlanes {
+			if p.chromaFormat == 1 || p.chromaFormat == 2 {
+				cropX = 2
+			}
+			if p.chromaFormat == 1 {
+				cropY *= 2
+			}
+		}
+		p.width -= cropX * (left + right)
+		p.height -= cropY * (top + bottom)
+	}
+
+	if r.err != nil {
+		return videoParams{}, r.err
+	}
+	if p.width <= 0 || p.height <= 0 {
+		return videoParams{}, fmt.Errorf("invalid picture size %dx%d", p.width, p.height)
+	}
+	return p, nil
+}
+
+// skipScalingList skips an H.264 scaling list of size entries
+func skipScalingList(r *bitReader, size int) {
+	last, next := int64(8), int64(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseH265SPS reads the picture size, format and profile from an H.265 SPS
+func parseH265SPS(nal []byte) (videoParams, error) {
+	rbsp := unescapeRBSP(nal)
+	if len(rbsp) < 15 {
+		return videoParams{}, errShortRBSP
+	}
+	r := &bitReader{data: rbsp, pos: 16}
+	r.skip(4) // sps_video_parameter_set_id
+	p := videoParams{maxSubLayers: int(r.bits(3)) + 1}
+	p.temporalNesting = r.flag()
+
+	// profile_tier_level: the general fields are copied into the hvcC as they are
+	p.profileTierLevel = append([]byte(nil), rbsp[3:15]...)
+	r.skip(96)
+	subLayers := p.maxSubLayers - 1
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i] = r.flag()
+		levelPresent[i] = r.flag()
+	}
+	if subLayers > 0 {
+		r.skip(2 * (8 - subLayers)) // reserved_zero_2bits
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	p.chromaFormat = int(r.ue())
+	if p.chromaFormat == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	p.width = int(r.ue())
+	p.height = int(r.ue())
+	if r.flag() { // conformance_window_flag
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		cropX, cropY := 1, 1
+		if p.chromaFormat == 1 || p.chromaFormat == 2 {
+			cropX = 2
+		}
+		if p.chromaFormat == 1 {
+			cropY = 2
+		}
+		p.width -= cropX * (left + right)
+		p.height -= cropY * (top + bottom)
+	}
+	p.bitDepthLuma = int(r.ue()) + 8
+	p.bitDepthChroma = int(r.ue()) + 8
+
+	if r.err != nil {
+		return videoParams{}, r.err
+	}
+	if p.width <= 0 || p.height <= 0 {
+		return videoParams{}, fmt.Errorf("invalid picture size %dx%d", p.width, p.height)
+	}
+	return p, nil
+}
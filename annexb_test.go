@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// Parameter sets and slices of the streams cameras record, with the SPSs
+// covering the profiles whose chroma format is coded in the SPS
+var (
+	h264MainSPS  = []byte{0x67, 0x4d, 0x00, 0x2a, 0x95, 0xa8, 0x1e, 0x00, 0x89, 0xf9, 0x66, 0xe0, 0x20, 0x20, 0x20, 0x40} // 1920x1080
+	h264HighSPS  = []byte{0x67, 0x64, 0x00, 0x28, 0xad, 0x00, 0xe8, 0x07, 0x80, 0x22, 0x7e, 0x54}                         // 1920x1088 cropped to 1080, scaling matrix
+	h264Hi444SPS = []byte{0x67, 0xf4, 0x00, 0x1f, 0x90, 0xd9, 0x68, 0x05, 0x00, 0x5b, 0x90}                               // 1280x720 4:4:4 10-bit
+	h264PPS      = []byte{0x68, 0xee, 0x3c, 0x80}
+	h264IDR      = []byte{0x65, 0x88, 0x80, 0x10, 0x00, 0x3f, 0xf2, 0x2c, 0x51}
+	h264Slice    = []byte{0x41, 0x9a, 0x02, 0x04, 0x5f, 0xfe, 0x91, 0x82}
+	h264Slice2   = []byte{0x41, 0x20, 0x9a, 0x02, 0x04} // second slice of a picture
+
+	h265VPS   = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90}
+	h265SPS   = []byte{0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x01, 0x40, 0x20, 0x05, 0xa1, 0x65, 0x80} // 2560x1440
+	h265PPS   = []byte{0x44, 0x01, 0xc1, 0x72}
+	h265IDR   = []byte{0x26, 0x01, 0xaf, 0x09, 0x08}
+	h265Slice = []byte{0x02, 0x01, 0xd0, 0x07, 0x07}
+)
+
+// annexB joins NAL units into an Annex-B byte stream with four-byte start codes
+func annexB(nalus ...[]byte) []byte {
+	var stream []byte
+	for _, nal := range nalus {
+		stream = append(stream, 0, 0, 0, 1)
+		stream = append(stream, nal...)
+	}
+	return stream
+}
+
+func TestSplitNALUnits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	}{
+		{"empty", nil, nil},
+		{"no start code", h264IDR, nil},
+		{"four-byte start codes", annexB(h264MainSPS, h264PPS, h264IDR), [][]byte{h264MainSPS, h264PPS, h264IDR}},
+		{
+			name: "three-byte start codes",
+			data: bytes.Join([][]byte{{0, 0, 1}, h264PPS, {0, 0, 1}, h264Slice}, nil),
+			want: [][]byte{h264PPS, h264Slice},
+		},
+		{
+			name: "junk and padding",
+			data: bytes.Join([][]byte{{0xff, 0x00}, annexB(h264PPS), {0, 0, 0, 0, 1}, h264Slice, {0, 0}}, nil),
+			want: [][]byte{h264PPS, h264Slice},
+		},
+		{"empty NAL units", annexB(nil, h264PPS, nil), [][]byte{h264PPS}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitNALUnits(tt.data); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitNALUnits = %x, want %x", got, tt.want)
+			}
+
+			// nalReader finds the same NAL units however the stream is read
+			var got [][]byte
+			r := newNALReader(iotest.OneByteReader(bytes.NewReader(tt.data)))
+			for {
+				nal, err := r.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, bytes.Clone(nal))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nalReader = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessUnitBuilder(t *testing.T) {
+	type pushed struct {
+		nal  []byte
+		time int64
+	}
+	tests := []struct {
+		name  string
+		codec string
+		nalus []pushed
+		want  []accessUnit
+	}{
+		{
+			name:  "h264",
+			codec: "h264",
+			nalus: []pushed{
+				{h264MainSPS, 0}, {h264PPS, 0}, {h264IDR, 10},
+				{h264Slice, 4500}, {h264Slice2, 4600},
+				{[]byte{0x09, 0xf0}, 9000}, {h264Slice, 9100},
+				{[]byte{0x06, 0x05}, 13500}, // SEI without a picture
+			},
+			want: []accessUnit{
+				{nalus: [][]byte{h264MainSPS, h264PPS, h264IDR}, time: 0, keyframe: true},
+				{nalus: [][]byte{h264Slice, h264Slice2}, time: 4500},
+				{nalus: [][]byte{{0x09, 0xf0}, h264Slice}, time: 9000},
+			},
+		},
+		{
+			name:  "hevc",
+			codec: "hevc",
+			nalus: []pushed{
+				{h265VPS, 0}, {h265SPS, 0}, {h265PPS, 0}, {h265IDR, 0},
+				{[]byte{0x4e}, 100}, // too short for a header
+				{h265Slice, 3000},
+				{[]byte{0x02, 0x01, 0x50}, 3000}, // second slice segment
+				{h265Slice, 6000},
+			},
+			want: []accessUnit{
+				{nalus: [][]byte{h265VPS, h265SPS, h265PPS, h265IDR}, time: 0, keyframe: true},
+				{nalus: [][]byte{h265Slice, {0x02, 0x01, 0x50}}, time: 3000},
+				{nalus: [][]byte{h265Slice}, time: 6000},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []accessUnit
+			b := newAccessUnitBuilder(tt.codec, func(au accessUnit) error {
+				got = append(got, au)
+				return nil
+			})
+			buf := make([]byte, 64)
+			for _, p := range tt.nalus {
+				// Reuse one buffer, as nalReader does
+				nal := append(buf[:0], p.nal...)
+				if err := b.Push(nal, p.time); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := b.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("access units:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec string
+		sps   []byte
+		want  videoParams
+	}{
+		{
+			name:  "h264 main",
+			codec: "h264",
+			sps:   h264MainSPS,
+			want:  videoParams{width: 1920, height: 1080, chromaFormat: 1, bitDepthLuma: 8, bitDepthChroma: 8},
+		},
+		{
+			name:  "h264 high",
+			codec: "h264",
+			sps:   h264HighSPS,
+			want:  videoParams{width: 1920, height: 1080, chromaFormat: 1, bitDepthLuma: 8, bitDepthChroma: 8},
+		},
+		{
+			name:  "h264 high 4:4:4",
+			codec: "h264",
+			sps:   h264Hi444SPS,
+			want:  videoParams{width: 1280, height: 720, chromaFormat: 3, bitDepthLuma: 10, bitDepthChroma: 10},
+		},
+		{
+			name:  "h265 main",
+			codec: "hevc",
+			sps:   h265SPS,
+			want: videoParams{
+				width: 2560, height: 1440, chromaFormat: 1, bitDepthLuma: 8, bitDepthChroma: 8,
+				profileTierLevel: []byte{0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5d},
+				maxSubLayers:     1,
+				temporalNesting:  true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse := parseH264SPS
+			if tt.codec == "hevc" {
+				parse = parseH265SPS
+			}
+			got, err := parse(tt.sps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("params:\n got %+v\nwant %+v", got, tt.want)
+			}
+
+			// A truncated SPS fails rather than giving a wrong picture size.
+			// The VUI at the end isn't read, so losing it doesn't matter.
+			for n := 0; n < len(tt.sps); n++ {
+				if p, err := parse(tt.sps[:n]); err == nil && !reflect.DeepEqual(p, tt.want) {
+					t.Errorf("%d bytes: parsed %+v", n, p)
+				}
+			}
+		})
+	}
+}
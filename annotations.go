@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on what can be stored in an annotation
+const (
+	maxAnnotationTags  = 32
+	maxTagLength       = 64
+	maxAnnotationNotes = 10000
+)
+
+// Annotation holds the tags, favorite flag and notes recorded for a media item
+type Annotation struct {
+	Tags     []string  `json:"tags"`
+	Favorite bool      `json:"favorite"`
+	Notes    string    `json:"notes"`
+	Updated  time.Time `json:"updated"`
+}
+
+// isEmpty reports whether an annotation records nothing, so it needn't be kept
+func (a Annotation) isEmpty() bool {
+	return len(a.Tags) == 0 && !a.Favorite && a.Notes == ""
+}
+
+// hasTag reports whether tags include tag, ignoring case
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// TagCount is a tag along with the number of media items that have it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// annotationsFile is the on-disk representation of Annotations
+type annotationsFile struct {
+	Annotations map[string]*Annotation `json:"annotations"` // camera path -> annotation
+}
+
+// Annotations is a camera's persistent store of annotations, keyed by camera
+// path. It's kept apart from the cache and catalog, so annotations outlive
+// both a cache wipe and the camera overwriting its SD card.
+type Annotations struct {
+	path string
+
+	mu     sync.RWMutex
+	byPath map[string]*Annotation
+
+	saving sync.Mutex // held while writing to disk, so saves land in order
+}
+
+// NewAnnotations loads the annotations stored at path, starting empty if the
+// file doesn't exist
+func NewAnnotations(path string) (*Annotations, error) {
+	a := &Annotations{path: path, byPath: make(map[string]*Annotation)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read annotations: %w", err)
+	}
+
+	// Unlike the catalog, annotations can't be rebuilt, so a corrupt file is an error
+	var file annotationsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse annotations %s: %w", path, err)
+	}
+	for p, annotation := range file.Annotations {
+		a.byPath[p] = annotation
+	}
+	return a, nil
+}
+
+// Get returns the annotation for a camera path
+func (a *Annotations) Get(path string) (Annotation, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	annotation, ok := a.byPath[path]
+	if !ok {
+		return Annotation{}, false
+	}
+	return *annotation, true
+}
+
+// normalized returns the annotation with its tags and notes cleaned up, or an
+// error if it's over the size limits
+func (a Annotation) normalized() (Annotation, error) {
+	tags, err := normalizeTags(a.Tags)
+	if err != nil {
+		return Annotation{}, err
+	}
+	if len(a.Notes) > maxAnnotationNotes {
+		return Annotation{}, fmt.Errorf("notes are longer than %d characters", maxAnnotationNotes)
+	}
+	a.Tags = tags
+	a.Notes = strings.TrimSpace(a.Notes)
+	return a, nil
+}
+
+// Set replaces the annotation for a camera path, which should be normalized,
+// and saves the store. Setting an annotation with no tags, favorite or notes
+// deletes it.
+func (a *Annotations) Set(path string, annotation Annotation) (Annotation, error) {
+	annotation.Updated = time.Now().UTC()
+
+	a.mu.Lock()
+	if annotation.isEmpty() {
+		delete(a.byPath, path)
+	} else {
+		a.byPath[path] = &annotation
+	}
+	a.mu.Unlock()
+	return annotation, a.save()
+}
+
+// Delete removes the annotation for a camera path and saves the store. It
+// reports whether there was one.
+func (a *Annotations) Delete(path string) (bool, error) {
+	a.mu.Lock()
+	_, ok := a.byPath[path]
+	delete(a.byPath, path)
+	a.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, a.save()
+}
+
+// All returns every annotation, keyed by camera path
+func (a *Annotations) All() map[string]Annotation {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	all := make(map[string]Annotation, len(a.byPath))
+	for p, annotation := range a.byPath {
+		all[p] = *annotation
+	}
+	return all
+}
+
+// Tags returns every tag in use with the number of items that have it, most
+// used first. Tags that differ only in case are counted together, under the
+// spelling seen first in path order.
+func (a *Annotations) Tags() []TagCount {
+	all := a.All()
+	paths := make([]string, 0, len(all))
+	for p := range all {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	counts := make(map[string]*TagCount)
+	var tags []*TagCount
+	for _, p := range paths {
+		for _, tag := range all[p].Tags {
+			key := strings.ToLower(tag)
+			if counts[key] == nil {
+				counts[key] = &TagCount{Tag: tag}
+				tags = append(tags, counts[key])
+			}
+			counts[key].Count++
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return strings.ToLower(tags[i].Tag) < strings.ToLower(tags[j].Tag)
+	})
+
+	result := make([]TagCount, len(tags))
+	for i, tag := range tags {
+		result[i] = *tag
+	}
+	return result
+}
+
+// Apply copies the stored annotations onto items, including burst frames
+func (a *Annotations) Apply(items []MediaItem) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.apply(items)
+}
+
+func (a *Annotations) apply(items []MediaItem) {
+	for i := range items {
+		if annotation, ok := a.byPath[items[i].Path]; ok {
+			items[i].Tags = append([]string(nil), annotation.Tags...)
+			items[i].Favorite = annotation.Favorite
+			items[i].Notes = annotation.Notes
+		}
+		a.apply(items[i].Frames)
+	}
+}
+
+// save writes the annotations to disk atomically
+func (a *Annotations) save() error {
+	a.saving.Lock()
+	defer a.saving.Unlock()
+
+	a.mu.RLock()
+	data, err := json.MarshalIndent(annotationsFile{Annotations: a.byPath}, "", "  ")
+	a.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(a.path), "temp-annotations-*.json")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer func() {
+		_ = os.Remove(tempPath)
+	}()
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, a.path)
+}
+
+// normalizeTags trims tags and collapses inner whitespace, dropping empty
+// tags and repeats that differ only in case
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(tag), " ")
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		seen[strings.ToLower(tag)] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxAnnotationTags {
+		return nil, fmt.Errorf("too many tags (at most %d)", maxAnnotationTags)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveRetention sets how long archived media is kept, per trigger and
+// media type. A zero duration keeps media forever.
+type ArchiveRetention struct {
+	AlarmImages    time.Duration
+	AlarmVideos    time.Duration
+	PeriodicImages time.Duration
+	PeriodicVideos time.Duration
+}
+
+// For returns the retention period that applies to an item
+func (r ArchiveRetention) For(item MediaItem) time.Duration {
+	switch {
+	case item.Trigger == "alarm" && item.Type == "video":
+		return r.AlarmVideos
+	case item.Trigger == "alarm":
+		return r.AlarmImages
+	case item.Type == "video":
+		return r.PeriodicVideos
+	default:
+		return r.PeriodicImages
+	}
+}
+
+// expired reports whether an item recorded at the given time is past its retention period
+func (r ArchiveRetention) expired(item MediaItem, recorded time.Time, now time.Time) bool {
+	keep := r.For(item)
+	return keep > 0 && now.Sub(recorded) > keep
+}
+
+// ArchiveEntry describes an archived file. It's stored as a JSON sidecar
+// next to the file so the archive stays self-describing.
+type ArchiveEntry struct {
+	Item       MediaItem `json:"item"`
+	File       string    `json:"file"` // relative to the camera's archive directory
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+// recordedAt returns when the archived media was recorded, falling back to when it was archived
+func (e *ArchiveEntry) recordedAt() time.Time {
+	return mediaStartTime(e.Item, e.ArchivedAt)
+}
+
+// Archive keeps durable copies of a camera's media, laid out as
+// <dir>/<YYYY-MM-DD>/<downloadFilename> with a <downloadFilename>.json
+// sidecar holding the item's metadata. Unlike the cache, media stays in the
+// archive after the camera overwrites it, until its retention period ends.
+type Archive struct {
+	dir       string
+	retention ArchiveRetention
+
+	mu      sync.RWMutex
+	entries map[string]*ArchiveEntry // keyed by camera path
+	writing map[string]bool          // files being written, keyed by ArchiveEntry.File
+}
+
+// NewArchive opens the archive in dir, indexing any media already archived
+// there. loc is the time zone of the camera's filename timestamps.
+func NewArchive(dir string, retention ArchiveRetention, loc *time.Location) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	a := &Archive{
+		dir:       dir,
+		retention: retention,
+		entries:   make(map[string]*ArchiveEntry),
+		writing:   make(map[string]bool),
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var entry ArchiveEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Item.Path == "" {
+			log.Printf("Warning: ignoring unreadable archive sidecar %s", p)
+			return nil
+		}
+		if entry.Item.Start == nil {
+			// Archived before start times were recorded
+			setMediaTimes(&entry.Item, loc)
+		}
+		a.entries[entry.Item.Path] = &entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to index archive: %w", err)
+	}
+	return a, nil
+}
+
+// Lookup returns the archived copy of the media at a camera path
+func (a *Archive) Lookup(path string) (*ArchiveEntry, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entry, ok := a.entries[path]
+	return entry, ok
+}
+
+// FilePath returns the absolute path of an archived file
+func (a *Archive) FilePath(entry *ArchiveEntry) string {
+	return filepath.Join(a.dir, filepath.FromSlash(entry.File))
+}
+
+// Merge adds archived media that's no longer on the camera to items, flagged as archived
+func (a *Archive) Merge(items []MediaItem) []MediaItem {
+	onCamera := make(map[string]bool, len(items))
+	for _, item := range items {
+		onCamera[item.Path] = true
+	}
+
+	a.mu.RLock()
+	merged := items
+	for path, entry := range a.entries {
+		if !onCamera[path] {
+			item := entry.Item
+			item.Archived = true
+			merged = append(merged, item)
+		}
+	}
+	a.mu.RUnlock()
+
+	sortMediaItems(merged)
+	return merged
+}
+
+// Add copies a media item into the archive. The file is taken from the
+// camera's cache, fetching or converting it first if needed.
+func (a *Archive) Add(cam *Camera, item MediaItem) error {
+	var cachedPath string
+	var err error
+	if item.Type == "video" {
+		cachedPath, err = cam.cache.GetWithFile(item.URL, ".mp4", func(destPath string) error {
+			return cam.convertVideoToMP4(item.URL, destPath)
+		})
+	} else {
+		cachedPath, err = cam.cache.Get(item.URL, proxyCacheSuffix(item.URL), func() ([]byte, error) {
+			return cam.fetchFromCamera(item.URL)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	file := a.allocateFile(item)
+	a.writing[file] = true // reserve the name so concurrent adds pick different ones
+	a.mu.Unlock()
+
+	entry := &ArchiveEntry{Item: item, File: file, ArchivedAt: time.Now()}
+	err = a.write(cachedPath, entry)
+
+	a.mu.Lock()
+	delete(a.writing, file)
+	if err == nil {
+		a.entries[item.Path] = entry
+	}
+	a.mu.Unlock()
+	return err
+}
+
+// allocateFile picks the archive file name for an item, adding a numeric
+// suffix if another item already uses its download filename. The caller
+// must hold a.mu.
+func (a *Archive) allocateFile(item MediaItem) string {
+	dateDir := item.Date
+	if t, err := time.Parse("20060102", item.Date); err == nil {
+		dateDir = t.Format("2006-01-02")
+	}
+
+	name := archiveFileName(item)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	taken := make(map[string]bool, len(a.entries)+len(a.writing))
+	for _, entry := range a.entries {
+		taken[entry.File] = true
+	}
+	for file := range a.writing {
+		taken[file] = true
+	}
+
+	file := dateDir + "/" + name
+	for n := 2; taken[file]; n++ {
+		file = fmt.Sprintf("%s/%s-%d%s", dateDir, base, n, ext)
+	}
+	return file
+}
+
+// archiveFileName returns a file name for an item that's safe to use on disk
+func archiveFileName(item MediaItem) string {
+	name := item.DownloadFilename
+	if name == "" {
+		name = item.Name
+	}
+	if item.Type == "video" && filepath.Ext(name) != ".mp4" {
+		// Videos are archived as converted MP4s
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".mp4"
+	}
+	name = strings.NewReplacer("/", "_", "\\", "_", ":", "-").Replace(name)
+	return strings.TrimLeft(name, ".")
+}
+
+// write copies a cached file and its sidecar into the archive
+func (a *Archive) write(cachedPath string, entry *ArchiveEntry) error {
+	destPath := a.FilePath(entry)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	if err := copyFileAtomic(cachedPath, destPath); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", entry.Item.Path, err)
+	}
+
+	sidecar, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(destPath+".json", sidecar); err != nil {
+		_ = os.Remove(destPath)
+		return fmt.Errorf("failed to write archive metadata for %s: %w", entry.Item.Path, err)
+	}
+	return nil
+}
+
+// Prune deletes archived media that's past its retention period
+func (a *Archive) Prune() int {
+	now := time.Now()
+
+	a.mu.Lock()
+	var expired []*ArchiveEntry
+	for path, entry := range a.entries {
+		if a.retention.expired(entry.Item, entry.recordedAt(), now) {
+			expired = append(expired, entry)
+			delete(a.entries, path)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, entry := range expired {
+		filePath := a.FilePath(entry)
+		for _, p := range []string{filePath, filePath + ".json"} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to remove %s: %v", p, err)
+			}
+		}
+		// Remove the date directory once it's empty; this fails harmlessly otherwise
+		_ = os.Remove(filepath.Dir(filePath))
+	}
+	return len(expired)
+}
+
+// Sync archives any cataloged media that isn't archived yet and prunes
+// expired media. Media that's already past its retention period isn't
+// archived, and while the camera is offline only cached media is archived.
+func (a *Archive) Sync(cam *Camera, items []MediaItem) {
+	now := time.Now()
+	offline := cam.status().Offline
+
+	var pending []MediaItem
+	for _, item := range items {
+		if _, ok := a.Lookup(item.Path); ok {
+			continue
+		}
+		if a.retention.expired(item, mediaStartTime(item, now), now) {
+			continue
+		}
+		if offline && !cam.isCached(item) {
+			continue
+		}
+		pending = append(pending, item)
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Archive [%s]: archiving %d new items", cam.ID, len(pending))
+	}
+
+	// Limit concurrent fetches and conversions, as the background cacher does
+	sem := make(chan struct{}, config.MaxConcurrentConversions)
+	var wg sync.WaitGroup
+	for _, item := range pending {
+		wg.Add(1)
+		go func(item MediaItem) {
+			defer wg.Done()
+			sem <- struct{}{}        // Acquire
+			defer func() { <-sem }() // Release
+
+			if err := a.Add(cam, item); err != nil {
+				log.Printf("Archive [%s]: failed to archive %s: %v", cam.ID, item.Path, err)
+			}
+		}(item)
+	}
+	wg.Wait()
+
+	if pruned := a.Prune(); pruned > 0 {
+		log.Printf("Archive [%s]: removed %d items past their retention period", cam.ID, pruned)
+	}
+}
+
+// mediaStartTime returns the time an item's recording started, or fallback if it's unknown
+func mediaStartTime(item MediaItem, fallback time.Time) time.Time {
+	if item.Start == nil {
+		return fallback
+	}
+	return *item.Start
+}
+
+// copyFileAtomic copies src to dest via a temporary file in dest's directory
+func copyFileAtomic(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tempFile, err := os.CreateTemp(filepath.Dir(dest), "temp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer func() {
+		_ = os.Remove(tempPath)
+	}()
+
+	if _, err := io.Copy(tempFile, in); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, dest)
+}
+
+// writeFileAtomic writes data to dest via a temporary file in dest's directory
+func writeFileAtomic(dest string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(dest), "temp-*")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer func() {
+		_ = os.Remove(tempPath)
+	}()
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, dest)
+}
+
+// Archiver periodically syncs each camera's catalog and copies new media into its archive
+type Archiver struct {
+	interval time.Duration
+	cameras  []*Camera
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	running  sync.Mutex // Prevents concurrent archive runs
+}
+
+// NewArchiver creates a new archiver for the cameras that have an archive
+func NewArchiver(interval time.Duration, cameras []*Camera) *Archiver {
+	return &Archiver{
+		interval: interval,
+		cameras:  cameras,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Start begins the archive loop
+func (a *Archiver) Start() {
+	log.Printf("Starting archiver with interval %v", a.interval)
+
+	go func() {
+		defer close(a.doneCh)
+
+		a.runArchiveJob()
+
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				a.runArchiveJob()
+			case <-a.stopCh:
+				log.Println("Archiver received stop signal")
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the archiver and waits for any in-progress archive run to complete
+func (a *Archiver) Stop() {
+	close(a.stopCh)
+	<-a.doneCh
+	log.Println("Archiver stopped")
+}
+
+// runArchiveJob executes a single archive run, skipping it if the previous one is still in progress
+func (a *Archiver) runArchiveJob() {
+	if !a.running.TryLock() {
+		log.Println("Archive: skipping run, previous run still in progress")
+		return
+	}
+	defer a.running.Unlock()
+
+	startTime := time.Now()
+	for _, cam := range a.cameras {
+		if cam.archive == nil {
+			continue
+		}
+		// Archive whatever the catalog knows about even if the camera can't be
+		// reached right now; anything not cached yet is retried on the next run
+		if _, err := cam.syncCatalog(); err != nil {
+			log.Printf("Archive [%s]: failed to sync catalog: %v", cam.ID, err)
+		}
+		cam.archive.Sync(cam, cam.catalog.Items())
+	}
+	log.Printf("Archive: completed in %v", time.Since(startTime))
+}
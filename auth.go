@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Camera authentication modes, selected via CAMERA_AUTH_MODE
+const (
+	AuthModeAuto   = "auto"   // Whichever scheme the camera's challenge asks for, preferring Digest
+	AuthModeBasic  = "basic"  // Basic only
+	AuthModeDigest = "digest" // Digest only
+	AuthModeNone   = "none"   // No credentials
+)
+
+// CameraAuth adds credentials to requests sent to a camera
+type CameraAuth interface {
+	// Authorize sets credentials on an outgoing request, if any are known yet
+	Authorize(req *http.Request)
+	// Challenge inspects a 401 response and reports whether the request
+	// should be retried with updated credentials
+	Challenge(resp *http.Response) bool
+}
+
+// NewCameraAuth creates the CameraAuth implementation for the given mode
+func NewCameraAuth(mode, username, password string) (CameraAuth, error) {
+	switch mode {
+	case AuthModeAuto, "":
+		return &AutoAuth{
+			basic:  &BasicAuth{username: username, password: password},
+			digest: &DigestAuth{username: username, password: password},
+		}, nil
+	case AuthModeBasic:
+		return &BasicAuth{username: username, password: password}, nil
+	case AuthModeDigest:
+		return &DigestAuth{username: username, password: password}, nil
+	case AuthModeNone:
+		return noAuth{}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q (expected auto, basic, digest or none)", mode)
+	}
+}
+
+// noAuth sends requests without credentials
+type noAuth struct{}
+
+func (noAuth) Authorize(*http.Request)       {}
+func (noAuth) Challenge(*http.Response) bool { return false }
+
+// BasicAuth sends a pre-computed HTTP Basic Authorization header
+type BasicAuth struct {
+	username string
+	password string
+}
+
+// Authorize sets the Basic Authorization header
+func (a *BasicAuth) Authorize(req *http.Request) {
+	req.Header.Set("Authorization", "Basic "+basicAuth(a.username, a.password))
+}
+
+// Challenge never retries; Basic credentials don't change between attempts
+func (a *BasicAuth) Challenge(*http.Response) bool {
+	return false
+}
+
+// DigestAuth implements RFC 7616 HTTP Digest authentication.
+// The most recent challenge is reused for subsequent requests, incrementing
+// the nonce count each time, so only the first request (and any request
+// after the camera expires the nonce) costs an extra round trip.
+type DigestAuth struct {
+	username string
+	password string
+
+	mu        sync.Mutex
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string // "auth" or "" for legacy RFC 2069 digests
+	nc        uint32
+}
+
+// Authorize sets a Digest Authorization header if a challenge has been seen
+func (a *DigestAuth) Authorize(req *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.nonce == "" {
+		return
+	}
+
+	a.nc++
+	nc := fmt.Sprintf("%08x", a.nc)
+	cnonce := newCnonce()
+	uri := req.URL.RequestURI()
+
+	h := a.hashFunc()
+	ha1 := h(a.username + ":" + a.realm + ":" + a.password)
+	if strings.HasSuffix(strings.ToLower(a.algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + a.nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	var response string
+	if a.qop == "" {
+		response = h(ha1 + ":" + a.nonce + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + a.nonce + ":" + nc + ":" + cnonce + ":" + a.qop + ":" + ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, a.username),
+		fmt.Sprintf(`realm="%s"`, a.realm),
+		fmt.Sprintf(`nonce="%s"`, a.nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+	if a.algorithm != "" {
+		fields = append(fields, "algorithm="+a.algorithm)
+	}
+	if a.qop != "" {
+		fields = append(fields, "qop="+a.qop, "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	if a.opaque != "" {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, a.opaque))
+	}
+	req.Header.Set("Authorization", "Digest "+strings.Join(fields, ", "))
+}
+
+// Challenge records a Digest challenge from the response. A retry is only
+// worthwhile if this is the first challenge, the nonce changed, the camera
+// flagged the old nonce as stale, or the refused request was sent before the
+// challenge was known; otherwise the credentials are simply wrong.
+func (a *DigestAuth) Challenge(resp *http.Response) bool {
+	params, ok := findChallenge(resp, "Digest")
+	if !ok {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	retry := a.nonce == "" || params["nonce"] != a.nonce || strings.EqualFold(params["stale"], "true") ||
+		!sentScheme(resp, "Digest")
+
+	if params["nonce"] != a.nonce {
+		a.nc = 0
+	}
+	a.realm = params["realm"]
+	a.nonce = params["nonce"]
+	a.opaque = params["opaque"]
+	a.algorithm = params["algorithm"]
+	a.qop = ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			a.qop = "auth"
+		}
+	}
+
+	return retry && a.nonce != ""
+}
+
+// hashFunc returns the hex digest function for the challenge's algorithm
+func (a *DigestAuth) hashFunc() func(string) string {
+	var newHash func() hash.Hash
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(a.algorithm), "-sess")) {
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		newHash = md5.New
+	}
+	return func(s string) string {
+		h := newHash()
+		_, _ = io.WriteString(h, s)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// AutoAuth sends no credentials until the camera challenges for them, then
+// answers with Digest if the camera offers it, or Basic if that's all it
+// offers, so the password is never sent in the clear to a camera that
+// accepts Digest. The scheme is kept for later requests.
+type AutoAuth struct {
+	basic  *BasicAuth
+	digest *DigestAuth
+
+	mu     sync.Mutex
+	scheme string // AuthModeBasic or AuthModeDigest, once a challenge has been seen
+}
+
+// Authorize delegates to whichever scheme the camera asked for, if any
+func (a *AutoAuth) Authorize(req *http.Request) {
+	a.mu.Lock()
+	scheme := a.scheme
+	a.mu.Unlock()
+
+	switch scheme {
+	case AuthModeDigest:
+		a.digest.Authorize(req)
+	case AuthModeBasic:
+		a.basic.Authorize(req)
+	}
+}
+
+// Challenge picks the scheme to answer the camera's challenge with
+func (a *AutoAuth) Challenge(resp *http.Response) bool {
+	if a.digest.Challenge(resp) {
+		a.mu.Lock()
+		a.scheme = AuthModeDigest
+		a.mu.Unlock()
+		return true
+	}
+	if _, ok := findChallenge(resp, "Digest"); ok {
+		// A repeated Digest challenge: the credentials are wrong
+		return false
+	}
+	if _, ok := findChallenge(resp, "Basic"); !ok {
+		return false
+	}
+
+	if sentScheme(resp, "Basic") {
+		// Basic credentials were sent and refused
+		return false
+	}
+	a.mu.Lock()
+	a.scheme = AuthModeBasic
+	a.mu.Unlock()
+	return true
+}
+
+// authTransport applies a CameraAuth to every request and retries once when
+// the camera answers with a challenge the CameraAuth can satisfy
+type authTransport struct {
+	base http.RoundTripper
+	auth CameraAuth
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authReq := req.Clone(req.Context())
+	t.auth.Authorize(authReq)
+
+	resp, err := t.base.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// Can't replay the request body
+		return resp, nil
+	}
+	if !t.auth.Challenge(resp) {
+		return resp, nil
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	retryReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retryReq.Body = body
+	}
+	t.auth.Authorize(retryReq)
+	return t.base.RoundTrip(retryReq)
+}
+
+// findChallenge returns the parameters of the first WWW-Authenticate
+// challenge using the given scheme
+func findChallenge(resp *http.Response, scheme string) (map[string]string, bool) {
+	for _, header := range resp.Header.Values("WWW-Authenticate") {
+		s, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if strings.EqualFold(s, scheme) {
+			return parseAuthParams(rest), true
+		}
+	}
+	return nil, false
+}
+
+// sentScheme reports whether the request that got resp carried credentials
+// using the given scheme
+func sentScheme(resp *http.Response, scheme string) bool {
+	if resp.Request == nil {
+		return false
+	}
+	s, _, _ := strings.Cut(resp.Request.Header.Get("Authorization"), " ")
+	return strings.EqualFold(s, scheme)
+}
+
+// parseAuthParams parses a comma-separated list of key=value or
+// key="quoted value" pairs from an authentication header
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return params
+		}
+
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted string, possibly containing commas and escaped quotes
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+}
+
+// newCnonce returns a random client nonce
+func newCnonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func basicAuth(username, password string) string {
+	auth := username + ":" + password
+	return base64.StdEncoding.EncodeToString([]byte(auth))
+}
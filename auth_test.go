@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// authCamera is a test server requiring Basic or Digest authentication, which
+// checks every Digest response itself and records the credentials each
+// request carried
+type authCamera struct {
+	digest    bool   // offer Digest
+	basic     bool   // offer Basic
+	algorithm string // Digest algorithm to ask for
+	qop       string // "auth", or "" for RFC 2069 digests
+
+	mu       sync.Mutex
+	nonces   int
+	nonce    string
+	lastNC   int64
+	requests []string // "none", "basic" or "digest nc=N nonce=X" per request
+}
+
+const (
+	authUsername = "admin"
+	authPassword = "s3cret"
+	authRealm    = "IPCamera"
+)
+
+func (c *authCamera) start(t *testing.T) *httptest.Server {
+	t.Helper()
+	c.expireNonce()
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// expireNonce starts using a new nonce, as cameras do every so often
+func (c *authCamera) expireNonce() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nonces++
+	c.nonce = fmt.Sprintf("nonce%d", c.nonces)
+	c.lastNC = 0
+}
+
+func (c *authCamera) log() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.requests...)
+}
+
+func (c *authCamera) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	scheme, rest, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	stale := false
+	switch {
+	case scheme == "":
+		c.requests = append(c.requests, "none")
+	case scheme == "Basic":
+		c.requests = append(c.requests, "basic")
+		user, pass, _ := r.BasicAuth()
+		if c.basic && user == authUsername && pass == authPassword {
+			fmt.Fprint(w, "ok")
+			return
+		}
+	case scheme == "Digest":
+		p := parseAuthParams(rest)
+		c.requests = append(c.requests, fmt.Sprintf("digest nc=%s nonce=%s", p["nc"], p["nonce"]))
+		if !c.digest {
+			break
+		}
+		if p["nonce"] != c.nonce {
+			stale = true
+			break
+		}
+		if c.qop != "" {
+			nc, err := strconv.ParseInt(p["nc"], 16, 64)
+			if err != nil || nc <= c.lastNC || p["qop"] != c.qop || p["cnonce"] == "" {
+				break
+			}
+			c.lastNC = nc
+		}
+		if p["username"] == authUsername && p["realm"] == authRealm && p["uri"] == r.URL.RequestURI() &&
+			p["response"] == c.expectedResponse(r.Method, p) {
+			fmt.Fprint(w, "ok")
+			return
+		}
+	}
+
+	if c.digest {
+		challenge := fmt.Sprintf(`Digest realm="%s", nonce="%s", opaque="0a1b"`, authRealm, c.nonce)
+		if c.algorithm != "" {
+			challenge += ", algorithm=" + c.algorithm
+		}
+		if c.qop != "" {
+			challenge += `, qop="auth,auth-int"`
+		}
+		if stale {
+			challenge += ", stale=true"
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+	if c.basic {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, authRealm))
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// expectedResponse computes the digest the client should have sent
+func (c *authCamera) expectedResponse(method string, p map[string]string) string {
+	h := func(s string) string {
+		if strings.HasPrefix(c.algorithm, "SHA-256") {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h(authUsername + ":" + authRealm + ":" + authPassword)
+	if strings.HasSuffix(c.algorithm, "-sess") {
+		ha1 = h(ha1 + ":" + c.nonce + ":" + p["cnonce"])
+	}
+	ha2 := h(method + ":" + p["uri"])
+	if c.qop == "" {
+		return h(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+	return h(ha1 + ":" + c.nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":" + c.qop + ":" + ha2)
+}
+
+// authGet fetches a path through an authTransport, returning the status
+func authGet(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode
+}
+
+func authClient(auth CameraAuth) *http.Client {
+	return &http.Client{Transport: &authTransport{base: http.DefaultTransport, auth: auth}}
+}
+
+func TestDigestAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		qop       string
+	}{
+		{"RFC 2069", "", ""},
+		{"MD5", "MD5", "auth"},
+		{"MD5 by default", "", "auth"},
+		{"MD5-sess", "MD5-sess", "auth"},
+		{"SHA-256", "SHA-256", "auth"},
+		{"SHA-256-sess", "SHA-256-sess", "auth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			camera := &authCamera{digest: true, algorithm: tt.algorithm, qop: tt.qop}
+			srv := camera.start(t)
+			client := authClient(&DigestAuth{username: authUsername, password: authPassword})
+
+			for i := 0; i < 3; i++ {
+				if status := authGet(t, client, srv.URL+"/sd/?page="+strconv.Itoa(i)); status != http.StatusOK {
+					t.Fatalf("request %d: status %d", i, status)
+				}
+			}
+
+			// Only the first request waits for the challenge; the rest
+			// reuse its nonce with an increasing count
+			want := []string{"none", "digest nc=00000001 nonce=nonce1", "digest nc=00000002 nonce=nonce1", "digest nc=00000003 nonce=nonce1"}
+			if tt.qop == "" {
+				want = []string{"none", "digest nc= nonce=nonce1", "digest nc= nonce=nonce1", "digest nc= nonce=nonce1"}
+			}
+			if got := camera.log(); strings.Join(got, "; ") != strings.Join(want, "; ") {
+				t.Errorf("requests:\n got %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDigestAuthStale(t *testing.T) {
+	camera := &authCamera{digest: true, algorithm: "MD5", qop: "auth"}
+	srv := camera.start(t)
+	client := authClient(&DigestAuth{username: authUsername, password: authPassword})
+
+	if status := authGet(t, client, srv.URL+"/sd/"); status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+	camera.expireNonce()
+	if status := authGet(t, client, srv.URL+"/sd/"); status != http.StatusOK {
+		t.Fatalf("status %d after the nonce expired", status)
+	}
+
+	want := []string{
+		"none", "digest nc=00000001 nonce=nonce1",
+		"digest nc=00000002 nonce=nonce1", // refused as stale
+		"digest nc=00000001 nonce=nonce2",
+	}
+	if got := camera.log(); strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("requests:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestDigestAuthWrongPassword(t *testing.T) {
+	camera := &authCamera{digest: true, algorithm: "MD5", qop: "auth"}
+	srv := camera.start(t)
+	client := authClient(&DigestAuth{username: authUsername, password: "wrong"})
+
+	if status := authGet(t, client, srv.URL+"/sd/"); status != http.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", status)
+	}
+	// Retried once for the challenge, but not again for the same nonce
+	if got := camera.log(); len(got) != 2 {
+		t.Errorf("requests %q, want the first and one retry", got)
+	}
+}
+
+func TestAutoAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		camera   *authCamera
+		password string
+		status   int
+		want     []string // after two requests
+	}{
+		{
+			name:     "Digest preferred",
+			camera:   &authCamera{digest: true, basic: true, algorithm: "MD5", qop: "auth"},
+			password: authPassword,
+			status:   http.StatusOK,
+			want:     []string{"none", "digest nc=00000001 nonce=nonce1", "digest nc=00000002 nonce=nonce1"},
+		},
+		{
+			name:     "Basic fallback",
+			camera:   &authCamera{basic: true},
+			password: authPassword,
+			status:   http.StatusOK,
+			want:     []string{"none", "basic", "basic"},
+		},
+		{
+			name:     "Basic refused",
+			camera:   &authCamera{basic: true},
+			password: "wrong",
+			status:   http.StatusUnauthorized,
+			want:     []string{"none", "basic", "basic"},
+		},
+		{
+			name:     "Digest refused",
+			camera:   &authCamera{digest: true, basic: true, algorithm: "MD5", qop: "auth"},
+			password: "wrong",
+			status:   http.StatusUnauthorized,
+			want:     []string{"none", "digest nc=00000001 nonce=nonce1", "digest nc=00000002 nonce=nonce1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := tt.camera.start(t)
+			auth, err := NewCameraAuth(AuthModeAuto, authUsername, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := authClient(auth)
+
+			for i := 0; i < 2; i++ {
+				if status := authGet(t, client, srv.URL+"/sd/"); status != tt.status {
+					t.Fatalf("request %d: status %d, want %d", i, status, tt.status)
+				}
+			}
+
+			// No credentials are sent until the camera asks for them, and
+			// then only in the scheme it asked for
+			if got := tt.camera.log(); strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("requests:\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
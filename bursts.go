@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// burstGap is the longest pause between two frames of the same burst
+const burstGap = time.Second
+
+// frameBefore orders images by start time, then by sequence number within
+// the second, then by path
+func frameBefore(a, b MediaItem) bool {
+	if !a.Start.Equal(*b.Start) {
+		return a.Start.Before(*b.Start)
+	}
+	if a.Sequence != nil && b.Sequence != nil && *a.Sequence != *b.Sequence {
+		return *a.Sequence < *b.Sequence
+	}
+	return a.Path < b.Path
+}
+
+// groupBursts collapses images taken in bursts into single items. Images
+// with the same trigger that follow each other by no more than burstGap form
+// a burst, which is represented by its first frame with every frame listed
+// in Frames. Videos, lone images and images without a timestamp are
+// returned as they are.
+func groupBursts(items []MediaItem) []MediaItem {
+	var images, grouped []MediaItem
+	for _, item := range items {
+		if item.Type == "image" && item.Start != nil {
+			images = append(images, item)
+		} else {
+			grouped = append(grouped, item)
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return frameBefore(images[i], images[j])
+	})
+
+	// The burst currently being built for each trigger, as an index into grouped
+	current := make(map[string]int)
+	for _, img := range images {
+		if i, ok := current[img.Trigger]; ok {
+			frames := grouped[i].Frames
+			if !img.Start.After(frames[len(frames)-1].Start.Add(burstGap)) {
+				grouped[i].Frames = append(frames, img)
+				continue
+			}
+		}
+
+		burst := img
+		burst.Frames = []MediaItem{img}
+		grouped = append(grouped, burst)
+		current[img.Trigger] = len(grouped) - 1
+	}
+
+	for i := range grouped {
+		if len(grouped[i].Frames) == 1 {
+			grouped[i].Frames = nil
+		}
+	}
+	return grouped
+}
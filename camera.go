@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CameraConfig holds the connection settings for a single camera
+type CameraConfig struct {
+	ID            string
+	Name          string
+	URL           string
+	Username      string
+	Password      string
+	AuthMode      string
+	ListingFormat string
+	Source        string // SourceHTTP, SourceLocal or SourceFTP
+	SourceDir     string // SD card directory for SourceLocal, upload store for SourceFTP
+	Timezone      string // IANA time zone of filename timestamps; empty for the server's
+	AudioFormat   string // AudioFormatALaw, AudioFormatULaw or AudioFormatOff
+}
+
+// Camera is a configured camera along with its own cache and request semaphore
+type Camera struct {
+	CameraConfig
+	cache   *MediaCache
+	source  MediaSource
+	catalog *Catalog
+	archive *Archive // nil unless ARCHIVE_DIR is set
+	inbox   *Inbox   // nil unless SMTP_RECEIVER_ADDR is set
+
+	annotations *Annotations
+
+	location *time.Location // time zone of the camera's clock
+
+	statusMu     sync.Mutex
+	offlineSince time.Time // zero while the camera is reachable
+	lastError    string
+}
+
+// CameraStatus reports whether a camera could be reached at its last sync
+type CameraStatus struct {
+	Offline      bool       `json:"offline"`
+	OfflineSince *time.Time `json:"offlineSince,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// cameraIDPattern restricts camera IDs to values that are safe in URLs,
+// environment variable names and cache directory names
+var cameraIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// defaultCameraID is used when the legacy single-camera settings are in use
+const defaultCameraID = "default"
+
+var cameras []*Camera
+
+// loadCameraConfigs reads camera settings from the environment.
+// If CAMERAS is set (e.g. "front,back"), each camera is configured via
+// CAMERA_<ID>_URL, CAMERA_<ID>_NAME, CAMERA_<ID>_USERNAME, etc., falling back
+// to the unprefixed CAMERA_* settings for everything except the URL and name.
+// Otherwise a single camera is configured from CAMERA_URL, CAMERA_NAME, etc.
+func loadCameraConfigs() ([]CameraConfig, error) {
+	defaults := CameraConfig{
+		ID:            defaultCameraID,
+		Name:          getEnv("CAMERA_NAME", "camera"),
+		URL:           getEnv("CAMERA_URL", ""),
+		Username:      getEnv("CAMERA_USERNAME", "admin"),
+		Password:      getEnv("CAMERA_PASSWORD", ""),
+		AuthMode:      strings.ToLower(getEnv("CAMERA_AUTH_MODE", AuthModeAuto)),
+		ListingFormat: strings.ToLower(getEnv("CAMERA_LISTING_FORMAT", listingFormatAuto)),
+		Source:        strings.ToLower(getEnv("CAMERA_SOURCE", "")),
+		SourceDir:     getEnv("CAMERA_SOURCE_DIR", ""),
+		Timezone:      getEnv("CAMERA_TIMEZONE", ""),
+		AudioFormat:   strings.ToLower(getEnv("CAMERA_AUDIO_FORMAT", AudioFormatALaw)),
+	}
+
+	ids := getEnv("CAMERAS", "")
+	if ids == "" {
+		return []CameraConfig{withDefaultSource(defaults)}, nil
+	}
+
+	var configs []CameraConfig
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.ToLower(strings.TrimSpace(id))
+		if id == "" {
+			continue
+		}
+		if !cameraIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid camera ID %q: must contain only a-z, 0-9, '-' and '_'", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate camera ID %q", id)
+		}
+		seen[id] = true
+
+		prefix := cameraEnvPrefix(id)
+		configs = append(configs, withDefaultSource(CameraConfig{
+			ID:            id,
+			Name:          getEnv(prefix+"NAME", id),
+			URL:           getEnv(prefix+"URL", ""),
+			Username:      getEnv(prefix+"USERNAME", defaults.Username),
+			Password:      getEnv(prefix+"PASSWORD", defaults.Password),
+			AuthMode:      strings.ToLower(getEnv(prefix+"AUTH_MODE", defaults.AuthMode)),
+			ListingFormat: strings.ToLower(getEnv(prefix+"LISTING_FORMAT", defaults.ListingFormat)),
+			Source:        strings.ToLower(getEnv(prefix+"SOURCE", "")),
+			SourceDir:     getEnv(prefix+"SOURCE_DIR", ""),
+			Timezone:      getEnv(prefix+"TIMEZONE", defaults.Timezone),
+			AudioFormat:   strings.ToLower(getEnv(prefix+"AUDIO_FORMAT", defaults.AudioFormat)),
+		}))
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("CAMERAS is set but lists no cameras")
+	}
+	return configs, nil
+}
+
+// withDefaultSource fills in the source type when it isn't set explicitly:
+// a camera with a source directory reads from disk, otherwise from HTTP.
+// An FTP camera's uploads are stored in FTP_DIR/<id> unless it has its own
+// source directory.
+func withDefaultSource(cfg CameraConfig) CameraConfig {
+	if cfg.Source == "" {
+		if cfg.SourceDir != "" {
+			cfg.Source = SourceLocal
+		} else {
+			cfg.Source = SourceHTTP
+		}
+	}
+	if cfg.Source == SourceFTP && cfg.SourceDir == "" {
+		if dir := getEnv("FTP_DIR", ""); dir != "" {
+			cfg.SourceDir = filepath.Join(dir, cfg.ID)
+		}
+	}
+	return cfg
+}
+
+// cameraEnvPrefix returns the environment variable prefix for a camera ID,
+// e.g. "front-door" -> "CAMERA_FRONT_DOOR_"
+func cameraEnvPrefix(id string) string {
+	return "CAMERA_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+}
+
+// NewCamera creates a camera with its own cache subdirectory under cacheRoot,
+// which also holds the camera's media catalog
+func NewCamera(cfg CameraConfig, cacheRoot string) (*Camera, error) {
+	switch cfg.AudioFormat {
+	case AudioFormatALaw, AudioFormatULaw, AudioFormatOff:
+	default:
+		return nil, fmt.Errorf("unknown audio format %q (expected alaw, ulaw or off)", cfg.AudioFormat)
+	}
+	location, err := loadCameraLocation(cfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	source, err := newMediaSource(cfg, location)
+	if err != nil {
+		return nil, err
+	}
+	cacheDir := filepath.Join(cacheRoot, cfg.ID)
+	cache, err := NewMediaCache(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := NewCatalog(filepath.Join(cacheDir, "catalog.json"), location)
+	if err != nil {
+		return nil, err
+	}
+	return &Camera{
+		CameraConfig: cfg,
+		cache:        cache,
+		source:       source,
+		catalog:      catalog,
+		location:     location,
+	}, nil
+}
+
+// newMediaSource creates the MediaSource selected by a camera's configuration,
+// for a camera whose clock is in loc
+func newMediaSource(cfg CameraConfig, loc *time.Location) (MediaSource, error) {
+	switch cfg.Source {
+	case SourceHTTP:
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("no camera URL configured")
+		}
+		auth, err := NewCameraAuth(cfg.AuthMode, cfg.Username, cfg.Password)
+		if err != nil {
+			return nil, err
+		}
+		parser, err := lookupDirectoryParser(cfg.ListingFormat)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{
+			Transport: &authTransport{base: http.DefaultTransport, auth: auth},
+		}
+		return NewHTTPSource(cfg.URL, client, parser, loc), nil
+	case SourceLocal:
+		if cfg.SourceDir == "" {
+			return nil, fmt.Errorf("no source directory configured")
+		}
+		return NewLocalSource(cfg.SourceDir)
+	case SourceFTP:
+		if cfg.SourceDir == "" {
+			return nil, fmt.Errorf("FTP_DIR is not set")
+		}
+		return newFTPSource(cfg.SourceDir)
+	default:
+		return nil, fmt.Errorf("unknown source %q (expected http, local or ftp)", cfg.Source)
+	}
+}
+
+// lookupCamera returns the camera with the given ID, or nil if there is none
+func lookupCamera(id string) *Camera {
+	for _, cam := range cameras {
+		if cam.ID == id {
+			return cam
+		}
+	}
+	return nil
+}
+
+// cameraForRequest resolves the camera selected by the "camera" query parameter.
+// When the parameter is omitted, the first configured camera is used so that
+// single-camera clients keep working unchanged. On failure an error response
+// is written and nil is returned.
+func cameraForRequest(w http.ResponseWriter, r *http.Request) *Camera {
+	id := r.URL.Query().Get("camera")
+	if id == "" {
+		return cameras[0]
+	}
+	cam := lookupCamera(id)
+	if cam == nil {
+		http.Error(w, "Unknown camera", http.StatusNotFound)
+		return nil
+	}
+	return cam
+}
+
+// proxyURL returns the /api/proxy URL for a file on this camera
+func (cam *Camera) proxyURL(targetURL string) string {
+	return "/api/proxy?camera=" + url.QueryEscape(cam.ID) + "&url=" + url.QueryEscape(targetURL)
+}
+
+// videoURL returns the /api/video URL for a video at the given camera path
+func (cam *Camera) videoURL(path string) string {
+	return "/api/video/" + url.QueryEscape(path) + ".mp4?camera=" + url.QueryEscape(cam.ID)
+}
+
+// setReachable records the outcome of the latest attempt to sync with the camera
+func (cam *Camera) setReachable(err error) {
+	cam.statusMu.Lock()
+	defer cam.statusMu.Unlock()
+
+	if err == nil {
+		if !cam.offlineSince.IsZero() {
+			log.Printf("Camera %s is back online", cam.ID)
+		}
+		cam.offlineSince = time.Time{}
+		cam.lastError = ""
+		return
+	}
+	if cam.offlineSince.IsZero() {
+		log.Printf("Camera %s is offline, serving cached media: %v", cam.ID, err)
+		cam.offlineSince = time.Now()
+	}
+	cam.lastError = err.Error()
+}
+
+// status returns the camera's current reachability
+func (cam *Camera) status() CameraStatus {
+	cam.statusMu.Lock()
+	defer cam.statusMu.Unlock()
+
+	if cam.offlineSince.IsZero() {
+		return CameraStatus{}
+	}
+	since := cam.offlineSince
+	return CameraStatus{Offline: true, OfflineSince: &since, Error: cam.lastError}
+}
+
+// isCached reports whether a media item can be served without the camera,
+// from either the cache or the archive
+func (cam *Camera) isCached(item MediaItem) bool {
+	if _, ok := cam.archivedFile(item.Path); ok {
+		return true
+	}
+	if item.Type == "video" {
+		return cam.cache.Has(item.URL, ".mp4")
+	}
+	return cam.cache.Has(item.URL, proxyCacheSuffix(item.URL))
+}
+
+// archivedFile returns the archived copy of the media at a camera path, if there is one
+func (cam *Camera) archivedFile(path string) (string, bool) {
+	if cam.archive == nil {
+		return "", false
+	}
+	entry, ok := cam.archive.Lookup(path)
+	if !ok {
+		return "", false
+	}
+	return cam.archive.FilePath(entry), true
+}
+
+// snapshotURL returns the camera URL of the image that represents an item:
+// the item itself for images, or the thumbnail matched to a video
+func (cam *Camera) snapshotURL(item MediaItem) (string, bool) {
+	if item.Type == "image" {
+		return item.URL, true
+	}
+	if item.ThumbnailURL == "" {
+		return "", false
+	}
+	u, err := url.Parse(item.ThumbnailURL)
+	if err != nil {
+		return "", false
+	}
+	targetURL := u.Query().Get("url")
+	return targetURL, targetURL != ""
+}
+
+// snapshot returns the JPEG bytes of the image that represents an item, from
+// the media cache if possible. It returns nil for videos without a thumbnail.
+func (cam *Camera) snapshot(item MediaItem) ([]byte, error) {
+	targetURL, ok := cam.snapshotURL(item)
+	if !ok {
+		return nil, nil
+	}
+	cachedPath, err := cam.cache.Get(targetURL, proxyCacheSuffix(targetURL), func() ([]byte, error) {
+		return cam.fetchFromCamera(targetURL)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(cachedPath)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// catalogRefreshInterval is the minimum time between syncs triggered by API requests
+const catalogRefreshInterval = 30 * time.Second
+
+// catalogVersion is bumped whenever the fields derived from listings change,
+// so that catalogs written by older versions are re-crawled
+const catalogVersion = 4
+
+// CatalogEntry is a media item recorded in the catalog
+type CatalogEntry struct {
+	Item      MediaItem `json:"item"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// CatalogChanges describes the differences found by a catalog sync
+type CatalogChanges struct {
+	Added   []MediaItem
+	Removed []MediaItem
+	Initial bool // the catalog was empty, so everything was added
+}
+
+// catalogFile is the on-disk representation of a Catalog
+type catalogFile struct {
+	Version    int               `json:"version"`
+	Timezone   string            `json:"timezone"` // camera time zone the entries' times were parsed in
+	LastSynced time.Time         `json:"lastSynced"`
+	Dates      map[string]string `json:"dates"` // date directory -> Modified value when last listed
+	Entries    []*CatalogEntry   `json:"entries"`
+}
+
+// Catalog is a persistent index of a camera's media, keyed by camera path.
+// Syncing only re-lists today's date directory and directories whose
+// Modified value changed since they were last listed, so the full SD card
+// only needs to be crawled once. Listings without Modified values can't show
+// a change, so such directories are re-listed until a sync runs on a later
+// day.
+type Catalog struct {
+	path     string
+	location *time.Location
+
+	mu         sync.RWMutex
+	entries    map[string]*CatalogEntry
+	dates      map[string]string
+	lastSynced time.Time
+
+	syncing sync.Mutex // held while a sync is in progress
+}
+
+// NewCatalog loads the catalog stored at path, starting empty if it doesn't
+// exist. loc is the camera's time zone; a catalog parsed in another zone is
+// re-crawled.
+func NewCatalog(path string, loc *time.Location) (*Catalog, error) {
+	c := &Catalog{
+		path:     path,
+		location: loc,
+		entries:  make(map[string]*CatalogEntry),
+		dates:    make(map[string]string),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+
+	var file catalogFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		// A corrupt catalog only costs a full re-crawl
+		log.Printf("Warning: ignoring unreadable catalog %s: %v", path, err)
+		return c, nil
+	}
+	if file.Version != catalogVersion {
+		log.Printf("Catalog %s is from an older version, re-crawling", path)
+		return c, nil
+	}
+	if zone := locationID(loc); file.Timezone != zone {
+		log.Printf("Camera time zone changed from %q to %q, re-crawling catalog %s", file.Timezone, zone, path)
+		return c, nil
+	}
+	c.lastSynced = file.LastSynced
+	for date, modified := range file.Dates {
+		c.dates[date] = modified
+	}
+	for _, entry := range file.Entries {
+		c.entries[entry.Item.Path] = entry
+	}
+	return c, nil
+}
+
+// LastSynced returns the time of the last successful sync, or the zero time if there has been none
+func (c *Catalog) LastSynced() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastSynced
+}
+
+// Items returns the cataloged media, ordered by date and path
+func (c *Catalog) Items() []MediaItem {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	items := make([]MediaItem, 0, len(c.entries))
+	for _, entry := range c.entries {
+		items = append(items, entry.Item)
+	}
+	sortMediaItems(items)
+	return items
+}
+
+// Sync brings the catalog up to date with the camera and saves it.
+// Only one sync runs at a time; concurrent callers wait for it to finish.
+func (c *Catalog) Sync(cam *Camera) (*CatalogChanges, error) {
+	c.syncing.Lock()
+	defer c.syncing.Unlock()
+	return c.sync(cam)
+}
+
+// SyncAsync starts a background sync unless one is already running or the
+// catalog was synced within catalogRefreshInterval. done is called with the
+// result of the sync.
+func (c *Catalog) SyncAsync(cam *Camera, done func(*CatalogChanges, error)) {
+	if time.Since(c.LastSynced()) < catalogRefreshInterval {
+		return
+	}
+	if !c.syncing.TryLock() {
+		return
+	}
+	go func() {
+		defer c.syncing.Unlock()
+		changes, err := c.sync(cam)
+		if err != nil {
+			log.Printf("Catalog sync for %s failed: %v", cam.ID, err)
+		}
+		done(changes, err)
+	}()
+}
+
+// sync does the work of Sync; the caller must hold c.syncing
+func (c *Catalog) sync(cam *Camera) (*CatalogChanges, error) {
+	startTime := time.Now()
+
+	dates, err := cam.source.ListDates()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch root directory: %w", err)
+	}
+
+	c.mu.RLock()
+	initial := c.lastSynced.IsZero()
+	lastSyncedDay := c.lastSynced.In(cam.location).Format("20060102")
+	knownDates := make(map[string]string, len(c.dates))
+	for date, modified := range c.dates {
+		knownDates[date] = modified
+	}
+	c.mu.RUnlock()
+
+	// Re-list today's directory, since the camera is still writing to it,
+	// and any directory that is new or whose Modified value changed. A
+	// directory without a Modified value is also re-listed if it was today's
+	// at the last sync, to pick up what was written after that sync and
+	// before midnight.
+	today := time.Now().In(cam.location).Format("20060102")
+	present := make(map[string]bool, len(dates))
+	listed := make(map[string][]MediaItem)
+	listedModified := make(map[string]string)
+	for _, date := range dates {
+		name := strings.TrimSuffix(date.Name, "/")
+		present[name] = true
+
+		modified, known := knownDates[name]
+		unchanged := known && modified == date.Modified
+		if date.Modified == "" && name >= lastSyncedDay {
+			unchanged = false
+		}
+		if unchanged && name != today {
+			continue
+		}
+
+		media, err := cam.fetchDateMedia(date.Name)
+		if err != nil {
+			// Keep what we had for this date and retry on the next sync
+			log.Printf("Warning: failed to fetch media for %s: %v", date.Name, err)
+			continue
+		}
+		listed[name] = media
+		listedModified[name] = date.Modified
+	}
+
+	now := time.Now()
+	changes := &CatalogChanges{Initial: initial}
+
+	c.mu.Lock()
+	// Rebuild the re-listed dates, carrying over first-seen times
+	for date, media := range listed {
+		previous := make(map[string]*CatalogEntry)
+		for path, entry := range c.entries {
+			if entry.Item.Date == date {
+				previous[path] = entry
+				delete(c.entries, path)
+			}
+		}
+
+		for _, item := range media {
+			entry, ok := previous[item.Path]
+			if ok {
+				delete(previous, item.Path)
+			} else {
+				entry = &CatalogEntry{FirstSeen: now}
+				changes.Added = append(changes.Added, item)
+			}
+			entry.Item = item
+			entry.LastSeen = now
+			c.entries[item.Path] = entry
+		}
+
+		for _, entry := range previous {
+			changes.Removed = append(changes.Removed, entry.Item)
+		}
+		c.dates[date] = listedModified[date]
+	}
+
+	// Drop dates that are gone from the card; the camera overwrote them
+	// when it wrapped around. Everything else is still there as of now.
+	for path, entry := range c.entries {
+		if !present[entry.Item.Date] {
+			delete(c.entries, path)
+			changes.Removed = append(changes.Removed, entry.Item)
+		} else {
+			entry.LastSeen = now
+		}
+	}
+	for date := range c.dates {
+		if !present[date] {
+			delete(c.dates, date)
+		}
+	}
+
+	c.lastSynced = now
+	c.mu.Unlock()
+
+	if err := c.save(); err != nil {
+		log.Printf("Warning: failed to save catalog for %s: %v", cam.ID, err)
+	}
+
+	log.Printf("Catalog sync for %s: re-listed %d of %d dates, %d added, %d removed in %v",
+		cam.ID, len(listed), len(dates), len(changes.Added), len(changes.Removed), time.Since(startTime))
+
+	sortMediaItems(changes.Added)
+	sortMediaItems(changes.Removed)
+	return changes, nil
+}
+
+// save writes the catalog to disk atomically
+func (c *Catalog) save() error {
+	c.mu.RLock()
+	file := catalogFile{
+		Version:    catalogVersion,
+		Timezone:   locationID(c.location),
+		LastSynced: c.lastSynced,
+		Dates:      c.dates,
+		Entries:    make([]*CatalogEntry, 0, len(c.entries)),
+	}
+	for _, entry := range c.entries {
+		file.Entries = append(file.Entries, entry)
+	}
+	sort.Slice(file.Entries, func(i, j int) bool {
+		return file.Entries[i].Item.Path < file.Entries[j].Item.Path
+	})
+	data, err := json.Marshal(file)
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(c.path), "temp-catalog-*.json")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer func() {
+		_ = os.Remove(tempPath)
+	}()
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, c.path)
+}
+
+// sortMediaItems orders media by date directory, then path
+func sortMediaItems(items []MediaItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Date != items[j].Date {
+			return items[i].Date < items[j].Date
+		}
+		return items[i].Path < items[j].Path
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listingSource is a MediaSource whose listings give no Modified values, as
+// with JSON listings that only have names
+type listingSource struct {
+	files []string
+	block chan struct{} // if not nil, listing dates waits until it's closed
+}
+
+func (s *listingSource) URL(p string) string { return "http://camera.local/" + p }
+
+func (s *listingSource) ListDates() ([]DirectoryEntry, error) {
+	if s.block != nil {
+		<-s.block
+	}
+	seen := make(map[string]bool)
+	var dates []DirectoryEntry
+	for _, f := range s.files {
+		date := f[:8]
+		if !seen[date] {
+			seen[date] = true
+			dates = append(dates, DirectoryEntry{Name: date + "/", Path: date + "/", IsDirectory: true})
+		}
+	}
+	return dates, nil
+}
+
+func (s *listingSource) ListMedia(datePath string) ([]DirectoryEntry, error) {
+	var files []DirectoryEntry
+	for _, f := range s.files {
+		if f[:8] == datePath[:8] {
+			files = append(files, DirectoryEntry{Name: path.Base(f), Path: f})
+		}
+	}
+	return files, nil
+}
+
+func (s *listingSource) Open(string) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestCatalogSyncWithoutModified(t *testing.T) {
+	cam := newSDCardTestCamera(t, nil)
+	src := &listingSource{files: []string{"20251121/images000/A25112121235600.jpg"}}
+	cam.source = src
+	catalog, err := NewCatalog(filepath.Join(t.TempDir(), "catalog.json"), cam.location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(name string, want ...string) {
+		t.Helper()
+		changes, err := catalog.Sync(cam)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var added []string
+		for _, item := range changes.Added {
+			added = append(added, item.Name)
+		}
+		sort.Strings(added)
+		if strings.Join(added, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: added %q, want %q", name, added, want)
+		}
+	}
+	sync("initial sync", "A25112121235600.jpg")
+
+	// The first sync after midnight picks up what was written late on the
+	// day the last sync ran
+	catalog.lastSynced = time.Date(2025, 11, 21, 23, 58, 0, 0, cam.location)
+	src.files = append(src.files, "20251121/images000/A25112123590000.jpg")
+	sync("first sync on the next day", "A25112123590000.jpg")
+
+	// After that the date is settled
+	src.files = append(src.files, "20251121/images000/A25112123595900.jpg")
+	sync("later sync")
+}
+
+func TestHasMediaDoesNotSync(t *testing.T) {
+	cam := newSDCardTestCamera(t, nil)
+	src := &listingSource{files: []string{"20251121/images000/A25112121235600.jpg"}}
+	cam.source = src
+	if _, err := cam.catalog.Sync(cam); err != nil {
+		t.Fatal(err)
+	}
+
+	// A sync would be due, and would hang listing the dates
+	cam.catalog.lastSynced = time.Now().Add(-time.Hour)
+	src.block = make(chan struct{})
+	defer close(src.block)
+
+	if !cam.hasMedia("20251121/images000/A25112121235600.jpg") {
+		t.Error("cataloged image not found")
+	}
+	if cam.hasMedia("20251121/images000/A25112121235700.jpg") {
+		t.Error("unknown image found")
+	}
+	if !cam.catalog.syncing.TryLock() {
+		t.Fatal("checking for media started a sync")
+	}
+	cam.catalog.syncing.Unlock()
+}
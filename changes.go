@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of MediaChange
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed" // overwritten on the SD card
+)
+
+// maxChanges is how many changes the feed keeps for clients catching up
+const maxChanges = 1000
+
+// MediaChange is a difference found between two successive crawls of a camera
+type MediaChange struct {
+	Cursor     string    `json:"cursor"` // position in the feed, for resuming after this change
+	Type       string    `json:"type"`   // ChangeAdded or ChangeRemoved
+	Camera     string    `json:"camera"`
+	DetectedAt time.Time `json:"detectedAt"`
+	Item       MediaItem `json:"item"`
+}
+
+// ChangeFeed keeps recent media changes across all cameras in memory and
+// fans them out to subscribers. Cursors include the time the feed was
+// created, so cursors from before a restart are recognized as stale.
+type ChangeFeed struct {
+	epoch string
+
+	mu          sync.Mutex
+	changes     []MediaChange // oldest first, at most maxChanges
+	lastSeq     uint64
+	subscribers map[chan MediaChange]struct{}
+	closed      bool
+}
+
+// NewChangeFeed creates an empty change feed
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		subscribers: make(map[chan MediaChange]struct{}),
+	}
+}
+
+var changeFeed = NewChangeFeed()
+
+// cursor returns the cursor for a position in the feed
+func (f *ChangeFeed) cursor(seq uint64) string {
+	return f.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseCursor returns the position a cursor refers to. ok is false for
+// cursors that are malformed or from before a restart.
+func (f *ChangeFeed) parseCursor(cursor string) (seq uint64, ok bool) {
+	epoch, n, found := strings.Cut(cursor, "-")
+	if !found || epoch != f.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(n, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// Publish records the changes found by a catalog sync and sends them to
+// subscribers. The changes from a camera's first crawl aren't published,
+// since everything on the card would show up as new.
+func (f *ChangeFeed) Publish(cam *Camera, changes *CatalogChanges) {
+	if changes == nil || changes.Initial {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	add := func(kind string, items []MediaItem) {
+		for _, item := range items {
+			f.lastSeq++
+			change := MediaChange{
+				Cursor:     f.cursor(f.lastSeq),
+				Type:       kind,
+				Camera:     cam.ID,
+				DetectedAt: now,
+				Item:       item,
+			}
+			f.changes = append(f.changes, change)
+
+			for ch := range f.subscribers {
+				select {
+				case ch <- change:
+				default:
+					// The subscriber isn't keeping up; drop it rather than
+					// block the sync. It can resume from its last cursor.
+					delete(f.subscribers, ch)
+					close(ch)
+				}
+			}
+		}
+	}
+	add(ChangeRemoved, changes.Removed)
+	add(ChangeAdded, changes.Added)
+
+	if len(f.changes) > maxChanges {
+		f.changes = append([]MediaChange(nil), f.changes[len(f.changes)-maxChanges:]...)
+	}
+}
+
+// Cursor returns the cursor for the current end of the feed
+func (f *ChangeFeed) Cursor() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cursor(f.lastSeq)
+}
+
+// Since returns the changes after cursor, along with the cursor for the end
+// of the feed. complete is false if the cursor is stale or some changes after
+// it were already discarded, in which case the client should reload the full
+// media list.
+func (f *ChangeFeed) Since(cursor string) (changes []MediaChange, next string, complete bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.since(cursor)
+}
+
+// since does the work of Since; the caller must hold f.mu
+func (f *ChangeFeed) since(cursor string) ([]MediaChange, string, bool) {
+	next := f.cursor(f.lastSeq)
+	seq, ok := f.parseCursor(cursor)
+	if !ok || seq > f.lastSeq {
+		return []MediaChange{}, next, false
+	}
+
+	oldest := f.lastSeq + 1 - uint64(len(f.changes))
+	if seq+1 < oldest {
+		return []MediaChange{}, next, false
+	}
+	changes := append([]MediaChange{}, f.changes[len(f.changes)-int(f.lastSeq-seq):]...)
+	return changes, next, true
+}
+
+// Subscription receives the changes published to a ChangeFeed
+type Subscription struct {
+	Cursor   string             // end of the feed when subscribing
+	Backlog  []MediaChange      // changes after the cursor subscribed from
+	Complete bool               // false if changes after the cursor were missed, as for Since
+	Changes  <-chan MediaChange // closed if the subscriber falls behind or the feed is closed
+
+	feed *ChangeFeed
+	ch   chan MediaChange
+}
+
+// Subscribe starts receiving every change published from now on. If cursor
+// is not empty, the changes after it are included in the Backlog, so that
+// nothing is missed between catching up and subscribing. Call Close when done.
+func (f *ChangeFeed) Subscribe(cursor string) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, fmt.Errorf("change feed is closed")
+	}
+
+	sub := &Subscription{Cursor: f.cursor(f.lastSeq), Complete: true, feed: f, ch: make(chan MediaChange, 64)}
+	sub.Changes = sub.ch
+	if cursor != "" {
+		sub.Backlog, _, sub.Complete = f.since(cursor)
+	}
+	f.subscribers[sub.ch] = struct{}{}
+	return sub, nil
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	if _, ok := s.feed.subscribers[s.ch]; ok {
+		delete(s.feed.subscribers, s.ch)
+		close(s.ch)
+	}
+}
+
+// Close disconnects all subscribers, so that streaming requests finish
+// during shutdown
+func (f *ChangeFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for ch := range f.subscribers {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Follow calls handle for every change published until stop is closed or
+// the feed is closed. If handle falls behind and the subscription is
+// dropped, it resubscribes from the last change it saw, so changes are only
+// lost if more than maxChanges were published in the meantime.
+func (f *ChangeFeed) Follow(name string, stop <-chan struct{}, handle func(MediaChange)) {
+	cursor := ""
+	for {
+		sub, err := f.Subscribe(cursor)
+		if err != nil {
+			return
+		}
+		if !sub.Complete {
+			log.Printf("%s: missed some media changes while catching up", name)
+		}
+		for _, change := range sub.Backlog {
+			handle(change)
+			cursor = change.Cursor
+		}
+		if cursor == "" {
+			cursor = sub.Cursor
+		}
+
+	receive:
+		for {
+			select {
+			case change, ok := <-sub.Changes:
+				if !ok {
+					break receive
+				}
+				handle(change)
+				cursor = change.Cursor
+			case <-stop:
+				sub.Close()
+				return
+			}
+		}
+	}
+}
@@ -34,8 +34,9 @@ echo "[$(date -Iseconds)] Files before cleanup: $FILES_BEFORE"
 # Find and remove files older than specified days
 # -type f: only files (not directories)
 # -mtime +N: modified more than N days ago
+# ! -name catalog.json: keep media catalogs, which are rewritten on every sync
 # -delete: delete matching files
-DELETED=$(find "$CACHE_ROOT" -type f -mtime "+$AGE_DAYS" -delete -print | wc -l)
+DELETED=$(find "$CACHE_ROOT" -type f -mtime "+$AGE_DAYS" ! -name catalog.json -delete -print | wc -l)
 
 # Count files after cleanup
 FILES_AFTER=$(find "$CACHE_ROOT" -type f | wc -l)
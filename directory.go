@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// DirectoryParser turns a camera's SD card directory listing into entries.
+// Camera firmwares differ in how they render these pages, so each known
+// layout gets its own parser.
+type DirectoryParser interface {
+	// Name identifies the parser in CAMERA_LISTING_FORMAT and in logs
+	Name() string
+	// Detect reports whether a response looks like this parser's format
+	Detect(contentType string, body []byte) bool
+	// Parse extracts the entries from a listing of basePath, formatting any
+	// absolute times in loc, the camera's time zone
+	Parse(body []byte, basePath string, loc *time.Location) ([]DirectoryEntry, error)
+}
+
+// directoryParsers lists the built-in parsers in detection order; the
+// Hi3510 table parser comes last since it's the historical default
+var directoryParsers = []DirectoryParser{
+	jsonListingParser{},
+	autoindexParser{},
+	hi3510TableParser{},
+}
+
+// listingFormatAuto selects a parser per response based on its content
+const listingFormatAuto = "auto"
+
+// lookupDirectoryParser returns the parser with the given name, or nil for auto-detection
+func lookupDirectoryParser(name string) (DirectoryParser, error) {
+	if name == "" || name == listingFormatAuto {
+		return nil, nil
+	}
+	for _, p := range directoryParsers {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown listing format %q", name)
+}
+
+// detectDirectoryParser picks the parser for a response, falling back to the Hi3510 table parser
+func detectDirectoryParser(contentType string, body []byte) DirectoryParser {
+	for _, p := range directoryParsers {
+		if p.Detect(contentType, body) {
+			return p
+		}
+	}
+	return hi3510TableParser{}
+}
+
+// listingEntryPath builds an entry's path from the listing's base path
+// without doubling slashes, keeping a trailing slash on directories
+func listingEntryPath(basePath, name string) string {
+	if basePath == "" {
+		return name
+	}
+	cleanBase := strings.TrimSuffix(basePath, "/")
+	cleanName := strings.Trim(name, "/")
+	if strings.HasSuffix(name, "/") {
+		cleanName += "/"
+	}
+	return cleanBase + "/" + cleanName
+}
+
+// newListingEntry creates a DirectoryEntry for a name found in a listing of basePath
+func newListingEntry(name, basePath, modified, size string) DirectoryEntry {
+	return DirectoryEntry{
+		Name:        name,
+		Path:        listingEntryPath(basePath, name),
+		Modified:    modified,
+		Size:        size,
+		IsDirectory: strings.HasSuffix(name, "/"),
+	}
+}
+
+// hi3510TableParser handles the stock Hi3510 SD card page: one <tr> per
+// entry with three <td> cells holding the link, modification time and size
+type hi3510TableParser struct{}
+
+func (hi3510TableParser) Name() string { return "hi3510" }
+
+func (hi3510TableParser) Detect(_ string, body []byte) bool {
+	return bytes.Contains(bytes.ToLower(body), []byte("<tr"))
+}
+
+func (hi3510TableParser) Parse(body []byte, basePath string, _ *time.Location) ([]DirectoryEntry, error) {
+	var entries []DirectoryEntry
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	var traverse func(*html.Node)
+	traverse = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "tr" {
+			entry := parseTableRow(n, basePath)
+			if entry != nil {
+				entries = append(entries, *entry)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			traverse(c)
+		}
+	}
+
+	traverse(doc)
+	return entries, nil
+}
+
+func parseTableRow(tr *html.Node, basePath string) *DirectoryEntry {
+	var cells []*html.Node
+
+	for c := tr.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == "td" {
+			cells = append(cells, c)
+		}
+	}
+
+	if len(cells) < 3 {
+		return nil
+	}
+
+	// Extract link from first cell
+	var link *html.Node
+	for c := cells[0].FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == "a" {
+			link = c
+			break
+		}
+	}
+
+	if link == nil {
+		return nil
+	}
+
+	name := getTextContent(link)
+	if name == "Parent directory" {
+		return nil
+	}
+
+	modified := strings.TrimSpace(getTextContent(cells[1]))
+	size := strings.TrimSpace(getTextContent(cells[2]))
+
+	entry := newListingEntry(name, basePath, modified, size)
+	return &entry
+}
+
+func getTextContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+
+	var text string
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		text += getTextContent(c)
+	}
+	return text
+}
+
+// autoindexParser handles Apache/nginx-style autoindex pages, where entries
+// are lines inside a <pre> block:
+//
+//	<a href="20251121/">20251121/</a>      21-Nov-2025 21:23       -
+//	<a href="A251121212356.jpg">A251121212356.jpg</a>  21-Nov-2025 21:23   245K
+type autoindexParser struct{}
+
+func (autoindexParser) Name() string { return "autoindex" }
+
+func (autoindexParser) Detect(_ string, body []byte) bool {
+	lower := bytes.ToLower(body)
+	pre := bytes.Index(lower, []byte("<pre"))
+	return pre >= 0 && bytes.Contains(lower[pre:], []byte("<a "))
+}
+
+func (autoindexParser) Parse(body []byte, basePath string, _ *time.Location) ([]DirectoryEntry, error) {
+	var entries []DirectoryEntry
+
+	z := html.NewTokenizer(bytes.NewReader(body))
+	inPre := false
+	inLink := false
+	var href, linkText string // href and text of the link being read
+	var pending *string       // name of the last link, waiting for its trailing text
+
+	finishPending := func(trailer string) {
+		if pending == nil {
+			return
+		}
+		name := *pending
+		pending = nil
+
+		// The rest of the line holds the modification time followed by the size
+		fields := strings.Fields(trailer)
+		modified, size := "", ""
+		if len(fields) > 0 {
+			size = fields[len(fields)-1]
+			modified = strings.Join(fields[:len(fields)-1], " ")
+		}
+		entries = append(entries, newListingEntry(name, basePath, modified, size))
+	}
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			finishPending("")
+			return entries, nil
+
+		case html.StartTagToken:
+			tag, hasAttr := z.TagName()
+			switch string(tag) {
+			case "pre":
+				inPre = true
+			case "a":
+				if !inPre {
+					continue
+				}
+				finishPending("")
+				inLink = true
+				href, linkText = "", ""
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "href" {
+						href = string(val)
+					}
+				}
+			}
+
+		case html.EndTagToken:
+			tag, _ := z.TagName()
+			switch string(tag) {
+			case "pre":
+				finishPending("")
+				inPre = false
+			case "a":
+				if !inLink {
+					continue
+				}
+				inLink = false
+				if strings.EqualFold(strings.TrimSpace(linkText), "parent directory") {
+					continue
+				}
+				if name, ok := autoindexEntryName(href); ok {
+					pending = &name
+				}
+			}
+
+		case html.TextToken:
+			if !inPre {
+				continue
+			}
+			text := string(z.Text())
+			if inLink {
+				linkText += text
+				continue
+			}
+			line, _, _ := strings.Cut(text, "\n")
+			finishPending(line)
+		}
+	}
+}
+
+// autoindexEntryName derives an entry name from an autoindex link, skipping
+// parent directory and column sorting links. The href is used rather than the
+// link text because nginx truncates long names in the text.
+func autoindexEntryName(href string) (string, bool) {
+	if href == "" || strings.HasPrefix(href, "?") || strings.HasPrefix(href, "#") {
+		return "", false
+	}
+	u, err := url.Parse(href)
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+
+	isDir := strings.HasSuffix(u.Path, "/")
+	name := path.Base(strings.TrimSuffix(u.Path, "/"))
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "", false
+	}
+	if isDir {
+		name += "/"
+	}
+	return name, true
+}
+
+// jsonListingParser handles firmwares that return the file list as JSON,
+// either as a bare array or wrapped in an object under a key such as "files".
+// Elements may be plain names (directories ending in "/") or objects with
+// name/path, size, modified and type/isDirectory fields.
+type jsonListingParser struct{}
+
+func (jsonListingParser) Name() string { return "json" }
+
+func (jsonListingParser) Detect(contentType string, body []byte) bool {
+	if strings.Contains(strings.ToLower(contentType), "json") {
+		return true
+	}
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') && json.Valid(trimmed)
+}
+
+func (jsonListingParser) Parse(body []byte, basePath string, loc *time.Location) ([]DirectoryEntry, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON listing: %w", err)
+	}
+
+	list, ok := doc.([]any)
+	if !ok {
+		obj, isObj := doc.(map[string]any)
+		if !isObj {
+			return nil, fmt.Errorf("unexpected JSON listing type %T", doc)
+		}
+		for _, key := range []string{"files", "entries", "items", "list", "data"} {
+			if l, found := jsonField(obj, key).([]any); found {
+				list = l
+				break
+			}
+		}
+		if list == nil {
+			return nil, fmt.Errorf("JSON listing object has no file list")
+		}
+	}
+
+	var entries []DirectoryEntry
+	for _, item := range list {
+		switch v := item.(type) {
+		case string:
+			if v != "" && v != "../" && v != "./" {
+				entries = append(entries, newListingEntry(v, basePath, "", ""))
+			}
+		case map[string]any:
+			if entry, ok := parseJSONListingEntry(v, basePath, loc); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// parseJSONListingEntry converts a single JSON listing object to a DirectoryEntry
+func parseJSONListingEntry(obj map[string]any, basePath string, loc *time.Location) (DirectoryEntry, bool) {
+	name := jsonString(obj, "name", "filename", "file")
+	if name == "" {
+		name = path.Base(strings.TrimSuffix(jsonString(obj, "path"), "/"))
+	}
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || name == "." || name == ".." {
+		return DirectoryEntry{}, false
+	}
+
+	isDir := strings.HasSuffix(jsonString(obj, "name", "path"), "/")
+	switch strings.ToLower(jsonString(obj, "type", "kind")) {
+	case "dir", "directory", "folder":
+		isDir = true
+	}
+	for _, key := range []string{"isDirectory", "is_dir", "isDir", "dir", "directory"} {
+		if b, ok := jsonField(obj, key).(bool); ok && b {
+			isDir = true
+		}
+	}
+	if isDir {
+		name += "/"
+	}
+
+	modified := jsonString(obj, "modified", "mtime", "time", "date")
+	if n, ok := jsonField(obj, "mtime").(json.Number); ok {
+		// Numeric modification times are Unix timestamps, shown on the camera's clock
+		if secs, err := n.Int64(); err == nil {
+			modified = time.Unix(secs, 0).In(loc).Format("2006-01-02 15:04:05")
+		}
+	}
+
+	return newListingEntry(name, basePath, modified, jsonString(obj, "size")), true
+}
+
+// jsonField returns an object's value for a key, matching the key case-insensitively
+func jsonField(obj map[string]any, key string) any {
+	if v, ok := obj[key]; ok {
+		return v
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+// jsonString returns the first of the given keys that holds a string or number
+func jsonString(obj map[string]any, keys ...string) string {
+	for _, key := range keys {
+		switch v := jsonField(obj, key).(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case json.Number:
+			return v.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// cameraZone is the time zone of the camera the listing fixtures describe
+var cameraZone = time.FixedZone("CST", 8*60*60)
+
+// readListing reads a directory listing fixture from testdata/listing
+func readListing(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "listing", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestDirectoryParsers(t *testing.T) {
+	tests := []struct {
+		file        string
+		contentType string
+		parser      string
+		basePath    string
+		want        []DirectoryEntry
+	}{
+		{
+			file:        "hi3510_root.html",
+			contentType: "text/html",
+			parser:      "hi3510",
+			basePath:    "",
+			want: []DirectoryEntry{
+				{Name: "20251120/", Path: "20251120/", Modified: "20-Nov-2025 23:59", Size: "-", IsDirectory: true},
+				{Name: "20251121/", Path: "20251121/", Modified: "21-Nov-2025 21:24", Size: "-", IsDirectory: true},
+				{Name: "ipc.log", Path: "ipc.log", Modified: "21-Nov-2025 06:00", Size: "12K"},
+			},
+		},
+		{
+			file:        "hi3510_record.html",
+			contentType: "text/html",
+			parser:      "hi3510",
+			basePath:    "20251121/record000/",
+			want: []DirectoryEntry{
+				{Name: "A251121_212356_212410.264", Path: "20251121/record000/A251121_212356_212410.264", Modified: "21-Nov-2025 21:24", Size: "2.1M"},
+				{Name: "P251121_080000_081500.264", Path: "20251121/record000/P251121_080000_081500.264", Modified: "21-Nov-2025 08:15", Size: "48.6M"},
+			},
+		},
+		{
+			file:        "nginx_images.html",
+			contentType: "text/html",
+			parser:      "autoindex",
+			basePath:    "20251121/images000/",
+			want: []DirectoryEntry{
+				{Name: "A25112121235600.jpg", Path: "20251121/images000/A25112121235600.jpg", Modified: "21-Nov-2025 21:23", Size: "245760"},
+				{Name: "A25112121235601.jpg", Path: "20251121/images000/A25112121235601.jpg", Modified: "21-Nov-2025 21:23", Size: "246118"},
+				{Name: "P25112108000000.jpg", Path: "20251121/images000/P25112108000000.jpg", Modified: "21-Nov-2025 08:00", Size: "198211"},
+			},
+		},
+		{
+			file:        "apache_record.html",
+			contentType: "text/html;charset=UTF-8",
+			parser:      "autoindex",
+			basePath:    "20251121/record000/",
+			want: []DirectoryEntry{
+				{Name: "A251121_212356_212410.264", Path: "20251121/record000/A251121_212356_212410.264", Modified: "2025-11-21 21:24", Size: "2.1M"},
+				{Name: "P251121_080000_081500.264", Path: "20251121/record000/P251121_080000_081500.264", Modified: "2025-11-21 08:15", Size: "49M"},
+			},
+		},
+		{
+			file:        "json_root.json",
+			contentType: "text/plain",
+			parser:      "json",
+			basePath:    "",
+			want: []DirectoryEntry{
+				{Name: "20251120/", Path: "20251120/", Modified: "Thu, 20 Nov 2025 15:59:00 GMT", IsDirectory: true},
+				{Name: "20251121/", Path: "20251121/", Modified: "Fri, 21 Nov 2025 13:24:00 GMT", IsDirectory: true},
+			},
+		},
+		{
+			file:        "json_images.json",
+			contentType: "application/json",
+			parser:      "json",
+			basePath:    "20251121/images000/",
+			want: []DirectoryEntry{
+				{Name: "thumbs/", Path: "20251121/images000/thumbs/", Modified: "Fri, 21 Nov 2025 00:00:00 GMT", IsDirectory: true},
+				{Name: "A25112121235600.jpg", Path: "20251121/images000/A25112121235600.jpg", Modified: "Fri, 21 Nov 2025 13:23:56 GMT", Size: "245760"},
+				{Name: "P25112108000000.jpg", Path: "20251121/images000/P25112108000000.jpg", Modified: "Fri, 21 Nov 2025 00:00:00 GMT", Size: "198211"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			body := readListing(t, tt.file)
+
+			detected := detectDirectoryParser(tt.contentType, body)
+			if detected.Name() != tt.parser {
+				t.Errorf("detected %s, want %s", detected.Name(), tt.parser)
+			}
+
+			parser, err := lookupDirectoryParser(tt.parser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := parser.Parse(body, tt.basePath, cameraZone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, tt.want) {
+				t.Errorf("entries:\n got %+v\nwant %+v", entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectoryListingMedia(t *testing.T) {
+	cam := &Camera{
+		CameraConfig: CameraConfig{ID: "front", Name: "Front Door"},
+		source:       NewHTTPSource("http://camera/sd", nil, nil, cameraZone),
+		location:     cameraZone,
+	}
+	start := time.Date(2025, 11, 21, 21, 23, 56, 0, cameraZone)
+	end := time.Date(2025, 11, 21, 21, 24, 10, 0, cameraZone)
+
+	tests := []struct {
+		file     string
+		basePath string
+		want     MediaItem
+	}{
+		{
+			file:     "hi3510_record.html",
+			basePath: "20251121/record000/",
+			want: MediaItem{
+				Camera:           "front",
+				Name:             "A251121_212356_212410.264",
+				Path:             "20251121/record000/A251121_212356_212410.264",
+				URL:              "http://camera/sd/20251121/record000/A251121_212356_212410.264",
+				ProxyURL:         "/api/video/20251121%2Frecord000%2FA251121_212356_212410.264.mp4?camera=front",
+				DownloadFilename: "Front Door_2025-11-21_21-23-56.mp4",
+				Date:             "20251121",
+				Type:             "video",
+				Trigger:          "alarm",
+				Timestamp:        "2025-11-21 21:23:56 - 21:24:10",
+				Start:            &start,
+				End:              &end,
+				DurationSeconds:  14,
+				Size:             "2.1M",
+				SizeBytes:        2202010,
+				Modified:         "21-Nov-2025 21:24",
+			},
+		},
+		{
+			file:     "json_images.json",
+			basePath: "20251121/images000/",
+			want: MediaItem{
+				Camera:           "front",
+				Name:             "A25112121235600.jpg",
+				Path:             "20251121/images000/A25112121235600.jpg",
+				URL:              "http://camera/sd/20251121/images000/A25112121235600.jpg",
+				DownloadFilename: "Front Door_2025-11-21_21-23-56.jpg",
+				Date:             "20251121",
+				Type:             "image",
+				Trigger:          "alarm",
+				Timestamp:        "2025-11-21 21:23:56",
+				Start:            &start,
+				Sequence:         new(int),
+				Size:             "245760",
+				SizeBytes:        245760,
+				Modified:         "Fri, 21 Nov 2025 13:23:56 GMT",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			body := readListing(t, tt.file)
+			parser := detectDirectoryParser("", body)
+			entries, err := parser.Parse(body, tt.basePath, cameraZone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first media file, skipping directories
+			for len(entries) > 0 && mediaTypeForName(entries[0].Name) == "" {
+				entries = entries[1:]
+			}
+			if len(entries) == 0 {
+				t.Fatal("no media entries")
+			}
+			item := cam.parseMedia(entries[0], "20251121/", mediaTypeForName(entries[0].Name))
+			if !reflect.DeepEqual(item, tt.want) {
+				t.Errorf("item:\n got %+v\nwant %+v", item, tt.want)
+			}
+		})
+	}
+}
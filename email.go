@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpTimeout bounds a whole SMTP conversation
+const smtpTimeout = 60 * time.Second
+
+// digestThumbnailWidth is the width digest thumbnails are scaled down to
+const digestThumbnailWidth = 320
+
+// EmailConfig holds the SMTP server and email notification settings
+type EmailConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	Security string // "starttls", "tls" or "none"
+	From     string
+	To       []string
+
+	Alerts    bool   // email each new alarm
+	AlertType string // "image", "video" or filterAny
+
+	Digest              bool // email a daily digest
+	DigestTime          int  // minutes after midnight, server time
+	DigestMaxThumbnails int
+}
+
+// loadEmailConfig reads the email settings from the environment. Email is
+// disabled if SMTP_HOST is not set.
+func loadEmailConfig() (EmailConfig, error) {
+	cfg := EmailConfig{
+		Host:                getEnv("SMTP_HOST", ""),
+		Port:                getEnv("SMTP_PORT", ""),
+		Username:            getEnv("SMTP_USERNAME", ""),
+		Password:            getEnv("SMTP_PASSWORD", ""),
+		Security:            strings.ToLower(getEnv("SMTP_SECURITY", "starttls")),
+		From:                getEnv("EMAIL_FROM", ""),
+		Alerts:              getEnvBool("EMAIL_ALERTS_ENABLED", true),
+		AlertType:           strings.ToLower(getEnv("EMAIL_ALERT_TYPE", "video")),
+		Digest:              getEnvBool("EMAIL_DIGEST_ENABLED", false),
+		DigestMaxThumbnails: getEnvInt("EMAIL_DIGEST_MAX_THUMBNAILS", 48),
+	}
+	if cfg.Host == "" {
+		return cfg, nil
+	}
+
+	for _, to := range strings.Split(getEnv("EMAIL_TO", ""), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			cfg.To = append(cfg.To, to)
+		}
+	}
+	if len(cfg.To) == 0 {
+		return cfg, fmt.Errorf("EMAIL_TO must be set when SMTP_HOST is set")
+	}
+	if cfg.From == "" {
+		cfg.From = cfg.Username
+	}
+	if !strings.Contains(cfg.From, "@") {
+		return cfg, fmt.Errorf("EMAIL_FROM must be an email address")
+	}
+
+	switch cfg.Security {
+	case "starttls", "none":
+		if cfg.Port == "" {
+			cfg.Port = "587"
+		}
+	case "tls":
+		if cfg.Port == "" {
+			cfg.Port = "465"
+		}
+	default:
+		return cfg, fmt.Errorf("invalid SMTP_SECURITY %q (expected starttls, tls or none)", cfg.Security)
+	}
+	switch cfg.AlertType {
+	case "image", "video", filterAny:
+	default:
+		return cfg, fmt.Errorf("invalid EMAIL_ALERT_TYPE %q (expected image, video or any)", cfg.AlertType)
+	}
+
+	digestTime, err := time.Parse("15:04", getEnv("EMAIL_DIGEST_TIME", "07:00"))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid EMAIL_DIGEST_TIME (expected HH:MM)")
+	}
+	cfg.DigestTime = digestTime.Hour()*60 + digestTime.Minute()
+	if cfg.DigestMaxThumbnails < 0 {
+		cfg.DigestMaxThumbnails = 0
+	}
+	return cfg, nil
+}
+
+// emailPart is one part of a MIME message
+type emailPart struct {
+	ContentType string
+	Body        []byte
+	Filename    string // sent as an attachment if set
+	ContentID   string // referenced from HTML as cid:ContentID if set
+}
+
+// buildEmail renders a MIME message. With a single part it's sent as is;
+// otherwise the parts are wrapped in a multipart container of the given
+// subtype, such as "mixed" for attachments or "related" for inline images.
+func buildEmail(from string, to []string, subject string, multipartType string, parts []emailPart) ([]byte, error) {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@ipcam-browser>\r\n", randomHex(12))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+
+	if len(parts) == 1 {
+		for key, values := range partHeader(parts[0]) {
+			fmt.Fprintf(&msg, "%s: %s\r\n", key, values[0])
+		}
+		msg.WriteString("\r\n")
+		writeBase64(&msg, parts[0].Body)
+		return msg.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		w, err := writer.CreatePart(partHeader(part))
+		if err != nil {
+			return nil, err
+		}
+		writeBase64(w, part.Body)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&msg, "Content-Type: multipart/%s; boundary=%s\r\n\r\n", multipartType, writer.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// partHeader returns the headers describing a part's content
+func partHeader(part emailPart) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", part.ContentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	if part.ContentID != "" {
+		header.Set("Content-ID", "<"+part.ContentID+">")
+		header.Set("Content-Disposition", "inline")
+	} else if part.Filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": part.Filename}))
+	}
+	return header
+}
+
+// writeBase64 writes data base64 encoded in 76-character lines
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		_, _ = w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	_, _ = w.Write([]byte(encoded + "\r\n"))
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sendEmail delivers a message through the configured SMTP server
+func sendEmail(cfg EmailConfig, msg []byte) error {
+	addr := net.JoinHostPort(cfg.Host, cfg.Port)
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if cfg.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP handshake failed: %w", err)
+	}
+	defer client.Close()
+
+	if cfg.Security == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(cfg.From); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM failed: %w", err)
+	}
+	for _, to := range cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("SMTP RCPT TO %s failed: %w", to, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA failed: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	return client.Quit()
+}
+
+// scaleJPEG shrinks a JPEG to the given width, keeping its aspect ratio.
+// Each output pixel averages the block of input pixels it covers. Images
+// that are already narrow enough or can't be decoded are returned unchanged.
+func scaleJPEG(data []byte, width int) []byte {
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return data
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, n uint32
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					pr, pg, pb, _ := src.At(sx, sy).RGBA()
+					r, g, bl, n = r+pr, g+pg, bl+pb, n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), 0xff})
+		}
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return data
+	}
+	return out.Bytes()
+}
+
+// EmailNotifier emails an alert with the snapshot attached for each new
+// alarm, and a daily digest of the previous day's alarms
+type EmailNotifier struct {
+	cfg     EmailConfig
+	baseURL string
+	cameras []*Camera
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewEmailNotifier creates an email notifier for the given cameras. baseURL
+// is the externally reachable URL of ipcam-browser, used for links.
+func NewEmailNotifier(cfg EmailConfig, baseURL string, cameras []*Camera) *EmailNotifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EmailNotifier{cfg: cfg, baseURL: baseURL, cameras: cameras, ctx: ctx, cancel: cancel}
+}
+
+// Start begins following the change feed for alerts and schedules the
+// digest, as configured
+func (e *EmailNotifier) Start() {
+	log.Printf("Starting email notifications to %s", strings.Join(e.cfg.To, ", "))
+	if e.cfg.Alerts {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			changeFeed.Follow("Email alerts", e.ctx.Done(), e.handleChange)
+		}()
+	}
+	if e.cfg.Digest {
+		e.wg.Add(1)
+		go func() {
+			defer e.wg.Done()
+			e.runDigests()
+		}()
+	}
+}
+
+// Stop stops sending email, waiting for messages being sent
+func (e *EmailNotifier) Stop() {
+	e.cancel()
+	e.wg.Wait()
+	log.Println("Email notifications stopped")
+}
+
+// handleChange emails an alert for new alarm media
+func (e *EmailNotifier) handleChange(change MediaChange) {
+	item := change.Item
+	if change.Type != ChangeAdded || item.Trigger != "alarm" {
+		return
+	}
+	if e.cfg.AlertType != filterAny && e.cfg.AlertType != item.Type {
+		return
+	}
+	cam := lookupCamera(change.Camera)
+	if cam == nil {
+		return
+	}
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		if err := e.sendAlert(cam, item); err != nil {
+			log.Printf("Email: failed to send alert for %s: %v", item.Path, err)
+		}
+	}()
+}
+
+// sendAlert emails an alert for one item
+func (e *EmailNotifier) sendAlert(cam *Camera, item MediaItem) error {
+	links := mediaLinks(cam, item, e.baseURL)
+	var text strings.Builder
+	fmt.Fprintf(&text, "New alarm %s from %s: %s\r\n\r\n", item.Type, cam.Name, item.Timestamp)
+	if item.Type == "video" {
+		fmt.Fprintf(&text, "Video: %s\r\n", links.Video)
+	} else {
+		fmt.Fprintf(&text, "Image: %s\r\n", links.Media)
+	}
+
+	parts := []emailPart{{ContentType: "text/plain; charset=utf-8", Body: []byte(text.String())}}
+	snapshot, err := cam.snapshot(item)
+	if err != nil {
+		log.Printf("Email: failed to fetch snapshot for %s: %v", item.Path, err)
+	}
+	if snapshot != nil {
+		name := strings.TrimSuffix(item.DownloadFilename, ".mp4")
+		if !strings.HasSuffix(name, ".jpg") {
+			name += ".jpg"
+		}
+		parts = append(parts, emailPart{ContentType: "image/jpeg", Body: snapshot, Filename: name})
+	}
+
+	subject := fmt.Sprintf("%s: alarm %s at %s", cam.Name, item.Type, alertTime(cam, item))
+	msg, err := buildEmail(e.cfg.From, e.cfg.To, subject, "mixed", parts)
+	if err != nil {
+		return err
+	}
+	return sendEmail(e.cfg, msg)
+}
+
+// alertTime formats an item's start time for a subject line
+func alertTime(cam *Camera, item MediaItem) string {
+	if item.Start == nil {
+		return item.Timestamp
+	}
+	return item.Start.In(cam.location).Format("15:04:05")
+}
+
+// runDigests sends the digest for the previous day at the configured time
+// every day until stopped
+func (e *EmailNotifier) runDigests() {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), 0, e.cfg.DigestTime, 0, 0, time.Local)
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-e.ctx.Done():
+			return
+		}
+
+		day := next.AddDate(0, 0, -1)
+		if _, err := e.SendDigest(day); err != nil {
+			log.Printf("Email: failed to send digest for %s: %v", day.Format("2006-01-02"), err)
+		}
+	}
+}
+
+// digestHour counts the alarm events and media recorded in one hour
+type digestHour struct {
+	Hour   int
+	Events int
+	Images int
+	Videos int
+	Bar    int // width of the bar in the HTML, in pixels
+}
+
+// digestThumbnail is one event in the digest's thumbnail grid
+type digestThumbnail struct {
+	ContentID string
+	Time      string
+	Label     string
+	Link      string
+	image     []byte // scaled down JPEG
+}
+
+// digestCamera is the digest section for one camera
+type digestCamera struct {
+	Name       string
+	Events     int
+	Hours      []digestHour // hours with alarms only
+	Thumbnails []digestThumbnail
+	Omitted    int // events left out of the grid
+}
+
+var digestTemplate = template.Must(template.New("digest").Parse(`<!DOCTYPE html>
+<html><body style="font-family: -apple-system, Helvetica, Arial, sans-serif; color: #222;">
+<h2>Alarms on {{.Date}}</h2>
+{{range .Cameras}}
+<h3>{{.Name}}: {{.Events}} event{{if ne .Events 1}}s{{end}}</h3>
+{{if .Hours}}
+<table cellpadding="4" cellspacing="0" style="border-collapse: collapse; font-size: 14px;">
+<tr style="text-align: left;"><th>Hour</th><th>Events</th><th>Videos</th><th>Images</th><th></th></tr>
+{{range .Hours}}<tr><td>{{printf "%02d:00" .Hour}}</td><td>{{.Events}}</td><td>{{.Videos}}</td><td>{{.Images}}</td><td><div style="background: #d9534f; height: 10px; width: {{.Bar}}px;"></div></td></tr>
+{{end}}</table>
+{{end}}
+<div>
+{{range .Thumbnails}}<div style="display: inline-block; width: 320px; margin: 4px; vertical-align: top; font-size: 13px;">
+<a href="{{.Link}}"><img src="cid:{{.ContentID}}" width="320" alt="{{.Label}}" style="display: block; border: 0;"></a>
+{{.Time}} &middot; {{.Label}}
+</div>
+{{end}}</div>
+{{if .Omitted}}<p>{{.Omitted}} more event{{if ne .Omitted 1}}s{{end}} not shown.</p>{{end}}
+{{end}}
+</body></html>
+`))
+
+// SendDigest emails the digest of alarms recorded on day, returning the
+// number of events it covered
+func (e *EmailNotifier) SendDigest(day time.Time) (int, error) {
+	y, m, d := day.Date()
+	var sections []digestCamera
+	var parts []emailPart
+	total := 0
+	thumbnails := 0
+
+	for _, cam := range e.cameras {
+		// The day is a calendar date in each camera's own time zone
+		var items []MediaItem
+		for _, item := range cam.currentMedia(false) {
+			if item.Start == nil {
+				continue
+			}
+			iy, im, id := item.Start.In(cam.location).Date()
+			if iy == y && im == m && id == d {
+				items = append(items, item)
+			}
+		}
+		events := groupEvents(cam, items, config.EventGap)
+		total += len(events)
+
+		section := digestCamera{Name: cam.Name, Events: len(events)}
+		hours := make([]digestHour, 24)
+		for _, ev := range events {
+			hour := &hours[ev.Start.In(cam.location).Hour()]
+			hour.Events++
+			hour.Images += ev.Counts["image"]
+			hour.Videos += ev.Counts["video"]
+
+			if thumbnails >= e.cfg.DigestMaxThumbnails {
+				section.Omitted++
+				continue
+			}
+			thumbnail, ok := e.digestThumbnail(cam, ev, thumbnails)
+			if !ok {
+				continue
+			}
+			section.Thumbnails = append(section.Thumbnails, thumbnail)
+			parts = append(parts, emailPart{ContentType: "image/jpeg", Body: thumbnail.image, ContentID: thumbnail.ContentID})
+			thumbnails++
+		}
+
+		busiest := 0
+		for _, hour := range hours {
+			busiest = max(busiest, hour.Events)
+		}
+		for i, hour := range hours {
+			if hour.Events > 0 {
+				hour.Hour = i
+				hour.Bar = max(2, hour.Events*200/busiest)
+				section.Hours = append(section.Hours, hour)
+			}
+		}
+		sections = append(sections, section)
+	}
+
+	var html bytes.Buffer
+	date := day.Format("Monday, January 2, 2006")
+	if err := digestTemplate.Execute(&html, map[string]any{"Date": date, "Cameras": sections}); err != nil {
+		return 0, fmt.Errorf("failed to render digest: %w", err)
+	}
+	parts = append([]emailPart{{ContentType: "text/html; charset=utf-8", Body: html.Bytes()}}, parts...)
+
+	subject := fmt.Sprintf("Camera digest for %s: %s", day.Format("Jan 2"), plural(total, "event"))
+	msg, err := buildEmail(e.cfg.From, e.cfg.To, subject, "related", parts)
+	if err != nil {
+		return 0, err
+	}
+	if err := sendEmail(e.cfg, msg); err != nil {
+		return 0, err
+	}
+	log.Printf("Email: sent digest for %s with %d events", day.Format("2006-01-02"), total)
+	return total, nil
+}
+
+// digestThumbnail returns the grid entry for an event, or false if the
+// event has no image that can be fetched
+func (e *EmailNotifier) digestThumbnail(cam *Camera, ev Event, n int) (digestThumbnail, bool) {
+	var snapshot []byte
+	for _, item := range ev.Items {
+		data, err := cam.snapshot(item)
+		if err != nil {
+			log.Printf("Email: failed to fetch digest thumbnail %s: %v", item.Path, err)
+			continue
+		}
+		if data != nil {
+			snapshot = data
+			break
+		}
+	}
+	if snapshot == nil {
+		return digestThumbnail{}, false
+	}
+
+	// Link to the event's first video if it has one, otherwise its first image
+	linked := ev.Items[0]
+	for _, item := range ev.Items {
+		if item.Type == "video" {
+			linked = item
+			break
+		}
+	}
+
+	label := plural(ev.Counts["image"], "image")
+	if videos := ev.Counts["video"]; videos > 0 {
+		label = plural(videos, "video") + ", " + label
+	}
+	return digestThumbnail{
+		ContentID: fmt.Sprintf("thumb%d@ipcam-browser", n),
+		Time:      ev.Start.In(cam.location).Format("15:04:05"),
+		Label:     label,
+		Link:      mediaLinks(cam, linked, e.baseURL).Media,
+		image:     scaleJPEG(snapshot, digestThumbnailWidth),
+	}, true
+}
+
+// plural formats a count of things, such as "1 image" or "3 images"
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSink is an SMTP server that accepts every message, for testing what
+// would be sent
+type smtpSink struct {
+	listener net.Listener
+	messages chan []byte
+}
+
+// startSMTPSink starts a sink on a local port, stopped when the test ends
+func startSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener, messages: make(chan []byte, 10)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	sess := &smtpSession{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	sess.reply(220, "sink ready")
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			sess.reply(250, "sink", "8BITMIME")
+		case "DATA":
+			sess.reply(354, "go ahead")
+			data, err := readSMTPData(sess)
+			if err != nil {
+				return
+			}
+			s.messages <- data
+			sess.reply(250, "OK")
+		case "QUIT":
+			sess.reply(221, "Bye")
+			return
+		default:
+			sess.reply(250, "OK")
+		}
+	}
+}
+
+// config returns email settings that send to the sink
+func (s *smtpSink) config() EmailConfig {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return EmailConfig{
+		Host:                host,
+		Port:                port,
+		Security:            "none",
+		From:                "ipcam@example.com",
+		To:                  []string{"owner@example.com"},
+		DigestMaxThumbnails: 10,
+	}
+}
+
+// receive returns the next message the sink accepted
+func (s *smtpSink) receive(t *testing.T) *mail.Message {
+	t.Helper()
+	select {
+	case data := <-s.messages:
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+// mimePart is a decoded part of a multipart message
+type mimePart struct {
+	contentType string
+	header      map[string][]string
+	body        []byte
+}
+
+// readParts checks a message is multipart of the given subtype and returns
+// its decoded parts
+func readParts(t *testing.T, msg *mail.Message, subtype string) []mimePart {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/"+subtype {
+		t.Fatalf("message is %s, want multipart/%s", mediaType, subtype)
+	}
+	var parts []mimePart
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc := part.Header.Get("Content-Transfer-Encoding"); enc != "base64" {
+			t.Fatalf("part encoded as %q", enc)
+		}
+		body, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts = append(parts, mimePart{contentType: contentType, header: part.Header, body: body})
+	}
+}
+
+// testJPEG encodes a gray JPEG of the given size
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newSDCardTestCamera creates a camera reading an SD card in a temp
+// directory, holding a JPEG for each of the given paths
+func newSDCardTestCamera(t *testing.T, photo []byte, paths ...string) *Camera {
+	t.Helper()
+	sd := t.TempDir()
+	for _, p := range paths {
+		file := filepath.Join(sd, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, photo, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cam, err := NewCamera(CameraConfig{
+		ID:          "front",
+		Name:        "Front Door",
+		Source:      SourceLocal,
+		SourceDir:   sd,
+		Timezone:    "America/New_York",
+		AudioFormat: AudioFormatALaw,
+	}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cam.annotations, err = NewAnnotations(filepath.Join(t.TempDir(), "annotations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cam
+}
+
+func TestEmailAlert(t *testing.T) {
+	sink := startSMTPSink(t)
+	photo := testJPEG(t, 64, 48)
+	cam := newSDCardTestCamera(t, photo, "20251121/images000/A25112121235600.jpg")
+	notifier := NewEmailNotifier(sink.config(), "http://ipcam.local", []*Camera{cam})
+
+	items := cam.currentMedia(false)
+	if len(items) != 1 {
+		t.Fatalf("%d items on the card", len(items))
+	}
+	if err := notifier.sendAlert(cam, items[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := sink.receive(t)
+	if subject := msg.Header.Get("Subject"); subject != "Front Door: alarm image at 21:23:56" {
+		t.Errorf("subject %q", subject)
+	}
+	parts := readParts(t, msg, "mixed")
+	if len(parts) != 2 {
+		t.Fatalf("%d parts, want text and snapshot", len(parts))
+	}
+	if parts[0].contentType != "text/plain" || !strings.Contains(string(parts[0].body), "New alarm image from Front Door: 2025-11-21 21:23:56") {
+		t.Errorf("text part %s: %q", parts[0].contentType, parts[0].body)
+	}
+
+	snapshot := parts[1]
+	_, params, _ := mime.ParseMediaType(snapshot.header["Content-Disposition"][0])
+	if snapshot.contentType != "image/jpeg" || params["filename"] != "Front Door_2025-11-21_21-23-56.jpg" {
+		t.Errorf("snapshot %s named %q", snapshot.contentType, params["filename"])
+	}
+	if !bytes.Equal(snapshot.body, photo) {
+		t.Error("attached snapshot differs from the camera's image")
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	oldGap := config.EventGap
+	config.EventGap = time.Minute
+	t.Cleanup(func() { config.EventGap = oldGap })
+
+	sink := startSMTPSink(t)
+	cam := newSDCardTestCamera(t, testJPEG(t, 640, 360),
+		"20251121/images000/A25112108000000.jpg",
+		"20251121/images000/A25112108001000.jpg", // same event
+		"20251121/images000/A25112108300000.jpg",
+		"20251121/images000/P25112108450000.jpg", // scheduled, not an alarm
+		"20251121/images000/A25112121235600.jpg",
+		"20251122/images000/A25112200000500.jpg", // the next day
+	)
+	notifier := NewEmailNotifier(sink.config(), "http://ipcam.local", []*Camera{cam})
+
+	events, err := notifier.SendDigest(time.Date(2025, 11, 21, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events != 3 {
+		t.Errorf("digest covered %d events, want 3", events)
+	}
+
+	msg := sink.receive(t)
+	if subject := msg.Header.Get("Subject"); subject != "Camera digest for Nov 21: 3 events" {
+		t.Errorf("subject %q", subject)
+	}
+	parts := readParts(t, msg, "related")
+	if parts[0].contentType != "text/html" {
+		t.Fatalf("first part is %s, want the HTML", parts[0].contentType)
+	}
+	html := string(parts[0].body)
+
+	// Alarm events, videos and images by hour
+	rows := regexp.MustCompile(`<tr><td>(\d\d:00)</td><td>(\d+)</td><td>(\d+)</td><td>(\d+)</td>`).FindAllStringSubmatch(html, -1)
+	var hours []string
+	for _, row := range rows {
+		hours = append(hours, strings.Join(row[1:], " "))
+	}
+	if want := []string{"08:00 2 0 3", "21:00 1 0 1"}; strings.Join(hours, ", ") != strings.Join(want, ", ") {
+		t.Errorf("hours %q, want %q", hours, want)
+	}
+
+	// Every image the HTML refers to is a part, and every other part is one
+	// of its images
+	var refs, ids []string
+	for _, m := range regexp.MustCompile(`src="cid:([^"]+)"`).FindAllStringSubmatch(html, -1) {
+		refs = append(refs, m[1])
+	}
+	for _, part := range parts[1:] {
+		ids = append(ids, strings.Trim(part.header["Content-Id"][0], "<>"))
+		if part.contentType != "image/jpeg" {
+			t.Errorf("thumbnail is %s", part.contentType)
+		}
+		thumbnail, err := jpeg.DecodeConfig(bytes.NewReader(part.body))
+		if err != nil || thumbnail.Width != digestThumbnailWidth {
+			t.Errorf("thumbnail %dx%d: %v", thumbnail.Width, thumbnail.Height, err)
+		}
+	}
+	sort.Strings(refs)
+	sort.Strings(ids)
+	if len(refs) != 3 || strings.Join(refs, " ") != strings.Join(ids, " ") {
+		t.Errorf("HTML refers to %q, parts are %q", refs, ids)
+	}
+}
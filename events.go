@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxEventGap bounds the gap accepted from the gap query parameter
+const maxEventGap = 24 * time.Hour
+
+// Event is a cluster of alarm media recorded close together, typically a
+// video plus the burst of images the camera took when the alarm fired
+type Event struct {
+	ID           string         `json:"id"` // path of the event's first item
+	Camera       string         `json:"camera"`
+	Start        time.Time      `json:"start"`
+	End          time.Time      `json:"end"`
+	ThumbnailURL string         `json:"thumbnailUrl,omitempty"`
+	Counts       map[string]int `json:"counts"` // items by type
+	Items        []MediaItem    `json:"items"`  // ordered by start time
+}
+
+// groupEvents clusters alarm media into events. An item joins the current
+// event if it starts no more than gap after the event's end; otherwise it
+// starts a new one. Media without a parseable timestamp is left out.
+func groupEvents(cam *Camera, items []MediaItem, gap time.Duration) []Event {
+	var alarms []MediaItem
+	for _, item := range items {
+		if item.Trigger == "alarm" && item.Start != nil {
+			alarms = append(alarms, item)
+		}
+	}
+	sort.SliceStable(alarms, func(i, j int) bool {
+		if !alarms[i].Start.Equal(*alarms[j].Start) {
+			return alarms[i].Start.Before(*alarms[j].Start)
+		}
+		return alarms[i].Path < alarms[j].Path
+	})
+
+	var events []Event
+	for _, item := range alarms {
+		end := *item.Start
+		if item.End != nil {
+			end = *item.End
+		}
+
+		if len(events) == 0 || item.Start.After(events[len(events)-1].End.Add(gap)) {
+			events = append(events, Event{
+				ID:     item.Path,
+				Camera: cam.ID,
+				Start:  *item.Start,
+				End:    end,
+				Counts: map[string]int{"image": 0, "video": 0},
+			})
+		}
+
+		ev := &events[len(events)-1]
+		ev.Items = append(ev.Items, item)
+		ev.Counts[item.Type]++
+		if end.After(ev.End) {
+			ev.End = end
+		}
+	}
+
+	for i := range events {
+		events[i].ThumbnailURL = eventThumbnail(cam, events[i].Items)
+	}
+	return events
+}
+
+// eventThumbnail picks an event's representative image: its first image, or
+// failing that the thumbnail matched to its first video
+func eventThumbnail(cam *Camera, items []MediaItem) string {
+	for _, item := range items {
+		if item.Type == "image" {
+			return cam.proxyURL(item.URL)
+		}
+	}
+	for _, item := range items {
+		if item.ThumbnailURL != "" {
+			return item.ThumbnailURL
+		}
+	}
+	return ""
+}
+
+// parseEventGap reads the gap query parameter, in seconds
+func parseEventGap(value string, defaultGap time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultGap, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxEventGap {
+		return 0, fmt.Errorf("invalid gap %q (expected 0 to %d seconds)", value, int(maxEventGap.Seconds()))
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// eventKey returns an event's sort key, which is that of its first item
+func eventKey(ev Event) mediaKey {
+	return keyFor(ev.Items[0])
+}
+
+// EventPage is one page of events matching a MediaQuery
+type EventPage struct {
+	Events     []Event
+	Total      int    // matching events across all pages
+	NextCursor string // empty on the last page
+}
+
+// ApplyEvents filters, sorts and paginates events. An event matches the date
+// and time window by its start, the type if it has media of that type, and
+// tags and favorites if any of its media has them.
+func (q *MediaQuery) ApplyEvents(events []Event) EventPage {
+	var matched []Event
+	for _, ev := range events {
+		if q.Date != "" && ev.Items[0].Date != q.Date {
+			continue
+		}
+		if q.Type != "" && ev.Counts[q.Type] == 0 {
+			continue
+		}
+		if q.Trigger != "" && q.Trigger != "alarm" {
+			continue
+		}
+		if !q.matchesTime(ev.Start) {
+			continue
+		}
+		if !q.matchesAnyAnnotation(ev.Items) {
+			continue
+		}
+		matched = append(matched, ev)
+	}
+
+	page := EventPage{Total: len(matched)}
+	page.Events, page.NextCursor = paginate(q, matched, eventKey)
+	if page.Events == nil {
+		page.Events = []Event{}
+	}
+	return page
+}
+
+// matchesAnyAnnotation reports whether any of items has the query's tags and favorite flag
+func (q *MediaQuery) matchesAnyAnnotation(items []MediaItem) bool {
+	for _, item := range items {
+		if q.matchesAnnotation(item) {
+			return true
+		}
+	}
+	return false
+}
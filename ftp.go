@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ftpCommandTimeout = 5 * time.Minute
+	ftpDataTimeout    = 30 * time.Second // to open a passive data connection
+	ftpMaxLineLength  = 4096
+	ftpMaxUploadSize  = 1 << 30 // well above the longest recording a camera writes
+
+	// Failed logins are answered slowly, and a connection is dropped after a
+	// few, to slow down password guessing
+	ftpLoginFailureDelay = 2 * time.Second
+	ftpMaxLoginFailures  = 3
+)
+
+// errUploadTooLarge means an upload exceeded ftpMaxUploadSize
+var errUploadTooLarge = errors.New("upload is too large")
+
+// FTPReceiverConfig holds the settings for the embedded FTP server
+type FTPReceiverConfig struct {
+	Addr       string // listen address, e.g. ":2121"; disabled if empty
+	Username   string
+	Password   string
+	PassiveMin int // range of ports for passive data connections
+	PassiveMax int
+	PublicHost string // IPv4 address announced for passive connections; empty for the listening address
+}
+
+// loadFTPReceiverConfig reads the FTP receiver settings from the environment
+func loadFTPReceiverConfig() (FTPReceiverConfig, error) {
+	cfg := FTPReceiverConfig{
+		Addr:       getEnv("FTP_ADDR", ""),
+		Username:   getEnv("FTP_USERNAME", ""),
+		Password:   getEnv("FTP_PASSWORD", ""),
+		PublicHost: getEnv("FTP_PUBLIC_HOST", ""),
+	}
+	if cfg.Addr == "" {
+		return cfg, nil
+	}
+	if cfg.Username == "" || cfg.Password == "" {
+		return cfg, fmt.Errorf("FTP_USERNAME and FTP_PASSWORD are required with FTP_ADDR")
+	}
+
+	ports := getEnv("FTP_PASSIVE_PORTS", "30000-30009")
+	lo, hi, ok := strings.Cut(ports, "-")
+	if !ok {
+		hi = lo
+	}
+	var err1, err2 error
+	cfg.PassiveMin, err1 = strconv.Atoi(strings.TrimSpace(lo))
+	cfg.PassiveMax, err2 = strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || cfg.PassiveMin < 1 || cfg.PassiveMax > 65535 || cfg.PassiveMin > cfg.PassiveMax {
+		return cfg, fmt.Errorf("invalid FTP_PASSIVE_PORTS %q (expected a range such as 30000-30009)", ports)
+	}
+
+	if cfg.PublicHost != "" {
+		if ip := net.ParseIP(cfg.PublicHost); ip == nil || ip.To4() == nil {
+			return cfg, fmt.Errorf("invalid FTP_PUBLIC_HOST %q (expected an IPv4 address)", cfg.PublicHost)
+		}
+	}
+	return cfg, nil
+}
+
+// newFTPSource creates the source for a camera's FTP upload store, which is
+// laid out like an SD card so it can be read as one
+func newFTPSource(dir string) (*LocalSource, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create FTP directory: %w", err)
+	}
+	return NewLocalSource(dir)
+}
+
+// FTPReceiver is a minimal passive-mode FTP server that accepts media uploads
+// from cameras and files them in the cameras' upload stores
+type FTPReceiver struct {
+	cfg     FTPReceiverConfig
+	cameras []*Camera // cameras with CAMERA_SOURCE=ftp
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewFTPReceiver creates a receiver for the given FTP cameras
+func NewFTPReceiver(cfg FTPReceiverConfig, cameras []*Camera) *FTPReceiver {
+	return &FTPReceiver{cfg: cfg, cameras: cameras, conns: make(map[net.Conn]struct{})}
+}
+
+// Start begins accepting connections
+func (s *FTPReceiver) Start() error {
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for FTP: %w", err)
+	}
+	s.listener = listener
+	log.Printf("FTP receiver listening on %s (passive ports %d-%d)", listener.Addr(), s.cfg.PassiveMin, s.cfg.PassiveMax)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+	return nil
+}
+
+// Stop stops accepting connections and closes open ones, including
+// uploads in progress
+func (s *FTPReceiver) Stop() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	log.Println("FTP receiver stopped")
+}
+
+// ftpSession is the state of one FTP control connection
+type ftpSession struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	user     string
+	loggedIn bool
+	failures int          // failed logins
+	cwd      string       // virtual working directory; uploads are filed by name, not by directory
+	passive  net.Listener // listener for the next data connection, if PASV was sent
+	uploads  map[string]string
+}
+
+func (sess *ftpSession) reply(code int, text string) {
+	fmt.Fprintf(sess.w, "%d %s\r\n", code, text)
+	sess.w.Flush()
+}
+
+// readLine reads a CRLF-terminated command line
+func (sess *ftpSession) readLine() (string, error) {
+	_ = sess.conn.SetReadDeadline(time.Now().Add(ftpCommandTimeout))
+	var line []byte
+	for {
+		chunk, isPrefix, err := sess.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > ftpMaxLineLength {
+			return "", errors.New("line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// resolve returns the absolute virtual path of a command argument
+func (sess *ftpSession) resolve(arg string) string {
+	if path.IsAbs(arg) {
+		return path.Clean(arg)
+	}
+	return path.Join(sess.cwd, arg)
+}
+
+func (sess *ftpSession) closePassive() {
+	if sess.passive != nil {
+		sess.passive.Close()
+		sess.passive = nil
+	}
+}
+
+// serve runs an FTP control connection
+func (s *FTPReceiver) serve(conn net.Conn) {
+	sess := &ftpSession{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		cwd:     "/",
+		uploads: make(map[string]string),
+	}
+	defer sess.closePassive()
+	sess.reply(220, "ipcam-browser FTP ready")
+
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		switch verb {
+		case "USER", "PASS", "QUIT", "SYST", "FEAT", "NOOP", "AUTH":
+		default:
+			if !sess.loggedIn {
+				sess.reply(530, "Not logged in")
+				continue
+			}
+		}
+
+		switch verb {
+		case "USER":
+			sess.user = arg
+			sess.loggedIn = false
+			sess.reply(331, "Password required")
+		case "PASS":
+			if s.checkLogin(sess.user, arg) {
+				sess.loggedIn = true
+				sess.reply(230, "Logged in")
+				continue
+			}
+			sess.failures++
+			time.Sleep(ftpLoginFailureDelay)
+			if sess.failures >= ftpMaxLoginFailures {
+				log.Printf("FTP receiver: closing connection from %s after %d failed logins", conn.RemoteAddr(), sess.failures)
+				sess.reply(421, "Too many failed logins")
+				return
+			}
+			sess.reply(530, "Login incorrect")
+		case "SYST":
+			sess.reply(215, "UNIX Type: L8")
+		case "FEAT":
+			fmt.Fprint(sess.w, "211-Features:\r\n PASV\r\n EPSV\r\n SIZE\r\n UTF8\r\n")
+			sess.reply(211, "End")
+		case "OPTS":
+			if strings.EqualFold(arg, "UTF8 ON") {
+				sess.reply(200, "UTF8 mode enabled")
+			} else {
+				sess.reply(501, "Option not supported")
+			}
+		case "AUTH":
+			sess.reply(502, "TLS is not supported")
+		case "PWD", "XPWD":
+			sess.reply(257, fmt.Sprintf("%q is the current directory", sess.cwd))
+		case "CWD", "XCWD":
+			// Directories are virtual, so changing into any of them works
+			sess.cwd = sess.resolve(arg)
+			sess.reply(250, "Directory changed")
+		case "CDUP", "XCUP":
+			sess.cwd = path.Dir(sess.cwd)
+			sess.reply(250, "Directory changed")
+		case "MKD", "XMKD":
+			sess.reply(257, fmt.Sprintf("%q created", sess.resolve(arg)))
+		case "RMD", "XRMD":
+			sess.reply(250, "Directory removed")
+		case "TYPE":
+			sess.reply(200, "Type set")
+		case "MODE":
+			if strings.EqualFold(arg, "S") {
+				sess.reply(200, "Mode set")
+			} else {
+				sess.reply(504, "Only stream mode is supported")
+			}
+		case "STRU":
+			if strings.EqualFold(arg, "F") {
+				sess.reply(200, "Structure set")
+			} else {
+				sess.reply(504, "Only file structure is supported")
+			}
+		case "ALLO":
+			sess.reply(202, "No storage allocation necessary")
+		case "PASV", "EPSV":
+			s.enterPassive(sess, verb == "EPSV")
+		case "PORT", "EPRT":
+			sess.reply(502, "Only passive mode is supported")
+		case "LIST", "NLST", "MLSD":
+			// Uploads can't be read back over FTP, so every directory looks empty
+			data, err := s.openData(sess)
+			if err != nil {
+				sess.reply(425, "Can't open data connection")
+				continue
+			}
+			sess.reply(150, "Here comes the directory listing")
+			data.Close()
+			sess.reply(226, "Directory send OK")
+		case "STOR":
+			s.store(sess, sess.resolve(arg))
+		case "SIZE":
+			stored, ok := sess.uploads[sess.resolve(arg)]
+			info, err := os.Stat(stored)
+			if !ok || stored == "" || err != nil {
+				sess.reply(550, "File not found")
+				continue
+			}
+			sess.reply(213, strconv.FormatInt(info.Size(), 10))
+		case "DELE":
+			// Cameras test their FTP settings by uploading a file and deleting it,
+			// so a file uploaded in the same session may be deleted
+			vpath := sess.resolve(arg)
+			stored, ok := sess.uploads[vpath]
+			if !ok {
+				sess.reply(550, "Permission denied")
+				continue
+			}
+			if stored != "" {
+				if err := os.Remove(stored); err != nil {
+					sess.reply(550, "Delete failed")
+					continue
+				}
+			}
+			delete(sess.uploads, vpath)
+			sess.reply(250, "File deleted")
+		case "RETR":
+			sess.reply(550, "Downloads are not supported")
+		case "NOOP":
+			sess.reply(200, "OK")
+		case "QUIT":
+			sess.reply(221, "Bye")
+			return
+		default:
+			sess.reply(502, "Command not implemented")
+		}
+	}
+}
+
+// checkLogin reports whether a username and password are the configured
+// login, taking the same time however much of them matches
+func (s *FTPReceiver) checkLogin(username, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.cfg.Username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password))
+	return userOK&passOK == 1
+}
+
+// enterPassive opens a listener for the next data connection on a port in
+// the passive range and tells the client where to connect
+func (s *FTPReceiver) enterPassive(sess *ftpSession, extended bool) {
+	sess.closePassive()
+
+	localHost, _, err := net.SplitHostPort(sess.conn.LocalAddr().String())
+	if err != nil {
+		sess.reply(425, "Can't open passive connection")
+		return
+	}
+	announced := s.cfg.PublicHost
+	if announced == "" {
+		announced = localHost
+	}
+	ip := net.ParseIP(announced).To4()
+	if !extended && ip == nil {
+		sess.reply(425, "Can't announce an IPv6 address, use EPSV")
+		return
+	}
+
+	// Start at a random port so concurrent sessions don't all contend for the first one
+	n := s.cfg.PassiveMax - s.cfg.PassiveMin + 1
+	offset := rand.Intn(n)
+	var listener net.Listener
+	var port int
+	for i := 0; i < n; i++ {
+		port = s.cfg.PassiveMin + (offset+i)%n
+		listener, err = net.Listen("tcp", net.JoinHostPort(localHost, strconv.Itoa(port)))
+		if err == nil {
+			break
+		}
+	}
+	if listener == nil {
+		log.Printf("FTP receiver: no free passive port in %d-%d", s.cfg.PassiveMin, s.cfg.PassiveMax)
+		sess.reply(425, "Can't open passive connection")
+		return
+	}
+	sess.passive = listener
+
+	if extended {
+		sess.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	} else {
+		sess.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+	}
+}
+
+// openData accepts the data connection for a transfer. Only the client on
+// the control connection may connect, so others can't hijack uploads.
+func (s *FTPReceiver) openData(sess *ftpSession) (net.Conn, error) {
+	listener := sess.passive
+	if listener == nil {
+		return nil, errors.New("no passive listener")
+	}
+	defer sess.closePassive()
+
+	if tl, ok := listener.(*net.TCPListener); ok {
+		_ = tl.SetDeadline(time.Now().Add(ftpDataTimeout))
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	clientHost, _, _ := net.SplitHostPort(sess.conn.RemoteAddr().String())
+	dataHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if clientHost != dataHost {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from %s, expected %s", dataHost, clientHost)
+	}
+	return conn, nil
+}
+
+// store receives an upload. Media files are filed by their timestamps into
+// the camera's upload store, as YYYYMMDD/images000 or YYYYMMDD/record000;
+// anything else, such as a camera's FTP test file, is accepted and discarded.
+func (s *FTPReceiver) store(sess *ftpSession, vpath string) {
+	cam := s.cameraFor(vpath, sess.conn.RemoteAddr())
+	if cam == nil {
+		sess.reply(550, "Unknown camera; upload to /<camera-id>/")
+		return
+	}
+
+	name := path.Base(vpath)
+	if ext := path.Ext(name); ext != "" {
+		name = strings.TrimSuffix(name, ext) + strings.ToLower(ext)
+	}
+	name = strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), "._")
+	mediaType := mediaTypeForName(name)
+
+	data, err := s.openData(sess)
+	if err != nil {
+		sess.reply(425, "Can't open data connection")
+		return
+	}
+	defer data.Close()
+	sess.reply(150, "Ok to send data")
+
+	if mediaType == "" {
+		n, err := io.Copy(io.Discard, io.LimitReader(data, ftpMaxUploadSize+1))
+		if err != nil {
+			sess.reply(426, "Transfer aborted")
+			return
+		}
+		if n > ftpMaxUploadSize {
+			sess.reply(552, "File too large")
+			return
+		}
+		log.Printf("FTP receiver: discarded %s from camera %s, which isn't a media file", vpath, cam.ID)
+		sess.uploads[vpath] = ""
+		sess.reply(226, "Transfer complete")
+		return
+	}
+
+	dest, err := storeUpload(cam, name, mediaType, data)
+	if err != nil {
+		log.Printf("FTP receiver: failed to store %s from camera %s: %v", vpath, cam.ID, err)
+		if errors.Is(err, errUploadTooLarge) {
+			sess.reply(552, "File too large")
+		} else {
+			sess.reply(451, "Failed to store file")
+		}
+		return
+	}
+	sess.uploads[vpath] = dest
+	log.Printf("FTP receiver: stored %s for camera %s", strings.TrimPrefix(dest, cam.SourceDir+string(filepath.Separator)), cam.ID)
+	sess.reply(226, "Transfer complete")
+}
+
+// storeUpload writes an uploaded media file into the camera's upload store.
+// The file is written under a temporary name and renamed once complete, so
+// partial uploads are never listed.
+func storeUpload(cam *Camera, name, mediaType string, r io.Reader) (string, error) {
+	t := time.Now().In(cam.location)
+	if start, _, ok := parseMediaTimes(name, mediaType, cam.location); ok {
+		t = start
+	}
+	subdir := "images000"
+	if mediaType == "video" {
+		subdir = "record000"
+	}
+	dateDir := filepath.Join(cam.SourceDir, t.Format("20060102"))
+	dir := filepath.Join(dateDir, subdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(dir, name)
+	tmp := dest + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, ftpMaxUploadSize+1))
+	if err == nil && n > ftpMaxUploadSize {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	// Adding a file to images000 doesn't change the date directory's
+	// modification time, which the catalog checks to decide what to re-list
+	now := time.Now()
+	_ = os.Chtimes(dateDir, now, now)
+	return dest, nil
+}
+
+// cameraFor finds the camera an upload is from: the camera whose ID is the
+// first directory of the upload path, else the camera whose URL is the
+// client's IP address, else the only FTP camera
+func (s *FTPReceiver) cameraFor(vpath string, remote net.Addr) *Camera {
+	first, _, _ := strings.Cut(strings.TrimPrefix(vpath, "/"), "/")
+	for _, cam := range s.cameras {
+		if cam.ID == strings.ToLower(first) {
+			return cam
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+		for _, cam := range s.cameras {
+			if u, err := url.Parse(cam.URL); err == nil && cam.URL != "" && u.Hostname() == host {
+				return cam
+			}
+		}
+	}
+	if len(s.cameras) == 1 {
+		return s.cameras[0]
+	}
+	return nil
+}
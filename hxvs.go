@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// hxvsHeaderSize is the size of the HXVS file header and of each HXVF/HXAF frame header
+const hxvsHeaderSize = 16
+
+// Four-byte tags that start each part of an HXVS recording
+const (
+	hxvsTagH264  = "HXVS" // file header of an H.264 recording
+	hxvsTagH265  = "HXVT" // file header of an H.265 recording
+	hxvsTagVideo = "HXVF" // video frame
+	hxvsTagAudio = "HXAF" // audio frame
+	hxvsTagIndex = "HXFI" // frame index, written after the last frame
+)
+
+// maxHXVSFrameSize bounds a frame's declared length, so a corrupt length is
+// treated as malformed rather than swallowing the rest of the recording
+const maxHXVSFrameSize = 16 << 20
+
+// maxHXVSProblems caps the problems kept for a badly damaged recording
+const maxHXVSProblems = 20
+
+// errNotHXVS means the data doesn't start with an HXVS file header; some
+// cameras record a bare H.264/H.265 stream instead
+var errNotHXVS = errors.New("not an HXVS recording")
+
+// G.711 audio formats cameras record in HXAF frames, selected via CAMERA_AUDIO_FORMAT
+const (
+	AudioFormatALaw = "alaw" // G.711 A-law, the usual HiSilicon default
+	AudioFormatULaw = "ulaw" // G.711 µ-law
+	AudioFormatOff  = "off"  // drop the audio
+)
+
+// G.711 is always 8 kHz mono
+const g711SampleRate = 8000
+
+// HXVSFrame is one video or audio frame of an HXVS recording
+type HXVSFrame struct {
+	Audio     bool
+	Timestamp uint32 // milliseconds on the camera's clock
+	Keyframe  bool
+	Size      int
+	Data      []byte // Annex-B video, or the HXAF audio payload; not kept in HXVSRecording.Frames
+}
+
+// HXVSRecording describes an HXVS recording and the frames read from it so
+// far. Recordings start with a 16-byte file header, HXVS for H.264 or HXVT
+// for H.265 followed by the width and height, then interleave HXVF video and
+// HXAF audio frames. Each frame has a 16-byte header: the tag, the payload
+// length, a millisecond timestamp and, for video, a keyframe flag. An HXFI
+// frame index may follow the last frame.
+type HXVSRecording struct {
+	Codec     string // ffmpeg input format: "h264" or "hevc"
+	Width     int
+	Height    int
+	Frames    []HXVSFrame // without their data
+	IndexSize int         // bytes of HXFI index at the end, which isn't media
+	Problems  []string    // malformed or truncated frames found while reading
+	Skipped   int         // bytes thrown away while recovering from malformed frames
+}
+
+// hxvsReader reads an HXVS recording one frame at a time, walking the frames
+// by their declared lengths, so memory use doesn't grow with the length of
+// the recording. Damage doesn't stop it: a frame whose header is garbled is
+// skipped up to the next valid frame header and recorded in Problems, and a
+// frame cut short by the end of the recording is kept.
+type hxvsReader struct {
+	r      *bufio.Reader
+	rec    *HXVSRecording
+	buf    []byte // the current frame's payload, reused between frames
+	offset int64  // of the next unread byte
+	done   bool
+}
+
+// newHXVSReader reads the file header of a recording. It returns errNotHXVS
+// if there isn't one, in which case nothing has been read from r.
+func newHXVSReader(r *bufio.Reader) (*hxvsReader, error) {
+	header, err := r.Peek(hxvsHeaderSize)
+	if errors.Is(err, io.EOF) {
+		return nil, errNotHXVS
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := &HXVSRecording{
+		Width:  int(binary.LittleEndian.Uint32(header[4:8])),
+		Height: int(binary.LittleEndian.Uint32(header[8:12])),
+	}
+	switch string(header[:4]) {
+	case hxvsTagH264:
+		rec.Codec = "h264"
+	case hxvsTagH265:
+		rec.Codec = "hevc"
+	default:
+		return nil, errNotHXVS
+	}
+	if _, err := r.Discard(hxvsHeaderSize); err != nil {
+		return nil, err
+	}
+	return &hxvsReader{r: r, rec: rec, offset: hxvsHeaderSize}, nil
+}
+
+// Next returns the next video or audio frame, or io.EOF at the end of the
+// recording. The frame's data is only valid until the next call.
+func (h *hxvsReader) Next() (HXVSFrame, error) {
+	for !h.done {
+		header, err := h.r.Peek(hxvsHeaderSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return HXVSFrame{}, err
+		}
+		if len(header) == 0 {
+			break
+		}
+		tag, size, ok := hxvsFrameHeader(header)
+		if !ok {
+			if err := h.resync(); err != nil {
+				return HXVSFrame{}, err
+			}
+			continue
+		}
+
+		if tag == hxvsTagIndex {
+			n, err := io.Copy(io.Discard, h.r)
+			h.rec.IndexSize = int(n)
+			h.done = true
+			if err != nil {
+				return HXVSFrame{}, err
+			}
+			break
+		}
+
+		frame := HXVSFrame{
+			Audio:     tag == hxvsTagAudio,
+			Timestamp: binary.LittleEndian.Uint32(header[8:12]),
+			Keyframe:  tag == hxvsTagVideo && binary.LittleEndian.Uint32(header[12:16]) == 1,
+		}
+		if _, err := h.r.Discard(hxvsHeaderSize); err != nil {
+			return HXVSFrame{}, err
+		}
+		start := h.offset
+		h.offset += hxvsHeaderSize
+
+		if cap(h.buf) < size {
+			h.buf = make([]byte, size)
+		}
+		n, err := io.ReadFull(h.r, h.buf[:size])
+		h.offset += int64(n)
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			h.rec.problem("offset %d: %s frame truncated, %d of %d bytes", start, tag, n, size)
+			h.done = true
+			if n == 0 {
+				break
+			}
+		} else if err != nil {
+			return HXVSFrame{}, err
+		}
+
+		frame.Size = n
+		h.rec.Frames = append(h.rec.Frames, frame)
+		frame.Data = h.buf[:n]
+		return frame, nil
+	}
+	h.done = true
+	return HXVSFrame{}, io.EOF
+}
+
+// resync skips ahead to the next well-formed frame header, or the end of the
+// recording
+func (h *hxvsReader) resync() error {
+	start := h.offset
+	for {
+		if _, err := h.r.Discard(1); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		h.offset++
+		header, err := h.r.Peek(hxvsHeaderSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(header) == 0 {
+			break
+		}
+		if _, _, ok := hxvsFrameHeader(header); ok {
+			break
+		}
+	}
+	h.rec.problem("offset %d: malformed frame, skipped %d bytes", start, h.offset-start)
+	h.rec.Skipped += int(h.offset - start)
+	return nil
+}
+
+// hxvsFrameHeader reads a frame header, reporting whether it's well-formed.
+// header may be cut short by the end of the recording.
+func hxvsFrameHeader(header []byte) (tag string, size int, ok bool) {
+	if len(header) < hxvsHeaderSize {
+		// The index header may be shorter than a frame header at the very end
+		if len(header) >= 4 && string(header[:4]) == hxvsTagIndex {
+			return hxvsTagIndex, 0, true
+		}
+		return "", 0, false
+	}
+	tag = string(header[:4])
+	switch tag {
+	case hxvsTagVideo, hxvsTagAudio:
+	case hxvsTagIndex:
+		return tag, 0, true
+	default:
+		return "", 0, false
+	}
+	size = int(binary.LittleEndian.Uint32(header[4:8]))
+	if size == 0 || size > maxHXVSFrameSize {
+		return "", 0, false
+	}
+	return tag, size, true
+}
+
+// problem records a malformed frame, up to maxHXVSProblems
+func (rec *HXVSRecording) problem(format string, args ...interface{}) {
+	if len(rec.Problems) < maxHXVSProblems {
+		rec.Problems = append(rec.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// readVideoFrames reads the recording's video frames back from video, where
+// their data was written one after another, calling fn with each frame and
+// its index among the video frames
+func (rec *HXVSRecording) readVideoFrames(video io.Reader, fn func(i int, frame HXVSFrame) error) error {
+	var buf []byte
+	i := 0
+	for _, frame := range rec.Frames {
+		if frame.Audio {
+			continue
+		}
+		if cap(buf) < frame.Size {
+			buf = make([]byte, frame.Size)
+		}
+		frame.Data = buf[:frame.Size]
+		if _, err := io.ReadFull(video, frame.Data); err != nil {
+			return fmt.Errorf("failed to read video frame: %w", err)
+		}
+		if err := fn(i, frame); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+// Counts returns the number of video frames, keyframes and audio frames
+func (rec *HXVSRecording) Counts() (video, keyframes, audio int) {
+	for _, frame := range rec.Frames {
+		switch {
+		case frame.Audio:
+			audio++
+		case frame.Keyframe:
+			keyframes++
+			video++
+		default:
+			video++
+		}
+	}
+	return video, keyframes, audio
+}
+
+// g711Payload returns the G.711 samples of an HXAF payload. HiSilicon
+// encoders prefix each frame with a 4-byte header, 00 01 followed by the
+// sample count in 16-bit words, which isn't audio and would be heard as clicks.
+func g711Payload(payload []byte) []byte {
+	if len(payload) >= 4 && payload[0] == 0x00 && payload[1] == 0x01 && int(binary.LittleEndian.Uint16(payload[2:4]))*2 == len(payload)-4 {
+		return payload[4:]
+	}
+	return payload
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Payloads as a HiSilicon encoder writes them: a 1080p H.264 SPS, PPS and
+// IDR slice in the first frame, a P slice, and a G.711 frame with its header
+var (
+	testKeyframe = []byte{
+		0x00, 0x00, 0x00, 0x01, 0x67, 0x4d, 0x00, 0x2a, 0x95, 0xa8, 0x1e, 0x00, 0x89, 0xf9, 0x66, 0xe0, 0x20, 0x20, 0x20, 0x40,
+		0x00, 0x00, 0x00, 0x01, 0x68, 0xee, 0x3c, 0x80,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x80, 0x10, 0x00, 0x3f, 0xf2, 0x2c, 0x51,
+	}
+	testPFrame = []byte{0x00, 0x00, 0x00, 0x01, 0x41, 0x9a, 0x02, 0x04, 0x5f, 0xfe, 0x91, 0x82}
+	testAudio  = []byte{0x00, 0x01, 0x04, 0x00, 0xd5, 0xd5, 0x55, 0x54, 0xd4, 0x55, 0xd5, 0x54}
+)
+
+// hxvsFileHeader builds an HXVS file header
+func hxvsFileHeader(tag string, width, height uint32) []byte {
+	h := make([]byte, hxvsHeaderSize)
+	copy(h, tag)
+	binary.LittleEndian.PutUint32(h[4:], width)
+	binary.LittleEndian.PutUint32(h[8:], height)
+	return h
+}
+
+// hxvsFrame builds a frame with its header
+func hxvsFrame(tag string, timestamp uint32, keyframe bool, payload []byte) []byte {
+	h := make([]byte, hxvsHeaderSize, hxvsHeaderSize+len(payload))
+	copy(h, tag)
+	binary.LittleEndian.PutUint32(h[4:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(h[8:], timestamp)
+	if keyframe {
+		binary.LittleEndian.PutUint32(h[12:], 1)
+	}
+	return append(h, payload...)
+}
+
+// testRecording is a short H.264 recording with an index
+func testRecording() []byte {
+	return bytes.Join([][]byte{
+		hxvsFileHeader(hxvsTagH264, 1920, 1080),
+		hxvsFrame(hxvsTagVideo, 1000, true, testKeyframe),
+		hxvsFrame(hxvsTagAudio, 1010, false, testAudio),
+		hxvsFrame(hxvsTagVideo, 1050, false, testPFrame),
+		[]byte("HXFI"), make([]byte, 28),
+	}, nil)
+}
+
+// readHXVS reads every frame of a recording, checking each one's data
+func readHXVS(t testing.TB, data []byte) (*HXVSRecording, error) {
+	h, err := newHXVSReader(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		frame, err := h.Next()
+		if errors.Is(err, io.EOF) {
+			return h.rec, nil
+		}
+		if err != nil {
+			return h.rec, err
+		}
+		if frame.Size != len(frame.Data) {
+			t.Fatalf("frame size %d, but %d bytes of data", frame.Size, len(frame.Data))
+		}
+		if frame.Size <= 0 || frame.Size > maxHXVSFrameSize {
+			t.Fatalf("frame size %d out of range", frame.Size)
+		}
+	}
+}
+
+func TestHXVSReader(t *testing.T) {
+	clean := testRecording()
+	// Offsets of the frames in clean
+	audioAt := hxvsHeaderSize*2 + len(testKeyframe)
+	pFrameAt := audioAt + hxvsHeaderSize + len(testAudio)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		codec     string
+		sizes     []int // of the frames read
+		indexSize int
+		skipped   int
+		problem   string // expected in the problems, if any
+	}{
+		{
+			name:      "clean",
+			data:      clean,
+			codec:     "h264",
+			sizes:     []int{len(testKeyframe), len(testAudio), len(testPFrame)},
+			indexSize: 32,
+		},
+		{
+			name: "h265",
+			data: bytes.Join([][]byte{
+				hxvsFileHeader(hxvsTagH265, 2560, 1440),
+				hxvsFrame(hxvsTagVideo, 0, true, testPFrame),
+			}, nil),
+			codec: "hevc",
+			sizes: []int{len(testPFrame)},
+		},
+		{
+			name:    "truncated frame",
+			data:    clean[:pFrameAt+hxvsHeaderSize+5],
+			codec:   "h264",
+			sizes:   []int{len(testKeyframe), len(testAudio), 5},
+			problem: "HXVF frame truncated, 5 of 12 bytes",
+		},
+		{
+			name:    "truncated frame header",
+			data:    clean[:pFrameAt+10],
+			codec:   "h264",
+			sizes:   []int{len(testKeyframe), len(testAudio)},
+			skipped: 10,
+			problem: "malformed frame, skipped 10 bytes",
+		},
+		{
+			name: "damaged tag",
+			data: func() []byte {
+				data := bytes.Clone(clean)
+				copy(data[audioAt:], "XXXX")
+				return data
+			}(),
+			codec:     "h264",
+			sizes:     []int{len(testKeyframe), len(testPFrame)},
+			indexSize: 32,
+			skipped:   hxvsHeaderSize + len(testAudio),
+			problem:   "malformed frame, skipped 28 bytes",
+		},
+		{
+			name: "impossible length",
+			data: func() []byte {
+				data := bytes.Clone(clean)
+				binary.LittleEndian.PutUint32(data[audioAt+4:], maxHXVSFrameSize+1)
+				return data
+			}(),
+			codec:     "h264",
+			sizes:     []int{len(testKeyframe), len(testPFrame)},
+			indexSize: 32,
+			skipped:   hxvsHeaderSize + len(testAudio),
+			problem:   "malformed frame",
+		},
+		{
+			name: "junk between frames",
+			data: bytes.Join([][]byte{
+				clean[:audioAt],
+				[]byte("\x00\x00\x00\x01junk"),
+				clean[audioAt:],
+			}, nil),
+			codec:     "h264",
+			sizes:     []int{len(testKeyframe), len(testAudio), len(testPFrame)},
+			indexSize: 32,
+			skipped:   8,
+			problem:   "offset 73: malformed frame, skipped 8 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := readHXVS(t, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Codec != tt.codec {
+				t.Errorf("codec %s, want %s", rec.Codec, tt.codec)
+			}
+			var sizes []int
+			for _, frame := range rec.Frames {
+				sizes = append(sizes, frame.Size)
+			}
+			if !equalInts(sizes, tt.sizes) {
+				t.Errorf("frame sizes %v, want %v", sizes, tt.sizes)
+			}
+			if rec.IndexSize != tt.indexSize {
+				t.Errorf("index size %d, want %d", rec.IndexSize, tt.indexSize)
+			}
+			if rec.Skipped != tt.skipped {
+				t.Errorf("skipped %d bytes, want %d", rec.Skipped, tt.skipped)
+			}
+			problems := strings.Join(rec.Problems, "; ")
+			if tt.problem == "" && problems != "" {
+				t.Errorf("unexpected problems: %s", problems)
+			}
+			if tt.problem != "" && !strings.Contains(problems, tt.problem) {
+				t.Errorf("problems %q, want %q", problems, tt.problem)
+			}
+		})
+	}
+}
+
+func TestHXVSReaderNotHXVS(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("HXVS"),
+		testKeyframe,
+		hxvsFileHeader("HXVX", 1920, 1080),
+	} {
+		if _, err := readHXVS(t, data); !errors.Is(err, errNotHXVS) {
+			t.Errorf("%q: got %v, want errNotHXVS", data, err)
+		}
+	}
+}
+
+func TestHXVSReadVideoFrames(t *testing.T) {
+	rec, err := readHXVS(t, testRecording())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool := bytes.Join([][]byte{testKeyframe, testPFrame}, nil)
+
+	var got [][]byte
+	err = rec.readVideoFrames(bytes.NewReader(spool), func(i int, frame HXVSFrame) error {
+		if i != len(got) {
+			t.Errorf("frame index %d, want %d", i, len(got))
+		}
+		got = append(got, bytes.Clone(frame.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !bytes.Equal(got[0], testKeyframe) || !bytes.Equal(got[1], testPFrame) {
+		t.Errorf("read back %x", got)
+	}
+}
+
+func FuzzHXVSReader(f *testing.F) {
+	clean := testRecording()
+	f.Add(clean)
+	f.Add(clean[:len(clean)-40])
+	f.Add(bytes.Join([][]byte{
+		hxvsFileHeader(hxvsTagH265, 2560, 1440),
+		hxvsFrame(hxvsTagVideo, 0, true, testPFrame),
+		[]byte("HXVF\xff\xff\xff\xff"),
+		hxvsFrame(hxvsTagAudio, 40, false, testAudio),
+	}, nil))
+	f.Add(hxvsFileHeader(hxvsTagH264, 0, 0))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rec, err := readHXVS(t, data)
+		if errors.Is(err, errNotHXVS) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every byte is accounted for as a frame, the index or skipped
+		// damage, except the header of a frame cut off before its payload
+		accounted := hxvsHeaderSize + rec.IndexSize + rec.Skipped
+		for _, frame := range rec.Frames {
+			accounted += hxvsHeaderSize + frame.Size
+		}
+		if accounted != len(data) && accounted != len(data)-hxvsHeaderSize {
+			t.Fatalf("accounted for %d of %d bytes", accounted, len(data))
+		}
+		if (rec.Skipped > 0) != (len(rec.Problems) > 0) && !strings.Contains(strings.Join(rec.Problems, ""), "truncated") {
+			t.Fatalf("skipped %d bytes with problems %q", rec.Skipped, rec.Problems)
+		}
+		if len(rec.Problems) > maxHXVSProblems {
+			t.Fatalf("%d problems kept", len(rec.Problems))
+		}
+	})
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
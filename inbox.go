@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email receiver settings
+const (
+	smtpCommandTimeout = 5 * time.Minute
+	smtpMaxMessageSize = 20 << 20
+	smtpMaxLineLength  = 64 << 10
+
+	// A client is slowed down after each failed login, and disconnected
+	// after smtpMaxLoginFailures of them, to make guessing the password slow
+	smtpLoginFailureDelay = 2 * time.Second
+	smtpMaxLoginFailures  = 3
+
+	// inboxMatchWindow is how far apart an emailed snapshot and media on the
+	// SD card may be taken and still count as the same alarm
+	inboxMatchWindow = time.Minute
+
+	// inboxClockSkew is how far a message's Date header may be from the time
+	// it's received before the camera's clock is considered wrong
+	inboxClockSkew = 10 * time.Minute
+)
+
+// inboxURLPrefix marks the URLs of emailed snapshots, which are served from
+// the media cache rather than fetched from the camera
+const inboxURLPrefix = "email:"
+
+// Inbox holds the alarm snapshots a camera emailed, which show up as alarm
+// images until the same alarm's media is found on the SD card. The pending
+// snapshots are saved to a file, their JPEGs being in the media cache, so
+// they survive a restart.
+type Inbox struct {
+	cam       *Camera
+	path      string
+	retention time.Duration
+
+	mu    sync.Mutex
+	items []MediaItem // pending snapshots, oldest first
+}
+
+// NewInbox opens the inbox saved at path, or creates an empty one. Snapshots
+// that are never matched with SD card media are dropped after retention, as
+// are those whose JPEG has gone from the cache.
+func NewInbox(cam *Camera, path string, retention time.Duration) (*Inbox, error) {
+	in := &Inbox{cam: cam, path: path, retention: retention}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return in, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inbox: %w", err)
+	}
+	var items []MediaItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		log.Printf("Warning: ignoring unreadable inbox %s: %v", path, err)
+		return in, nil
+	}
+	for _, item := range items {
+		if item.Start == nil || !cam.cache.Has(item.URL, proxyCacheSuffix(item.URL)) {
+			continue
+		}
+		start := item.Start.In(cam.location)
+		item.Start = &start
+		in.items = append(in.items, item)
+	}
+	return in, nil
+}
+
+// Pending returns the snapshots that haven't been matched with SD card media
+func (in *Inbox) Pending() []MediaItem {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	cutoff := time.Now().Add(-in.retention)
+	kept := in.items[:0]
+	for _, item := range in.items {
+		if item.Start.After(cutoff) {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) < len(in.items) {
+		in.items = kept
+		in.save()
+	}
+	return append([]MediaItem(nil), in.items...)
+}
+
+// Deliver stores the JPEGs from an alarm email in the media cache and
+// publishes them as new alarm images. Snapshots of an alarm whose media is
+// already on the SD card are dropped.
+func (in *Inbox) Deliver(received time.Time, images []emailImage) (int, error) {
+	cam := in.cam
+	id := randomHex(6)
+	var items []MediaItem
+	for i, img := range images {
+		seq := i
+		start := received.In(cam.location)
+		name := img.name
+		if name == "" {
+			name = fmt.Sprintf("%s-%02d.jpg", id, i)
+		}
+		item := MediaItem{
+			Camera:    cam.ID,
+			Name:      name,
+			Path:      "email/" + id + "/" + fmt.Sprintf("%02d-%s", i, name),
+			Date:      start.Format("20060102"),
+			Type:      "image",
+			Trigger:   "alarm",
+			Timestamp: start.Format("2006-01-02 15:04:05"),
+			Start:     &start,
+			Sequence:  &seq,
+			Size:      fmt.Sprintf("%dK", (len(img.data)+1023)/1024),
+			SizeBytes: int64(len(img.data)),
+			Modified:  start.Format("02-Jan-2006 15:04"),
+			Source:    "email",
+		}
+		item.URL = inboxURLPrefix + item.Path
+		item.DownloadFilename = generateDownloadFilename(cam.Name, item.Start, name, "image")
+		if in.onCard(item) {
+			continue
+		}
+
+		data := img.data
+		if _, err := cam.cache.Get(item.URL, proxyCacheSuffix(item.URL), func() ([]byte, error) {
+			return data, nil
+		}); err != nil {
+			return 0, fmt.Errorf("failed to cache emailed snapshot: %w", err)
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	in.mu.Lock()
+	in.items = append(in.items, items...)
+	in.save()
+	in.mu.Unlock()
+
+	changeFeed.Publish(cam, &CatalogChanges{Added: items})
+	return len(items), nil
+}
+
+// onCard reports whether the SD card already has media for the same alarm
+// as a snapshot
+func (in *Inbox) onCard(snapshot MediaItem) bool {
+	for _, item := range in.cam.catalog.Items() {
+		if sameAlarm(snapshot, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reconcile drops the snapshots of alarms whose media was just found on the
+// SD card, returning them
+func (in *Inbox) Reconcile(added []MediaItem) []MediaItem {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	var kept, matched []MediaItem
+	for _, snapshot := range in.items {
+		found := false
+		for _, item := range added {
+			if sameAlarm(snapshot, item) {
+				found = true
+				break
+			}
+		}
+		if found {
+			matched = append(matched, snapshot)
+		} else {
+			kept = append(kept, snapshot)
+		}
+	}
+	in.items = kept
+	if len(matched) > 0 {
+		in.save()
+	}
+	return matched
+}
+
+// save writes the pending snapshots to the inbox file. The caller must hold
+// in.mu. A failed save is only logged: the snapshots are still served, and
+// at worst are forgotten on restart.
+func (in *Inbox) save() {
+	if err := in.write(); err != nil {
+		log.Printf("Warning: failed to save inbox %s: %v", in.path, err)
+	}
+}
+
+func (in *Inbox) write() error {
+	data, err := json.Marshal(in.items)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(in.path), "temp-inbox-*.json")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer func() {
+		_ = os.Remove(tempPath)
+	}()
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, in.path)
+}
+
+// sameAlarm reports whether SD card media was recorded for the alarm an
+// emailed snapshot was taken for
+func sameAlarm(snapshot, item MediaItem) bool {
+	if item.Trigger != "alarm" || item.Start == nil || item.Source != "" {
+		return false
+	}
+	end := *item.Start
+	if item.End != nil {
+		end = *item.End
+	}
+	return !snapshot.Start.Before(item.Start.Add(-inboxMatchWindow)) &&
+		!snapshot.Start.After(end.Add(inboxMatchWindow))
+}
+
+// emailImage is a JPEG attached to an email
+type emailImage struct {
+	name string
+	data []byte
+}
+
+// unsafeNameChars matches characters not kept in attachment filenames
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// extractEmailImages returns the JPEGs attached to or embedded in a message
+func extractEmailImages(header mail.Header, body io.Reader) ([]emailImage, error) {
+	return extractPartImages(header.Get("Content-Type"), header.Get("Content-Transfer-Encoding"), header.Get("Content-Disposition"), body, 0)
+}
+
+// extractPartImages walks a MIME part, descending into multipart containers
+func extractPartImages(contentType, encoding, disposition string, body io.Reader, depth int) ([]emailImage, error) {
+	if depth > 10 {
+		return nil, errors.New("MIME parts nested too deeply")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		var images []emailImage
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return images, nil
+			}
+			if err != nil {
+				return images, err
+			}
+			found, err := extractPartImages(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part, depth+1)
+			images = append(images, found...)
+			if err != nil {
+				return images, err
+			}
+		}
+	}
+
+	// Some cameras label snapshots application/octet-stream, so go by the
+	// filename as well as the content type
+	name := params["name"]
+	if _, dispParams, err := mime.ParseMediaType(disposition); err == nil && dispParams["filename"] != "" {
+		name = dispParams["filename"]
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if mediaType != "image/jpeg" && mediaType != "image/jpg" && ext != ".jpg" && ext != ".jpeg" {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode attachment: %w", err)
+	}
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil, nil
+	}
+
+	name = strings.Trim(unsafeNameChars.ReplaceAllString(path.Base(name), "_"), "._")
+	if name != "" && ext != ".jpg" && ext != ".jpeg" {
+		name += ".jpg"
+	}
+	return []emailImage{{name: name, data: data}}, nil
+}
+
+// SMTPReceiverConfig holds the settings for the embedded SMTP server
+type SMTPReceiverConfig struct {
+	Addr      string // listen address, e.g. ":2525"; disabled if empty
+	Username  string // required from clients if set
+	Password  string
+	Retention time.Duration
+}
+
+// loadSMTPReceiverConfig reads the SMTP receiver settings from the environment
+func loadSMTPReceiverConfig() SMTPReceiverConfig {
+	cfg := SMTPReceiverConfig{
+		Addr:      getEnv("SMTP_RECEIVER_ADDR", ""),
+		Username:  getEnv("SMTP_RECEIVER_USERNAME", ""),
+		Password:  getEnv("SMTP_RECEIVER_PASSWORD", ""),
+		Retention: time.Duration(getEnvInt("SMTP_RECEIVER_RETENTION_HOURS", 24)) * time.Hour,
+	}
+	if cfg.Retention < time.Hour {
+		log.Printf("Warning: SMTP_RECEIVER_RETENTION_HOURS must be >= 1, using 1")
+		cfg.Retention = time.Hour
+	}
+	return cfg
+}
+
+// SMTPReceiver is a minimal SMTP server that accepts alarm emails from
+// cameras and delivers their snapshots to the cameras' inboxes
+type SMTPReceiver struct {
+	cfg     SMTPReceiverConfig
+	cameras []*Camera
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewSMTPReceiver creates a receiver for the given cameras, which must have inboxes
+func NewSMTPReceiver(cfg SMTPReceiverConfig, cameras []*Camera) *SMTPReceiver {
+	return &SMTPReceiver{cfg: cfg, cameras: cameras, conns: make(map[net.Conn]struct{})}
+}
+
+// Start begins accepting connections
+func (s *SMTPReceiver) Start() error {
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SMTP: %w", err)
+	}
+	s.listener = listener
+	log.Printf("SMTP receiver listening on %s", listener.Addr())
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+	return nil
+}
+
+// Stop stops accepting connections and closes open ones
+func (s *SMTPReceiver) Stop() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	log.Println("SMTP receiver stopped")
+}
+
+// smtpSession is the state of one SMTP conversation
+type smtpSession struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	w             *bufio.Writer
+	authenticated bool
+	failures      int // failed logins
+	from          string
+	cameras       []*Camera
+}
+
+func (sess *smtpSession) reply(code int, lines ...string) {
+	for i, line := range lines {
+		sep := " "
+		if i < len(lines)-1 {
+			sep = "-"
+		}
+		fmt.Fprintf(sess.w, "%d%s%s\r\n", code, sep, line)
+	}
+	sess.w.Flush()
+}
+
+// readLine reads a CRLF-terminated line, without the line ending
+func (sess *smtpSession) readLine() (string, error) {
+	_ = sess.conn.SetReadDeadline(time.Now().Add(smtpCommandTimeout))
+	var line []byte
+	for {
+		chunk, isPrefix, err := sess.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > smtpMaxLineLength {
+			return "", errors.New("line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func (sess *smtpSession) reset() {
+	sess.from = ""
+	sess.cameras = nil
+}
+
+// serve runs an SMTP conversation
+func (s *SMTPReceiver) serve(conn net.Conn) {
+	sess := &smtpSession{
+		conn:          conn,
+		r:             bufio.NewReader(conn),
+		w:             bufio.NewWriter(conn),
+		authenticated: s.cfg.Username == "",
+	}
+	sess.reply(220, "ipcam-browser ESMTP ready")
+
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			sess.reset()
+			sess.reply(250, "ipcam-browser")
+		case "EHLO":
+			sess.reset()
+			sess.reply(250, "ipcam-browser", fmt.Sprintf("SIZE %d", smtpMaxMessageSize), "8BITMIME", "AUTH PLAIN LOGIN")
+		case "AUTH":
+			if s.authenticate(sess, arg) {
+				sess.authenticated = true
+				sess.reply(235, "Authentication successful")
+				continue
+			}
+			sess.failures++
+			time.Sleep(smtpLoginFailureDelay)
+			if sess.failures >= smtpMaxLoginFailures {
+				log.Printf("SMTP receiver: closing connection from %s after %d failed logins", conn.RemoteAddr(), sess.failures)
+				sess.reply(421, "Too many failed logins")
+				return
+			}
+			sess.reply(535, "Authentication failed")
+		case "MAIL":
+			if !sess.authenticated {
+				sess.reply(530, "Authentication required")
+				continue
+			}
+			sess.reset()
+			sess.from = arg
+			sess.reply(250, "OK")
+		case "RCPT":
+			if sess.from == "" {
+				sess.reply(503, "MAIL first")
+				continue
+			}
+			cam := s.cameraFor(arg, conn.RemoteAddr())
+			if cam == nil {
+				sess.reply(550, "Unknown camera; send to <camera-id>@ipcam-browser")
+				continue
+			}
+			sess.cameras = append(sess.cameras, cam)
+			sess.reply(250, "OK")
+		case "DATA":
+			if len(sess.cameras) == 0 {
+				sess.reply(503, "RCPT first")
+				continue
+			}
+			sess.reply(354, "End data with <CR><LF>.<CR><LF>")
+			data, err := readSMTPData(sess)
+			if err != nil {
+				if errors.Is(err, errMessageTooLarge) {
+					sess.reply(552, "Message too large")
+					sess.reset()
+					continue
+				}
+				return
+			}
+			if err := s.deliver(data, sess.cameras); err != nil {
+				log.Printf("SMTP receiver: %v", err)
+				sess.reply(554, "Could not process message")
+			} else {
+				sess.reply(250, "OK")
+			}
+			sess.reset()
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "OK")
+		case "NOOP":
+			sess.reply(250, "OK")
+		case "VRFY":
+			sess.reply(252, "Cannot verify")
+		case "QUIT":
+			sess.reply(221, "Bye")
+			return
+		default:
+			sess.reply(502, "Command not implemented")
+		}
+	}
+}
+
+// authenticate runs an AUTH PLAIN or AUTH LOGIN exchange. Without a
+// configured username any credentials are accepted, since many cameras
+// refuse to send email without authenticating.
+func (s *SMTPReceiver) authenticate(sess *smtpSession, arg string) bool {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var username, password string
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			sess.reply(334, "")
+			line, err := sess.readLine()
+			if err != nil {
+				return false
+			}
+			initial = line
+		}
+		decoded, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			return false
+		}
+		fields := strings.Split(string(decoded), "\x00")
+		if len(fields) != 3 {
+			return false
+		}
+		username, password = fields[1], fields[2]
+	case "LOGIN":
+		values := []string{initial}
+		prompts := []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"} // "Username:", "Password:"
+		if initial != "" {
+			prompts = prompts[1:]
+		} else {
+			values = nil
+		}
+		for _, prompt := range prompts {
+			sess.reply(334, prompt)
+			line, err := sess.readLine()
+			if err != nil {
+				return false
+			}
+			values = append(values, line)
+		}
+		for i, value := range values {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return false
+			}
+			values[i] = string(decoded)
+		}
+		username, password = values[0], values[1]
+	default:
+		return false
+	}
+
+	if s.cfg.Username == "" {
+		return true
+	}
+	return s.checkLogin(username, password)
+}
+
+// checkLogin reports whether a username and password are the configured
+// login, taking the same time however much of them matches
+func (s *SMTPReceiver) checkLogin(username, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.cfg.Username))
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password))
+	return userOK&passOK == 1
+}
+
+// cameraFor finds the camera an email is from: the camera whose ID is the
+// recipient's local part, else the camera at the client's IP address, else
+// the only camera
+func (s *SMTPReceiver) cameraFor(rcpt string, remote net.Addr) *Camera {
+	addr := strings.TrimPrefix(strings.TrimPrefix(rcpt, "TO:"), "to:")
+	addr = strings.Trim(strings.TrimSpace(addr), "<>")
+	local, _, _ := strings.Cut(addr, "@")
+	if cam := lookupCamera(strings.ToLower(local)); cam != nil {
+		return cam
+	}
+
+	if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+		for _, cam := range s.cameras {
+			if u, err := url.Parse(cam.source.URL("")); err == nil && u.Hostname() == host {
+				return cam
+			}
+		}
+	}
+	if len(s.cameras) == 1 {
+		return s.cameras[0]
+	}
+	return nil
+}
+
+// deliver hands the snapshots in a message to the recipient cameras' inboxes
+func (s *SMTPReceiver) deliver(data []byte, cameras []*Camera) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse message: %w", err)
+	}
+	images, err := extractEmailImages(msg.Header, msg.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read attachments: %w", err)
+	}
+
+	// Prefer the camera's own timestamp, which matches its SD card
+	// filenames, unless its clock is clearly wrong
+	received := time.Now()
+	if date, err := msg.Header.Date(); err == nil && date.Sub(received).Abs() < inboxClockSkew {
+		received = date
+	}
+
+	seen := make(map[string]bool)
+	for _, cam := range cameras {
+		if seen[cam.ID] {
+			continue
+		}
+		seen[cam.ID] = true
+
+		n, err := cam.inbox.Deliver(received, images)
+		if err != nil {
+			return err
+		}
+		log.Printf("SMTP receiver: %d snapshot(s) from %s for camera %s", n, msg.Header.Get("From"), cam.ID)
+	}
+	return nil
+}
+
+var errMessageTooLarge = errors.New("message too large")
+
+// readSMTPData reads a message after DATA, up to the terminating dot line,
+// undoing dot-stuffing
+func readSMTPData(sess *smtpSession) ([]byte, error) {
+	var data bytes.Buffer
+	tooLarge := false
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "." {
+			break
+		}
+		line = strings.TrimPrefix(line, ".")
+		if data.Len()+len(line) > smtpMaxMessageSize {
+			tooLarge = true
+			continue
+		}
+		data.WriteString(line)
+		data.WriteString("\r\n")
+	}
+	if tooLarge {
+		return nil, errMessageTooLarge
+	}
+	return data.Bytes(), nil
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"embed"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -18,13 +18,12 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
-
-	"golang.org/x/net/html"
 )
 
 var version = "<dev>"
@@ -33,14 +32,25 @@ var version = "<dev>"
 var staticFiles embed.FS
 
 type Config struct {
-	CameraURL                string
-	CameraName               string
-	Username                 string
-	Password                 string
+	Cameras                  []CameraConfig
 	CacheDir                 string
+	DataDir                  string // annotations and other data that must survive cache wipes
 	MaxConcurrentConversions int
 	BackgroundCacheEnabled   bool
 	BackgroundCacheInterval  time.Duration
+	ChangesPollInterval      time.Duration
+	ArchiveDir               string
+	ArchiveInterval          time.Duration
+	ArchiveRetention         ArchiveRetention
+	EventGap                 time.Duration
+	Webhooks                 []WebhookConfig
+	PublicURL                string // base URL for links sent to webhooks and MQTT
+	MQTT                     MQTTConfig
+	Notifiers                []NotifierConfig
+	Email                    EmailConfig
+	SMTPReceiver             SMTPReceiverConfig
+	FTPReceiver              FTPReceiverConfig
+	RemuxEngine              string
 }
 
 // MediaCache handles thread-safe caching of media files
@@ -78,6 +88,12 @@ func (c *MediaCache) getFileLock(cacheKey string) *sync.Mutex {
 	return lock.(*sync.Mutex)
 }
 
+// Has reports whether a file is already cached
+func (c *MediaCache) Has(url string, suffix string) bool {
+	_, err := os.Stat(c.getCachePath(url, suffix))
+	return err == nil
+}
+
 // Get retrieves a file from cache, or executes fetchFunc if not cached
 // This ensures only one goroutine fetches a given file at a time
 func (c *MediaCache) Get(url string, suffix string, fetchFunc func() ([]byte, error)) (string, error) {
@@ -190,42 +206,62 @@ func (c *MediaCache) GetWithFile(url string, suffix string, fetchFunc func(destP
 	return cachePath, nil
 }
 
-// BackgroundCacher handles periodic media caching in the background
+// BackgroundCacher handles periodic media caching in the background. Between
+// cache runs it also polls the cameras for new media, which feeds the change
+// feed.
 type BackgroundCacher struct {
-	interval time.Duration
-	cache    *MediaCache
-	stopCh   chan struct{}
-	doneCh   chan struct{}
-	running  sync.Mutex // Prevents concurrent cache runs
+	interval     time.Duration // between cache runs; 0 disables caching
+	pollInterval time.Duration // between catalog syncs; 0 disables polling
+	cameras      []*Camera
+	stopCh       chan struct{}
+	doneCh       chan struct{}
+	running      sync.Mutex // Prevents concurrent cache runs
 }
 
 // NewBackgroundCacher creates a new background cacher
-func NewBackgroundCacher(interval time.Duration, cache *MediaCache) *BackgroundCacher {
+func NewBackgroundCacher(interval, pollInterval time.Duration, cameras []*Camera) *BackgroundCacher {
 	return &BackgroundCacher{
-		interval: interval,
-		cache:    cache,
-		stopCh:   make(chan struct{}),
-		doneCh:   make(chan struct{}),
+		interval:     interval,
+		pollInterval: pollInterval,
+		cameras:      cameras,
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
 	}
 }
 
 // Start begins the background caching loop
 func (b *BackgroundCacher) Start() {
-	log.Printf("Starting background cacher with interval %v", b.interval)
+	log.Printf("Starting background cacher with interval %v, polling every %v", b.interval, b.pollInterval)
 
 	go func() {
 		defer close(b.doneCh)
 
-		// Run immediately on startup (but asynchronously so server can start)
-		b.runCacheJob()
+		// A nil channel never fires, which disables a disabled job's case below
+		var cacheTick, pollTick <-chan time.Time
+		if b.interval > 0 {
+			ticker := time.NewTicker(b.interval)
+			defer ticker.Stop()
+			cacheTick = ticker.C
+		}
+		if b.pollInterval > 0 {
+			ticker := time.NewTicker(b.pollInterval)
+			defer ticker.Stop()
+			pollTick = ticker.C
+		}
 
-		ticker := time.NewTicker(b.interval)
-		defer ticker.Stop()
+		// Run immediately on startup (but asynchronously so server can start)
+		if b.interval > 0 {
+			b.runCacheJob()
+		} else {
+			b.runPollJob()
+		}
 
 		for {
 			select {
-			case <-ticker.C:
+			case <-cacheTick:
 				b.runCacheJob()
+			case <-pollTick:
+				b.runPollJob()
 			case <-b.stopCh:
 				log.Println("Background cacher received stop signal")
 				return
@@ -258,15 +294,40 @@ func (b *BackgroundCacher) runCacheJob() {
 	log.Println("Background cache: starting media fetch and cache run")
 	startTime := time.Now()
 
-	// Fetch all media - this also triggers async video pre-caching via preCacheVideos,
-	// but we'll wait for completion below using preCacheVideosSync
-	media, err := fetchAllMedia()
-	if err != nil {
-		log.Printf("Background cache: failed to fetch media: %v", err)
+	for _, cam := range b.cameras {
+		b.cacheCamera(cam)
+	}
+
+	log.Printf("Background cache: completed in %v", time.Since(startTime))
+}
+
+// runPollJob syncs every camera's catalog so that new and removed media is
+// published to the change feed. It's skipped while a cache run, which also
+// syncs, is in progress.
+func (b *BackgroundCacher) runPollJob() {
+	if !b.running.TryLock() {
 		return
 	}
+	defer b.running.Unlock()
+
+	for _, cam := range b.cameras {
+		if _, err := cam.syncCatalog(); err != nil {
+			log.Printf("Background poll [%s]: failed to sync catalog: %v", cam.ID, err)
+		}
+	}
+}
+
+// cacheCamera syncs the catalog for a single camera and caches its media
+func (b *BackgroundCacher) cacheCamera(cam *Camera) {
+	// Sync the catalog - this also triggers async video pre-caching of new
+	// videos via preCacheVideos, but we'll cache everything below using preCacheVideosSync
+	if _, err := cam.syncCatalog(); err != nil {
+		log.Printf("Background cache [%s]: failed to sync catalog: %v", cam.ID, err)
+		return
+	}
+	media := cam.catalog.Items()
 
-	log.Printf("Background cache: fetched %d media items", len(media))
+	log.Printf("Background cache [%s]: fetched %d media items", cam.ID, len(media))
 
 	// Count videos and images
 	videoCount := 0
@@ -279,10 +340,10 @@ func (b *BackgroundCacher) runCacheJob() {
 			imageCount++
 		}
 	}
-	log.Printf("Background cache: caching %d videos and %d images", videoCount, imageCount)
+	log.Printf("Background cache [%s]: caching %d videos and %d images", cam.ID, videoCount, imageCount)
 
 	// Pre-cache videos and images concurrently
-	// Note: fetchAllMedia already spawned async preCacheVideos, but the MediaCache's
+	// Note: syncCatalog already spawned async preCacheVideos, but the MediaCache's
 	// per-file locking ensures no duplicate work - whichever goroutine gets there
 	// first does the work, others return immediately from the cache check
 	var wg sync.WaitGroup
@@ -290,22 +351,20 @@ func (b *BackgroundCacher) runCacheJob() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		preCacheVideosSync(media)
+		preCacheVideosSync(cam, media)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		b.preCacheImages(media)
+		b.preCacheImages(cam, media)
 	}()
 
 	wg.Wait()
-
-	log.Printf("Background cache: completed in %v", time.Since(startTime))
 }
 
 // preCacheImages downloads and caches images, prioritizing video thumbnails
-func (b *BackgroundCacher) preCacheImages(media []MediaItem) {
+func (b *BackgroundCacher) preCacheImages(cam *Camera, media []MediaItem) {
 	// Create a semaphore to limit concurrent image fetches
 	// Use same limit as video conversions to avoid overwhelming the camera
 	sem := make(chan struct{}, config.MaxConcurrentConversions)
@@ -316,16 +375,14 @@ func (b *BackgroundCacher) preCacheImages(media []MediaItem) {
 	for _, item := range media {
 		if item.Type == "video" && item.ThumbnailURL != "" {
 			// Extract the actual image URL from the proxy URL
-			// ThumbnailURL format: /api/proxy?url=<encoded-url>
-			thumbnailURL := item.ThumbnailURL
-			if !strings.HasPrefix(thumbnailURL, "/api/proxy?url=") {
+			// ThumbnailURL format: /api/proxy?camera=<id>&url=<encoded-url>
+			thumbnailURL, err := url.Parse(item.ThumbnailURL)
+			if err != nil || thumbnailURL.Path != "/api/proxy" {
+				log.Printf("Background cache [%s]: failed to decode thumbnail URL: %s", cam.ID, item.ThumbnailURL)
 				continue
 			}
-
-			encodedURL := strings.TrimPrefix(thumbnailURL, "/api/proxy?url=")
-			imageURL, err := url.QueryUnescape(encodedURL)
-			if err != nil {
-				log.Printf("Background cache: failed to decode thumbnail URL: %v", err)
+			imageURL := thumbnailURL.Query().Get("url")
+			if imageURL == "" {
 				continue
 			}
 
@@ -340,11 +397,11 @@ func (b *BackgroundCacher) preCacheImages(media []MediaItem) {
 					ext = ".jpg"
 				}
 
-				_, err := b.cache.Get(imgURL, ext, func() ([]byte, error) {
-					return fetchFromCamera(imgURL)
+				_, err := cam.cache.Get(imgURL, ext, func() ([]byte, error) {
+					return cam.fetchFromCamera(imgURL)
 				})
 				if err != nil {
-					log.Printf("Background cache: failed to cache thumbnail %s: %v", imgURL, err)
+					log.Printf("Background cache [%s]: failed to cache thumbnail %s: %v", cam.ID, imgURL, err)
 				}
 			}(imageURL)
 		}
@@ -364,11 +421,11 @@ func (b *BackgroundCacher) preCacheImages(media []MediaItem) {
 					ext = ".jpg"
 				}
 
-				_, err := b.cache.Get(imgURL, ext, func() ([]byte, error) {
-					return fetchFromCamera(imgURL)
+				_, err := cam.cache.Get(imgURL, ext, func() ([]byte, error) {
+					return cam.fetchFromCamera(imgURL)
 				})
 				if err != nil {
-					log.Printf("Background cache: failed to cache image %s: %v", imgURL, err)
+					log.Printf("Background cache [%s]: failed to cache image %s: %v", cam.ID, imgURL, err)
 				}
 			}(item.URL)
 		}
@@ -378,18 +435,65 @@ func (b *BackgroundCacher) preCacheImages(media []MediaItem) {
 }
 
 type MediaItem struct {
-	Name             string `json:"name"`
-	Path             string `json:"path"`
-	URL              string `json:"url"`
-	ProxyURL         string `json:"proxyUrl"`
-	ThumbnailURL     string `json:"thumbnailUrl,omitempty"`
-	DownloadFilename string `json:"downloadFilename"`
-	Date             string `json:"date"`
-	Type             string `json:"type"`
-	Trigger          string `json:"trigger"`
-	Timestamp        string `json:"timestamp"`
-	Size             string `json:"size"`
-	Modified         string `json:"modified"`
+	Camera           string      `json:"camera"`
+	Name             string      `json:"name"`
+	Path             string      `json:"path"`
+	URL              string      `json:"url"`
+	ProxyURL         string      `json:"proxyUrl"`
+	ThumbnailURL     string      `json:"thumbnailUrl,omitempty"`
+	DownloadFilename string      `json:"downloadFilename"`
+	Date             string      `json:"date"`
+	Type             string      `json:"type"`
+	Trigger          string      `json:"trigger"`
+	Timestamp        string      `json:"timestamp"`
+	Start            *time.Time  `json:"start,omitempty"`           // omitted if the filename has no timestamp
+	End              *time.Time  `json:"end,omitempty"`             // videos only
+	DurationSeconds  int         `json:"durationSeconds,omitempty"` // videos only
+	Sequence         *int        `json:"sequence,omitempty"`        // images only: frame number within the second
+	Size             string      `json:"size"`
+	SizeBytes        int64       `json:"sizeBytes,omitempty"` // omitted if Size can't be parsed
+	Modified         string      `json:"modified"`
+	Availability     string      `json:"availability,omitempty"` // only set while the camera is offline
+	Archived         bool        `json:"archived,omitempty"`     // no longer on the camera, served from the archive
+	Frames           []MediaItem `json:"frames,omitempty"`       // burst items only: every frame, in order
+	Source           string      `json:"source,omitempty"`       // "email" for snapshots the camera emailed; empty for SD card media
+	Tags             []string    `json:"tags,omitempty"`         // from the item's annotation
+	Favorite         bool        `json:"favorite,omitempty"`     // from the item's annotation
+	Notes            string      `json:"notes,omitempty"`        // from the item's annotation
+}
+
+// Media availability values, reported while a camera is offline
+const (
+	AvailabilityCached      = "cached"      // served from the cache
+	AvailabilityUnavailable = "unavailable" // not cached, so it can't be served until the camera is back
+)
+
+// MediaResponse is the response body of GET /api/media?envelope=true
+type MediaResponse struct {
+	Camera string `json:"camera"`
+	CameraStatus
+	LastSynced time.Time      `json:"lastSynced"`
+	Dates      []string       `json:"dates"`  // every date directory, regardless of filters
+	Total      int            `json:"total"`  // items matching the filters, across all pages
+	Counts     map[string]int `json:"counts"` // items matching the filters, by type
+	NextCursor string         `json:"nextCursor,omitempty"`
+	Items      []MediaItem    `json:"items"`
+}
+
+type EventsResponse struct {
+	Camera string `json:"camera"`
+	CameraStatus
+	LastSynced time.Time `json:"lastSynced"`
+	Dates      []string  `json:"dates"` // every date directory, regardless of filters
+	Total      int       `json:"total"` // events matching the filters, across all pages
+	NextCursor string    `json:"nextCursor,omitempty"`
+	Events     []Event   `json:"events"`
+}
+
+type MediaChangesResponse struct {
+	Cursor  string        `json:"cursor"` // pass as since to get the changes after these
+	Reset   bool          `json:"reset"`  // changes were missed; reload the media list
+	Changes []MediaChange `json:"changes"`
 }
 
 type DirectoryEntry struct {
@@ -401,7 +505,15 @@ type DirectoryEntry struct {
 }
 
 var config Config
-var mediaCache *MediaCache
+
+// webhookDispatcher is nil if no webhooks are configured
+var webhookDispatcher *WebhookDispatcher
+
+// notificationDispatcher is nil if no notifiers are configured
+var notificationDispatcher *NotificationDispatcher
+
+// emailNotifier is nil if no SMTP server is configured
+var emailNotifier *EmailNotifier
 
 func main() {
 	// Parse flags
@@ -414,15 +526,63 @@ func main() {
 	}
 
 	// Load config from environment
+	cameraConfigs, err := loadCameraConfigs()
+	if err != nil {
+		log.Fatalf("Invalid camera configuration: %v", err)
+	}
+	webhookConfigs, err := loadWebhookConfigs()
+	if err != nil {
+		log.Fatalf("Invalid webhook configuration: %v", err)
+	}
+	mqttConfig, err := loadMQTTConfig()
+	if err != nil {
+		log.Fatalf("Invalid MQTT configuration: %v", err)
+	}
+	notifierConfigs, err := loadNotifierConfigs()
+	if err != nil {
+		log.Fatalf("Invalid notifier configuration: %v", err)
+	}
+	emailConfig, err := loadEmailConfig()
+	if err != nil {
+		log.Fatalf("Invalid email configuration: %v", err)
+	}
+	ftpReceiverConfig, err := loadFTPReceiverConfig()
+	if err != nil {
+		log.Fatalf("Invalid FTP receiver configuration: %v", err)
+	}
+	remuxEngine, err := loadRemuxEngine()
+	if err != nil {
+		log.Fatalf("Invalid remux configuration: %v", err)
+	}
+	port := getEnv("PORT", "8080")
 	config = Config{
-		CameraURL:                getEnv("CAMERA_URL", ""),
-		CameraName:               getEnv("CAMERA_NAME", "camera"),
-		Username:                 getEnv("CAMERA_USERNAME", "admin"),
-		Password:                 getEnv("CAMERA_PASSWORD", ""),
+		Cameras:                  cameraConfigs,
 		CacheDir:                 getEnv("CACHE_DIR", filepath.Join(os.TempDir(), "ipcam-browser-cache")),
+		DataDir:                  getEnv("DATA_DIR", defaultDataDir()),
 		MaxConcurrentConversions: getEnvInt("MAX_CONCURRENT_CONVERSIONS", 3),
 		BackgroundCacheEnabled:   getEnvBool("BACKGROUND_CACHE_ENABLED", false),
 		BackgroundCacheInterval:  time.Duration(getEnvInt("BACKGROUND_CACHE_INTERVAL_MINUTES", 5)) * time.Minute,
+		ChangesPollInterval:      time.Duration(getEnvInt("CHANGES_POLL_INTERVAL_SECONDS", 60)) * time.Second,
+		ArchiveDir:               getEnv("ARCHIVE_DIR", ""),
+		ArchiveInterval:          time.Duration(getEnvInt("ARCHIVE_INTERVAL_MINUTES", 15)) * time.Minute,
+		EventGap:                 time.Duration(getEnvInt("EVENT_GAP_SECONDS", 60)) * time.Second,
+		Webhooks:                 webhookConfigs,
+		PublicURL:                getEnv("PUBLIC_URL", "http://localhost:"+port),
+		MQTT:                     mqttConfig,
+		Notifiers:                notifierConfigs,
+		Email:                    emailConfig,
+		SMTPReceiver:             loadSMTPReceiverConfig(),
+		FTPReceiver:              ftpReceiverConfig,
+		RemuxEngine:              remuxEngine,
+	}
+
+	// Retention defaults to ARCHIVE_RETENTION_DAYS and can be set per trigger and media type
+	retentionDays := getEnvInt("ARCHIVE_RETENTION_DAYS", 0)
+	config.ArchiveRetention = ArchiveRetention{
+		AlarmImages:    time.Duration(getEnvInt("ARCHIVE_RETENTION_ALARM_IMAGES_DAYS", retentionDays)) * 24 * time.Hour,
+		AlarmVideos:    time.Duration(getEnvInt("ARCHIVE_RETENTION_ALARM_VIDEOS_DAYS", retentionDays)) * 24 * time.Hour,
+		PeriodicImages: time.Duration(getEnvInt("ARCHIVE_RETENTION_PERIODIC_IMAGES_DAYS", retentionDays)) * 24 * time.Hour,
+		PeriodicVideos: time.Duration(getEnvInt("ARCHIVE_RETENTION_PERIODIC_VIDEOS_DAYS", retentionDays)) * 24 * time.Hour,
 	}
 
 	// Validate config to prevent panics/deadlocks
@@ -434,17 +594,52 @@ func main() {
 		log.Printf("Warning: BACKGROUND_CACHE_INTERVAL_MINUTES must be >= 1, using 1")
 		config.BackgroundCacheInterval = 1 * time.Minute
 	}
+	if config.ArchiveInterval < 1*time.Minute {
+		log.Printf("Warning: ARCHIVE_INTERVAL_MINUTES must be >= 1, using 1")
+		config.ArchiveInterval = 1 * time.Minute
+	}
 
-	// Initialize cache
-	var err error
-	mediaCache, err = NewMediaCache(config.CacheDir)
-	if err != nil {
-		log.Fatalf("Failed to initialize cache: %v", err)
+	// Initialize cameras, each with its own cache subdirectory
+	for _, cfg := range config.Cameras {
+		cam, err := NewCamera(cfg, config.CacheDir)
+		if err != nil {
+			log.Fatalf("Failed to initialize camera %s: %v", cfg.ID, err)
+		}
+		if config.ArchiveDir != "" {
+			cam.archive, err = NewArchive(filepath.Join(config.ArchiveDir, cam.ID), config.ArchiveRetention, cam.location)
+			if err != nil {
+				log.Fatalf("Failed to open archive for camera %s: %v", cfg.ID, err)
+			}
+		}
+		if config.SMTPReceiver.Addr != "" {
+			cam.inbox, err = NewInbox(cam, filepath.Join(cam.cache.dir, "inbox.json"), config.SMTPReceiver.Retention)
+			if err != nil {
+				log.Fatalf("Failed to open inbox for camera %s: %v", cfg.ID, err)
+			}
+		}
+		cam.annotations, err = NewAnnotations(filepath.Join(config.DataDir, cam.ID, "annotations.json"))
+		if err != nil {
+			log.Fatalf("Failed to load annotations for camera %s: %v", cfg.ID, err)
+		}
+		cameras = append(cameras, cam)
 	}
 	log.Printf("Cache directory: %s", config.CacheDir)
+	log.Printf("Data directory: %s", config.DataDir)
+	log.Printf("Remux engine: %s", config.RemuxEngine)
+	if config.RemuxEngine == RemuxEngineFFmpeg && !ffmpegInstalled() {
+		log.Printf("Warning: REMUX_ENGINE is ffmpeg, but ffmpeg isn't in the PATH; videos can't be converted")
+	}
 
 	http.HandleFunc("/api/config", handleGetConfig)
+	http.HandleFunc("/api/cameras", handleGetCameras)
 	http.HandleFunc("/api/media", handleGetMedia)
+	http.HandleFunc("/api/media/changes", handleGetMediaChanges)
+	http.HandleFunc("/api/annotations", handleAnnotations)
+	http.HandleFunc("/api/events", handleGetEvents)
+	http.HandleFunc("/api/events/stream", handleEventStream)
+	http.HandleFunc("/api/webhooks/deliveries", handleGetWebhookDeliveries)
+	http.HandleFunc("/api/notifications/test", handleTestNotification)
+	http.HandleFunc("/api/email/digest", handleSendDigest)
 	http.HandleFunc("/api/proxy", handleProxy)
 	http.HandleFunc("/api/video/", handleVideoProxy)
 
@@ -455,18 +650,84 @@ func main() {
 	}
 	http.Handle("/", http.FileServer(http.FS(staticFS)))
 
-	// Start background cacher if enabled
+	// Start background cacher if caching or polling is enabled
 	var backgroundCacher *BackgroundCacher
-	if config.BackgroundCacheEnabled {
-		backgroundCacher = NewBackgroundCacher(config.BackgroundCacheInterval, mediaCache)
+	if config.BackgroundCacheEnabled || config.ChangesPollInterval > 0 {
+		cacheInterval := config.BackgroundCacheInterval
+		if !config.BackgroundCacheEnabled {
+			cacheInterval = 0
+		}
+		backgroundCacher = NewBackgroundCacher(cacheInterval, config.ChangesPollInterval, cameras)
 		backgroundCacher.Start()
 	}
 
+	// Start archiver if enabled
+	var archiver *Archiver
+	if config.ArchiveDir != "" {
+		archiver = NewArchiver(config.ArchiveInterval, cameras)
+		archiver.Start()
+	}
+
+	// Start webhook dispatcher if any webhooks are configured
+	if len(config.Webhooks) > 0 {
+		webhookDispatcher = NewWebhookDispatcher(config.Webhooks, config.PublicURL)
+		webhookDispatcher.Start()
+	}
+
+	// Start MQTT publisher if a broker is configured
+	var mqttPublisher *MQTTPublisher
+	if config.MQTT.Broker != "" {
+		mqttPublisher = NewMQTTPublisher(config.MQTT, config.PublicURL, cameras)
+		mqttPublisher.Start()
+	}
+
+	// Start push notifications if any notifiers are configured
+	if len(config.Notifiers) > 0 {
+		notificationDispatcher = NewNotificationDispatcher(config.Notifiers, config.PublicURL)
+		notificationDispatcher.Start()
+	}
+
+	// Start email notifications if an SMTP server is configured
+	if config.Email.Host != "" {
+		emailNotifier = NewEmailNotifier(config.Email, config.PublicURL, cameras)
+		emailNotifier.Start()
+	}
+
+	// Start SMTP receiver if enabled
+	var smtpReceiver *SMTPReceiver
+	if config.SMTPReceiver.Addr != "" {
+		smtpReceiver = NewSMTPReceiver(config.SMTPReceiver, cameras)
+		if err := smtpReceiver.Start(); err != nil {
+			log.Fatalf("Failed to start SMTP receiver: %v", err)
+		}
+	}
+
+	// Start FTP receiver if enabled, for the cameras that upload to it
+	var ftpReceiver *FTPReceiver
+	var ftpCameras []*Camera
+	for _, cam := range cameras {
+		if cam.Source == SourceFTP {
+			ftpCameras = append(ftpCameras, cam)
+		}
+	}
+	if config.FTPReceiver.Addr != "" {
+		if len(ftpCameras) == 0 {
+			log.Fatalf("FTP_ADDR is set but no camera has CAMERA_SOURCE=ftp")
+		}
+		ftpReceiver = NewFTPReceiver(config.FTPReceiver, ftpCameras)
+		if err := ftpReceiver.Start(); err != nil {
+			log.Fatalf("Failed to start FTP receiver: %v", err)
+		}
+	} else if len(ftpCameras) > 0 {
+		log.Printf("Warning: cameras with CAMERA_SOURCE=ftp only show existing uploads, since FTP_ADDR is not set")
+	}
+
 	// Setup HTTP server
-	port := getEnv("PORT", "8080")
 	server := &http.Server{
 		Addr: ":" + port,
 	}
+	// Streaming responses would otherwise hold up shutdown until it times out
+	server.RegisterOnShutdown(changeFeed.Close)
 
 	// Handle graceful shutdown
 	shutdownCh := make(chan os.Signal, 1)
@@ -476,10 +737,31 @@ func main() {
 		<-shutdownCh
 		log.Println("Shutdown signal received, stopping gracefully...")
 
-		// Stop background cacher first
+		// Stop accepting alarm emails and uploads, then the background cacher
+		if smtpReceiver != nil {
+			smtpReceiver.Stop()
+		}
+		if ftpReceiver != nil {
+			ftpReceiver.Stop()
+		}
 		if backgroundCacher != nil {
 			backgroundCacher.Stop()
 		}
+		if archiver != nil {
+			archiver.Stop()
+		}
+		if webhookDispatcher != nil {
+			webhookDispatcher.Stop()
+		}
+		if mqttPublisher != nil {
+			mqttPublisher.Stop()
+		}
+		if notificationDispatcher != nil {
+			notificationDispatcher.Stop()
+		}
+		if emailNotifier != nil {
+			emailNotifier.Stop()
+		}
 
 		// Shutdown HTTP server with timeout
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -490,10 +772,24 @@ func main() {
 	}()
 
 	log.Printf("Starting server on http://localhost:%s", port)
-	log.Printf("Camera URL: %s", config.CameraURL)
+	for _, cam := range cameras {
+		log.Printf("Camera %s (%s): %s", cam.ID, cam.Name, cam.source.URL(""))
+	}
 	if config.BackgroundCacheEnabled {
 		log.Printf("Background caching enabled with interval %v", config.BackgroundCacheInterval)
 	}
+	if config.ArchiveDir != "" {
+		log.Printf("Archiving to %s with interval %v", config.ArchiveDir, config.ArchiveInterval)
+	}
+	for _, webhook := range config.Webhooks {
+		log.Printf("Webhook %s: %s (trigger %s, type %s)", webhook.ID, webhook.URL, webhook.Trigger, webhook.Type)
+	}
+	if config.Email.Host != "" {
+		log.Printf("Emailing %s via %s:%s (alerts %v, digest %v)", strings.Join(config.Email.To, ", "), config.Email.Host, config.Email.Port, config.Email.Alerts, config.Email.Digest)
+	}
+	for _, notifier := range config.Notifiers {
+		log.Printf("Notifier %s: %s at %s (trigger %s, type %s)", notifier.ID, notifier.Provider, notifier.URL, notifier.Trigger, notifier.Type)
+	}
 
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("HTTP server error: %v", err)
@@ -507,184 +803,705 @@ func handleGetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cam := cameraForRequest(w, r)
+	if cam == nil {
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{
-		"cameraName": config.CameraName,
+		"cameraId":   cam.ID,
+		"cameraName": cam.Name,
 	}); err != nil {
 		log.Printf("Error encoding config response: %v", err)
 	}
 }
 
+func handleGetCameras(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type cameraInfo struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		CameraStatus
+	}
+	infos := make([]cameraInfo, 0, len(cameras))
+	for _, cam := range cameras {
+		infos = append(infos, cameraInfo{ID: cam.ID, Name: cam.Name, CameraStatus: cam.status()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		log.Printf("Error encoding cameras response: %v", err)
+	}
+}
+
 func handleGetMedia(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	media, err := fetchAllMedia()
+	cam := cameraForRequest(w, r)
+	if cam == nil {
+		return
+	}
+
+	query, err := parseMediaQuery(r.URL.Query(), time.Now(), cam.location)
 	if err != nil {
-		log.Printf("Error fetching media: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to fetch media: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Prevent browser caching so that the media list is always fresh from the camera
+	items := cam.currentMedia(r.URL.Query().Get("refresh") == "true")
+	status := cam.status()
+	page := query.Apply(items)
+	if status.Offline {
+		cam.markAvailability(page.Items)
+	}
+
+	lastSynced := cam.catalog.LastSynced()
+
+	// The sync status and paging are also sent as headers, for clients of
+	// the plain array response
+	if !lastSynced.IsZero() {
+		w.Header().Set("X-Last-Synced", lastSynced.Format(time.RFC3339))
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	if status.Offline {
+		w.Header().Set("X-Camera-Offline", "true")
+	}
+
+	// Respond with just the items unless the full response object is asked for
+	var response any = page.Items
+	if page.Items == nil {
+		response = []MediaItem{}
+	}
+	if r.URL.Query().Get("envelope") == "true" {
+		response = MediaResponse{
+			Camera:       cam.ID,
+			CameraStatus: status,
+			LastSynced:   lastSynced,
+			Dates:        mediaDates(items),
+			Total:        page.Total,
+			Counts:       page.Counts,
+			NextCursor:   page.NextCursor,
+			Items:        page.Items,
+		}
+	}
+
+	// Prevent browser caching so that the media list always reflects the latest sync
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(media); err != nil {
+	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Error encoding media response: %v", err)
 	}
 }
 
-func handleProxy(w http.ResponseWriter, r *http.Request) {
-	targetURL := r.URL.Query().Get("url")
-	if targetURL == "" {
-		http.Error(w, "Missing url parameter", http.StatusBadRequest)
+func handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Ensure URL is for our camera
-	if !strings.HasPrefix(targetURL, config.CameraURL) {
-		http.Error(w, "Invalid URL", http.StatusBadRequest)
+	cam := cameraForRequest(w, r)
+	if cam == nil {
 		return
 	}
 
-	// Determine file extension for cache key
-	ext := filepath.Ext(targetURL)
-	if ext == "" {
-		ext = ".bin" // fallback for files without extension
+	query, err := parseMediaQuery(r.URL.Query(), time.Now(), cam.location)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	// Try to get from cache, or fetch if not cached
-	cachedPath, err := mediaCache.Get(targetURL, ext, func() ([]byte, error) {
-		return fetchFromCamera(targetURL)
-	})
-
+	gap, err := parseEventGap(r.URL.Query().Get("gap"), config.EventGap)
 	if err != nil {
-		log.Printf("Cache error for %s: %v", targetURL, err)
-		http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Serve the cached file
-	http.ServeFile(w, r, cachedPath)
-}
+	items := cam.currentMedia(r.URL.Query().Get("refresh") == "true")
+	status := cam.status()
+	page := query.ApplyEvents(groupEvents(cam, items, gap))
+	if status.Offline {
+		for i := range page.Events {
+			cam.markAvailability(page.Events[i].Items)
+		}
+	}
 
-// fetchFromCamera downloads a file from the camera
-func fetchFromCamera(targetURL string) ([]byte, error) {
-	// Acquire semaphore to limit concurrent camera requests
-	mediaCache.cameraSem <- struct{}{}
-	defer func() { <-mediaCache.cameraSem }()
+	response := EventsResponse{
+		Camera:       cam.ID,
+		CameraStatus: status,
+		LastSynced:   cam.catalog.LastSynced(),
+		Dates:        mediaDates(items),
+		Total:        page.Total,
+		NextCursor:   page.NextCursor,
+		Events:       page.Events,
+	}
 
-	req, err := http.NewRequest("GET", targetURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding events response: %v", err)
 	}
+}
 
-	req.Header.Set("Authorization", "Basic "+basicAuth(config.Username, config.Password))
+// changesCamera resolves the optional camera filter of the change feed
+// endpoints, which cover every camera when it's omitted. On failure an error
+// response is written and ok is false.
+func changesCamera(w http.ResponseWriter, r *http.Request) (cam *Camera, ok bool) {
+	id := r.URL.Query().Get("camera")
+	if id == "" {
+		return nil, true
+	}
+	cam = lookupCamera(id)
+	if cam == nil {
+		http.Error(w, "Unknown camera", http.StatusNotFound)
+		return nil, false
+	}
+	return cam, true
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch from camera: %w", err)
+func handleGetMediaChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("camera returned status %d", resp.StatusCode)
+	cam, ok := changesCamera(w, r)
+	if !ok {
+		return
 	}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+	// Without since, just return the cursor to start following the feed from
+	response := MediaChangesResponse{Cursor: changeFeed.Cursor(), Changes: []MediaChange{}}
+	if since := r.URL.Query().Get("since"); since != "" {
+		changes, next, complete := changeFeed.Since(since)
+		response.Cursor = next
+		response.Reset = !complete
+		for _, change := range changes {
+			if cam == nil || change.Camera == cam.ID {
+				response.Changes = append(response.Changes, change)
+			}
+		}
 	}
 
-	return data, nil
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding changes response: %v", err)
+	}
 }
 
-func handleVideoProxy(w http.ResponseWriter, r *http.Request) {
-	// Extract the video path from the URL
-	// URL format: /api/video/{encoded-path}.mp4
-	path := strings.TrimPrefix(r.URL.Path, "/api/video/")
-	path = strings.TrimSuffix(path, ".mp4")
+// AnnotatedPath is an annotation along with the camera path it belongs to
+type AnnotatedPath struct {
+	Path string `json:"path"`
+	Annotation
+}
 
-	// Decode the path
-	decodedPath, err := url.QueryUnescape(path)
-	if err != nil {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+// AnnotationsResponse is the response body of GET /api/annotations
+type AnnotationsResponse struct {
+	Camera      string          `json:"camera"`
+	Tags        []TagCount      `json:"tags"` // every tag in use, regardless of filters
+	Annotations []AnnotatedPath `json:"annotations"`
+}
+
+// handleAnnotations lists a camera's annotations, or with a path, gets (GET),
+// replaces (PUT) or deletes (DELETE) the annotation of one media item
+func handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	cam := cameraForRequest(w, r)
+	if cam == nil {
+		return
+	}
+	mediaPath := r.URL.Query().Get("path")
+	if mediaPath == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Missing path", http.StatusBadRequest)
+			return
+		}
+		listAnnotations(w, r, cam)
 		return
 	}
 
-	// Build the camera URL
-	targetURL := config.CameraURL + "/" + decodedPath
+	switch r.Method {
+	case http.MethodGet:
+		annotation, ok := cam.annotations.Get(mediaPath)
+		if !ok {
+			http.Error(w, "No annotation for this path", http.StatusNotFound)
+			return
+		}
+		writeAnnotation(w, mediaPath, annotation)
+	case http.MethodPut:
+		var annotation Annotation
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&annotation); err != nil {
+			http.Error(w, "Invalid annotation: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		annotation, err := annotation.normalized()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !cam.hasMedia(mediaPath) {
+			http.Error(w, "Unknown media path", http.StatusNotFound)
+			return
+		}
+		saved, err := cam.annotations.Set(mediaPath, annotation)
+		if err != nil {
+			log.Printf("Error saving annotations for %s: %v", cam.ID, err)
+			http.Error(w, "Failed to save annotation", http.StatusInternalServerError)
+			return
+		}
+		writeAnnotation(w, mediaPath, saved)
+	case http.MethodDelete:
+		found, err := cam.annotations.Delete(mediaPath)
+		if err != nil {
+			log.Printf("Error saving annotations for %s: %v", cam.ID, err)
+			http.Error(w, "Failed to delete annotation", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "No annotation for this path", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-	// Ensure URL is for our camera
-	if !strings.HasPrefix(targetURL, config.CameraURL) {
-		http.Error(w, "Invalid URL", http.StatusBadRequest)
-		return
+// listAnnotations writes a camera's annotations ordered by path, filtered by
+// the tag and favorite query parameters
+func listAnnotations(w http.ResponseWriter, r *http.Request, cam *Camera) {
+	query := &MediaQuery{
+		Tags:     parseTagParams(r.URL.Query()),
+		Favorite: r.URL.Query().Get("favorite") == "true",
 	}
 
-	// Try to get converted video from cache, or convert if not cached
-	cachedPath, err := mediaCache.GetWithFile(targetURL, ".mp4", func(destPath string) error {
-		return convertVideoToMP4(targetURL, destPath)
+	response := AnnotationsResponse{
+		Camera:      cam.ID,
+		Tags:        cam.annotations.Tags(),
+		Annotations: []AnnotatedPath{},
+	}
+	for p, annotation := range cam.annotations.All() {
+		if query.matchesAnnotation(MediaItem{Tags: annotation.Tags, Favorite: annotation.Favorite}) {
+			response.Annotations = append(response.Annotations, AnnotatedPath{Path: p, Annotation: annotation})
+		}
+	}
+	sort.Slice(response.Annotations, func(i, j int) bool {
+		return response.Annotations[i].Path < response.Annotations[j].Path
 	})
 
-	if err != nil {
-		log.Printf("Video conversion error for %s: %v", targetURL, err)
-		http.Error(w, "Failed to convert video", http.StatusInternalServerError)
-		return
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding annotations response: %v", err)
 	}
+}
 
-	// Serve the cached converted video
-	http.ServeFile(w, r, cachedPath)
+func writeAnnotation(w http.ResponseWriter, mediaPath string, annotation Annotation) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(AnnotatedPath{Path: mediaPath, Annotation: annotation}); err != nil {
+		log.Printf("Error encoding annotation: %v", err)
+	}
 }
 
-// stripHXVSHeaders removes HXVS/HXVF 16-byte headers from raw H.264/H.265 stream
-// These proprietary headers prevent the video from playing in most video players
-func stripHXVSHeaders(data []byte) []byte {
-	out := make([]byte, 0, len(data))
-	i := 0
-	removed := 0
-	length := len(data)
-
-	for i < length {
-		// Check for HXVS or HXVF header (4 bytes + 12 more = 16 bytes total)
-		if i+16 <= length {
-			header := data[i : i+4]
-			if string(header) == "HXVS" || string(header) == "HXVF" {
-				// Skip the 16-byte header
-				i += 16
-				removed += 16
-				continue
-			}
-		}
-		out = append(out, data[i])
-		i++
+func handleGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	if removed > 0 {
-		log.Printf("Stripped %d bytes of HXVS/HXVF headers from video", removed)
+	deliveries := []WebhookDelivery{}
+	if webhookDispatcher != nil {
+		deliveries = webhookDispatcher.Deliveries(r.URL.Query().Get("webhook"))
 	}
 
-	return out
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		log.Printf("Error encoding webhook deliveries: %v", err)
+	}
 }
 
-// detectFPS tries to detect the frame rate from a video file using ffprobe
-// Returns the detected FPS or 0 if detection fails
-func detectFPS(path string) int {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-select_streams", "v:0",
-		"-show_entries", "stream=r_frame_rate,avg_frame_rate",
-		"-of", "default=nk=1:nw=1",
-		path,
-	)
+func handleTestNotification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if notificationDispatcher == nil {
+		http.Error(w, "No notifiers configured", http.StatusNotFound)
+		return
+	}
 
-	output, err := cmd.Output()
+	cam := cameraForRequest(w, r)
+	if cam == nil {
+		return
+	}
+	results, err := notificationDispatcher.SendTest(r.URL.Query().Get("notifier"), cam)
 	if err != nil {
-		return 0
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if !result.Sent {
+			status = http.StatusBadGateway
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("Error encoding notification results: %v", err)
+	}
+}
+
+func handleSendDigest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if emailNotifier == nil {
+		http.Error(w, "Email is not configured", http.StatusNotFound)
+		return
+	}
+
+	// The day is a calendar date on the camera's clock, defaulting to
+	// yesterday as for the scheduled digest
+	cam := cameraForRequest(w, r)
+	if cam == nil {
+		return
+	}
+	day := time.Now().In(cam.location).AddDate(0, 0, -1)
+	if value := r.URL.Query().Get("date"); value != "" {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", value, cam.location)
+		if err != nil {
+			http.Error(w, "Invalid date (expected YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, err := emailNotifier.SendDigest(day)
+	if err != nil {
+		log.Printf("Error sending digest: %v", err)
+		http.Error(w, "Failed to send digest: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"date": day.Format("2006-01-02"), "events": events}); err != nil {
+		log.Printf("Error encoding digest response: %v", err)
+	}
+}
+
+// sseKeepaliveInterval is how often an idle event stream sends a comment to
+// keep proxies from closing the connection
+const sseKeepaliveInterval = 30 * time.Second
+
+func handleEventStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cam, ok := changesCamera(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Browsers resume from the last event ID when they reconnect
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("since")
+	}
+	sub, err := changeFeed.Subscribe(cursor)
+	if err != nil {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable buffering in nginx
+
+	writeEvent := func(id, event string, data any) bool {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("Error encoding stream event: %v", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, payload); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	// Start with "ready", or "reset" if changes since the client's cursor
+	// were missed and it should reload the media list. The ID stays at the
+	// client's cursor until the backlog has been sent.
+	initial, id := "ready", sub.Cursor
+	if !sub.Complete {
+		initial = "reset"
+	} else if cursor != "" {
+		id = cursor
+	}
+	if !writeEvent(id, initial, map[string]string{"cursor": id}) {
+		return
+	}
+	for _, change := range sub.Backlog {
+		if cam == nil || change.Camera == cam.ID {
+			if !writeEvent(change.Cursor, change.Type, change) {
+				return
+			}
+		}
+	}
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case change, ok := <-sub.Changes:
+			if !ok {
+				// Fell behind or shutting down; the client reconnects and
+				// catches up from its last event ID
+				return
+			}
+			if cam == nil || change.Camera == cam.ID {
+				if !writeEvent(change.Cursor, change.Type, change) {
+					return
+				}
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func handleProxy(w http.ResponseWriter, r *http.Request) {
+	targetURL := r.URL.Query().Get("url")
+	if targetURL == "" {
+		http.Error(w, "Missing url parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Older links carry no camera parameter, so find the camera by URL
+	var cam *Camera
+	if r.URL.Query().Get("camera") == "" {
+		for _, c := range cameras {
+			if _, ok := sourcePath(c.source, targetURL); ok {
+				cam = c
+				break
+			}
+		}
+	} else {
+		cam = cameraForRequest(w, r)
+		if cam == nil {
+			return
+		}
+	}
+
+	// Ensure URL is for our camera
+	if cam == nil {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	// Emailed snapshots only exist in the cache
+	if strings.HasPrefix(targetURL, inboxURLPrefix) {
+		ext := proxyCacheSuffix(targetURL)
+		if cam.inbox == nil || !cam.cache.Has(targetURL, ext) {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, cam.cache.getCachePath(targetURL, ext))
+		return
+	}
+	mediaPath, ok := sourcePath(cam.source, targetURL)
+	if !ok {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	ext := proxyCacheSuffix(targetURL)
+	if !cam.cache.Has(targetURL, ext) {
+		if archivedPath, ok := cam.archivedFile(mediaPath); ok {
+			http.ServeFile(w, r, archivedPath)
+			return
+		}
+	}
+	if cam.status().Offline && !cam.cache.Has(targetURL, ext) {
+		http.Error(w, "Camera is offline", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Try to get from cache, or fetch if not cached
+	cachedPath, err := cam.cache.Get(targetURL, ext, func() ([]byte, error) {
+		return cam.fetchFromCamera(targetURL)
+	})
+
+	if err != nil {
+		log.Printf("Cache error for %s: %v", targetURL, err)
+		http.Error(w, "Failed to fetch media", http.StatusInternalServerError)
+		return
+	}
+
+	// Serve the cached file
+	http.ServeFile(w, r, cachedPath)
+}
+
+// proxyCacheSuffix returns the cache key suffix for a file served by /api/proxy
+func proxyCacheSuffix(targetURL string) string {
+	// Determine file extension for cache key
+	ext := filepath.Ext(targetURL)
+	if ext == "" {
+		ext = ".bin" // fallback for files without extension
+	}
+	return ext
+}
+
+// fetchFromCamera downloads a file from the camera's media source
+func (cam *Camera) fetchFromCamera(targetURL string) ([]byte, error) {
+	body, err := cam.openFromCamera(targetURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return data, nil
+}
+
+// openFromCamera opens a file from the camera's media source for streaming.
+// The file counts against the concurrent camera requests until it's closed.
+func (cam *Camera) openFromCamera(targetURL string) (io.ReadCloser, error) {
+	path, ok := sourcePath(cam.source, targetURL)
+	if !ok {
+		return nil, fmt.Errorf("URL %s does not belong to camera %s", targetURL, cam.ID)
+	}
+
+	// Acquire semaphore to limit concurrent camera requests
+	cam.cache.cameraSem <- struct{}{}
+
+	body, err := cam.source.Open(path)
+	if err != nil {
+		<-cam.cache.cameraSem
+		return nil, err
+	}
+	return &cameraBody{ReadCloser: body, sem: cam.cache.cameraSem}, nil
+}
+
+// cameraBody releases its camera request slot when closed
+type cameraBody struct {
+	io.ReadCloser
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (b *cameraBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { <-b.sem })
+	return err
+}
+
+func handleVideoProxy(w http.ResponseWriter, r *http.Request) {
+	cam := cameraForRequest(w, r)
+	if cam == nil {
+		return
+	}
+
+	// Extract the video path from the URL
+	// URL format: /api/video/{encoded-path}.mp4
+	path := strings.TrimPrefix(r.URL.Path, "/api/video/")
+	path = strings.TrimSuffix(path, ".mp4")
+
+	// Decode the path
+	decodedPath, err := url.QueryUnescape(path)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	// Build the camera URL
+	targetURL := cam.source.URL(decodedPath)
+
+	// Ensure URL is for our camera
+	if _, ok := sourcePath(cam.source, targetURL); !ok {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+
+	if !cam.cache.Has(targetURL, ".mp4") {
+		if archivedPath, ok := cam.archivedFile(decodedPath); ok {
+			http.ServeFile(w, r, archivedPath)
+			return
+		}
+	}
+	if cam.status().Offline && !cam.cache.Has(targetURL, ".mp4") {
+		http.Error(w, "Camera is offline", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Try to get converted video from cache, or convert if not cached
+	cachedPath, err := cam.cache.GetWithFile(targetURL, ".mp4", func(destPath string) error {
+		return cam.convertVideoToMP4(targetURL, destPath)
+	})
+
+	if err != nil {
+		log.Printf("Video conversion error for %s: %v", targetURL, err)
+		http.Error(w, "Failed to convert video", http.StatusInternalServerError)
+		return
+	}
+
+	// Serve the cached converted video
+	if timing, ok := cam.cache.loadVideoTiming(targetURL); ok {
+		setVideoTimingHeaders(w, timing)
+	}
+	http.ServeFile(w, r, cachedPath)
+}
+
+// detectFPS tries to detect the frame rate from a video file using ffprobe
+// Returns the detected FPS or 0 if detection fails
+func detectFPS(path string) int {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=r_frame_rate,avg_frame_rate",
+		"-of", "default=nk=1:nw=1",
+		path,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0
 	}
 
 	// Parse frame rate from output (format: "num/den" or "fps")
@@ -723,64 +1540,107 @@ func parseFloat(s string) float64 {
 	return f
 }
 
-// convertVideoToMP4 downloads a raw video from camera and converts it to MP4
-func convertVideoToMP4(sourceURL string, destPath string) error {
-	// Download raw video from camera
-	rawData, err := fetchFromCamera(sourceURL)
+// convertVideoToMP4 downloads a raw video from camera and converts it to MP4.
+// The recording is demuxed into temp files as it downloads and then streamed
+// to the remuxer, so memory use doesn't grow with the length of the clip.
+func (cam *Camera) convertVideoToMP4(sourceURL string, destPath string) error {
+	// Download the video, separating it from the HXVS headers and audio frames mixed into it
+	clip, err := cam.spoolRecording(sourceURL)
 	if err != nil {
-		return fmt.Errorf("failed to fetch video: %w", err)
-	}
-
-	// Strip HXVS/HXVF headers that prevent playback in most video players
-	cleanedData := stripHXVSHeaders(rawData)
-
-	// Determine input format based on file extension
-	inputFormat := "h264"
-	if strings.HasSuffix(sourceURL, ".265") {
-		inputFormat = "hevc"
-	}
-
-	// Create temporary file for cleaned video
-	tempFile, err := os.CreateTemp("", "clean-video-*."+inputFormat)
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	defer func() {
-		_ = os.Remove(tempFile.Name())
-	}()
-	defer tempFile.Close()
-
-	// Write cleaned video to temp file
-	if _, err := tempFile.Write(cleanedData); err != nil {
-		return fmt.Errorf("failed to write cleaned video: %w", err)
+		return err
+	}
+	defer clip.Close()
+
+	// Time the frames from the recording itself where possible. Per-frame
+	// timestamps are kept by wrapping the video in a transport stream.
+	timing, timed := cam.frameTiming(sourceURL, clip.hxvs)
+
+	// The built-in muxer can't convert the audio, so recordings with audio
+	// go to ffmpeg if it's installed
+	native := config.RemuxEngine == RemuxEngineNative
+	if native && clip.audio != nil && ffmpegInstalled() {
+		log.Printf("Converting %s with ffmpeg to keep its audio", sourceURL)
+		native = false
+	}
+	if native {
+		nativeTiming, err := cam.remuxNative(sourceURL, destPath, clip, timing, timed)
+		if err == nil {
+			log.Printf("Remuxed %s natively, timing: %s", sourceURL, nativeTiming)
+			if clip.audio != nil {
+				log.Printf("Left the audio out of %s, as native remuxing can't convert it and ffmpeg isn't installed", sourceURL)
+			}
+			if err := cam.cache.saveVideoTiming(sourceURL, nativeTiming); err != nil {
+				log.Printf("Failed to save timing for %s: %v", sourceURL, err)
+			}
+			return nil
+		}
+		if !ffmpegInstalled() {
+			return fmt.Errorf("native remux failed: %w", err)
+		}
+		log.Printf("Native remux of %s failed, falling back to ffmpeg: %v", sourceURL, err)
 	}
-	if err := tempFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temp file: %w", err)
+	if err := clip.rewindVideo(); err != nil {
+		return err
 	}
 
-	// Detect frame rate from the cleaned video
-	fps := detectFPS(tempFile.Name())
-	if fps == 0 {
-		fps = 20 // Default fallback
-		log.Printf("Could not detect FPS for %s, defaulting to 20", sourceURL)
+	// The spooled video is piped to ffmpeg's stdin
+	var args []string
+	if timing.times != nil {
+		args = []string{
+			"-y",           // Overwrite output file without asking
+			"-f", "mpegts", // Timestamped video
+			"-i", "pipe:0", // Input from stdin
+		}
 	} else {
-		log.Printf("Detected FPS for %s: %d", sourceURL, fps)
+		// Fall back to detecting frame rate from the spooled video
+		if !timed {
+			timing = timingFromProbe(clip.video.Name())
+		}
+		args = []string{
+			"-y",                 // Overwrite output file without asking
+			"-fflags", "+genpts", // Generate presentation timestamps
+			"-f", clip.codec, // Raw video stream
+			"-framerate", timing.rate, // Set input framerate
+			"-i", "pipe:0", // Input from stdin
+		}
 	}
+	log.Printf("Timing for %s: %s", sourceURL, timing)
 
-	// Convert to MP4 using ffmpeg with proper framerate
-	cmd := exec.Command("ffmpeg",
-		"-y",                       // Overwrite output file without asking
-		"-fflags", "+genpts",       // Generate presentation timestamps
-		"-framerate", fmt.Sprintf("%d", fps), // Set input framerate
-		"-i", tempFile.Name(),      // Input file
-		"-c:v", "copy",             // Copy video codec (no re-encoding)
-		"-c:a", "copy",             // Copy audio codec (preserve audio if present)
-		"-movflags", "+faststart",  // Put moov atom at start for better compatibility
-		destPath,                   // Output file
+	if clip.audio != nil {
+		// Browsers can't play G.711 from MP4, so it's transcoded to AAC
+		args = append(args,
+			"-f", cam.AudioFormat, "-ar", fmt.Sprint(g711SampleRate), "-ac", "1", // Raw G.711 audio
+		)
+		if timing.audioOffset > 0 {
+			// Audio started after the first video frame
+			args = append(args, "-itsoffset", fmt.Sprintf("%.3f", float64(timing.audioOffset)/1000))
+		}
+		args = append(args,
+			"-i", clip.audio.Name(),
+			"-map", "0:v:0", "-map", "1:a:0",
+			"-c:a", "aac", "-b:a", "32k",
+		)
+	}
+	args = append(args,
+		"-c:v", "copy", // Copy video codec (no re-encoding)
+		"-movflags", "+faststart", // Put moov atom at start for better compatibility
+		destPath, // Output file
 	)
 
-	// Run ffmpeg and capture errors
-	errOutput, err := cmd.CombinedOutput()
+	// Convert to MP4 using ffmpeg with proper framerate
+	cmd := exec.Command("ffmpeg", args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	// Run ffmpeg, feeding it the video, and capture errors
+	if timing.times != nil {
+		err = clip.pipeTimedVideo(cmd, timing.times)
+	} else {
+		cmd.Stdin = clip.video
+		err = cmd.Run()
+	}
+	errOutput := output.Bytes()
 	if err != nil {
 		return fmt.Errorf("ffmpeg failed: %v, output: %s", err, string(errOutput))
 	}
@@ -788,41 +1648,106 @@ func convertVideoToMP4(sourceURL string, destPath string) error {
 		log.Printf("ffmpeg output for %s: %s", sourceURL, string(errOutput))
 	}
 
+	if err := cam.cache.saveVideoTiming(sourceURL, timing); err != nil {
+		log.Printf("Failed to save timing for %s: %v", sourceURL, err)
+	}
 	return nil
 }
 
-func fetchAllMedia() ([]MediaItem, error) {
-	var allMedia []MediaItem
-
-	// Fetch root directory
-	dates, err := fetchDirectory("")
+// syncCatalog brings the camera's catalog up to date and starts converting
+// any newly found videos in the background for instant playback
+func (cam *Camera) syncCatalog() (*CatalogChanges, error) {
+	changes, err := cam.catalog.Sync(cam)
+	cam.setReachable(err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch root directory: %w", err)
+		return nil, err
 	}
+	cam.catalogSynced(changes)
+	return changes, nil
+}
 
-	// Iterate through date directories
-	for _, date := range dates {
-		if !date.IsDirectory {
-			continue
+// syncCatalogAsync is like syncCatalog but runs in the background, and is
+// skipped if the catalog was synced recently
+func (cam *Camera) syncCatalogAsync() {
+	cam.catalog.SyncAsync(cam, func(changes *CatalogChanges, err error) {
+		cam.setReachable(err)
+		if err == nil {
+			cam.catalogSynced(changes)
 		}
+	})
+}
 
-		dateMedia, err := fetchDateMedia(date.Name)
-		if err != nil {
-			log.Printf("Warning: failed to fetch media for %s: %v", date.Name, err)
-			continue
+// catalogSynced publishes the changes found by a successful catalog sync
+// and starts converting new videos
+func (cam *Camera) catalogSynced(changes *CatalogChanges) {
+	// Emailed snapshots give way to the same alarm's media from the SD card
+	if cam.inbox != nil {
+		if matched := cam.inbox.Reconcile(changes.Added); len(matched) > 0 {
+			changeFeed.Publish(cam, &CatalogChanges{Removed: matched})
 		}
+	}
+	changeFeed.Publish(cam, changes)
+	go preCacheVideos(cam, changes.Added)
+}
 
-		allMedia = append(allMedia, dateMedia...)
+// currentMedia returns the camera's cataloged and archived media, with their annotations. The first
+// request for a camera has to wait for the initial crawl, as does an explicit
+// refresh. Otherwise it answers from the catalog right away and brings it up
+// to date in the background.
+func (cam *Camera) currentMedia(refresh bool) []MediaItem {
+	if cam.catalog.LastSynced().IsZero() || refresh {
+		if _, err := cam.syncCatalog(); err != nil {
+			// Fall back to the last known media; responses report the camera as offline
+			log.Printf("Error syncing catalog for %s: %v", cam.ID, err)
+		}
+	} else {
+		cam.syncCatalogAsync()
 	}
 
-	// Pre-cache videos in the background for instant playback
-	go preCacheVideos(allMedia)
+	items := cam.knownMedia()
+	cam.annotations.Apply(items)
+	return items
+}
 
-	return allMedia, nil
+// knownMedia returns the media in the catalog as of the last sync, with
+// archived media and pending emailed snapshots, without syncing
+func (cam *Camera) knownMedia() []MediaItem {
+	items := cam.catalog.Items()
+	if cam.archive != nil {
+		items = cam.archive.Merge(items)
+	}
+	if cam.inbox != nil {
+		items = append(items, cam.inbox.Pending()...)
+	}
+	return items
+}
+
+// hasMedia reports whether a path is among the camera's known media. It
+// doesn't sync, so checking a path never costs a request to the camera.
+func (cam *Camera) hasMedia(mediaPath string) bool {
+	for _, item := range cam.knownMedia() {
+		if item.Path == mediaPath {
+			return true
+		}
+	}
+	return false
+}
+
+// markAvailability sets the availability of items while the camera is
+// offline, when only media that's already cached can be served
+func (cam *Camera) markAvailability(items []MediaItem) {
+	for i := range items {
+		if cam.isCached(items[i]) {
+			items[i].Availability = AvailabilityCached
+		} else {
+			items[i].Availability = AvailabilityUnavailable
+		}
+		cam.markAvailability(items[i].Frames)
+	}
 }
 
 // preCacheVideos pre-converts videos to MP4 in the background (fire-and-forget)
-func preCacheVideos(media []MediaItem) {
+func preCacheVideos(cam *Camera, media []MediaItem) {
 	// Create a semaphore to limit concurrent video conversions
 	sem := make(chan struct{}, config.MaxConcurrentConversions)
 
@@ -836,8 +1761,8 @@ func preCacheVideos(media []MediaItem) {
 			defer func() { <-sem }() // Release
 
 			// Try to get/create cached MP4 - this will trigger conversion if not cached
-			_, err := mediaCache.GetWithFile(videoURL, ".mp4", func(destPath string) error {
-				return convertVideoToMP4(videoURL, destPath)
+			_, err := cam.cache.GetWithFile(videoURL, ".mp4", func(destPath string) error {
+				return cam.convertVideoToMP4(videoURL, destPath)
 			})
 			if err != nil {
 				log.Printf("Pre-cache failed for %s: %v", videoURL, err)
@@ -847,7 +1772,7 @@ func preCacheVideos(media []MediaItem) {
 }
 
 // preCacheVideosSync pre-converts videos to MP4 and waits for all to complete
-func preCacheVideosSync(media []MediaItem) {
+func preCacheVideosSync(cam *Camera, media []MediaItem) {
 	// Create a semaphore to limit concurrent video conversions
 	sem := make(chan struct{}, config.MaxConcurrentConversions)
 	var wg sync.WaitGroup
@@ -864,8 +1789,8 @@ func preCacheVideosSync(media []MediaItem) {
 			defer func() { <-sem }() // Release
 
 			// Try to get/create cached MP4 - this will trigger conversion if not cached
-			_, err := mediaCache.GetWithFile(videoURL, ".mp4", func(destPath string) error {
-				return convertVideoToMP4(videoURL, destPath)
+			_, err := cam.cache.GetWithFile(videoURL, ".mp4", func(destPath string) error {
+				return cam.convertVideoToMP4(videoURL, destPath)
 			})
 			if err != nil {
 				log.Printf("Pre-cache failed for %s: %v", videoURL, err)
@@ -878,69 +1803,41 @@ func preCacheVideosSync(media []MediaItem) {
 
 // matchVideoThumbnails finds and assigns thumbnail images to videos
 // Prefers images taken during the video, falls back to 1 second before
-func matchVideoThumbnails(media []MediaItem) {
-	// Build index of images by timestamp
-	images := make(map[string]*MediaItem)
+func (cam *Camera) matchVideoThumbnails(media []MediaItem) {
+	var images []*MediaItem
 	for i := range media {
-		if media[i].Type == "image" {
-			images[media[i].Timestamp] = &media[i]
+		if media[i].Type == "image" && media[i].Start != nil {
+			images = append(images, &media[i])
 		}
 	}
+	// Frames taken in the same second are ordered by their sequence number,
+	// so the first matching image is always the same one
+	sort.SliceStable(images, func(i, j int) bool {
+		return frameBefore(*images[i], *images[j])
+	})
 
 	// Match each video with the best thumbnail
 	for i := range media {
-		if media[i].Type != "video" {
-			continue
-		}
-
-		// Parse video timestamp range "2025-11-21 21:23:56 - 21:24:10"
-		parts := strings.Split(media[i].Timestamp, " - ")
-		if len(parts) != 2 {
-			continue
-		}
-
-		startTime := strings.TrimSpace(parts[0])
-		endTime := strings.TrimSpace(parts[1])
-
-		// Parse times to compare
-		startParsed, err := time.Parse("2006-01-02 15:04:05", startTime)
-		if err != nil {
-			continue
-		}
-
-		// For end time, we may need to prepend the date
-		var endParsed time.Time
-		if strings.Contains(endTime, "-") {
-			// Full timestamp
-			endParsed, err = time.Parse("2006-01-02 15:04:05", endTime)
-		} else {
-			// Time only, use same date as start
-			endParsed, err = time.Parse("2006-01-02 15:04:05", startTime[:11]+endTime)
-		}
-		if err != nil {
+		if media[i].Type != "video" || media[i].Start == nil || media[i].End == nil {
 			continue
 		}
+		start, end := *media[i].Start, *media[i].End
 
 		var bestMatch *MediaItem
 		var duringVideo *MediaItem
 		var beforeVideo *MediaItem
 
-		// Look for matching images
+		// Look for matching images; the earliest frame wins
 		for _, img := range images {
-			imgParsed, err := time.Parse("2006-01-02 15:04:05", img.Timestamp)
-			if err != nil {
-				continue
-			}
+			imgTime := *img.Start
 
 			// Check if image is during video (preferred)
-			if (imgParsed.Equal(startParsed) || imgParsed.After(startParsed)) && imgParsed.Before(endParsed) {
-				if duringVideo == nil || imgParsed.Before(mustParseTime(duringVideo.Timestamp)) {
-					duringVideo = img
-				}
+			if duringVideo == nil && !imgTime.Before(start) && imgTime.Before(end) {
+				duringVideo = img
 			}
 
 			// Check if image is 1 second before video start (fallback)
-			if imgParsed.Equal(startParsed.Add(-1 * time.Second)) {
+			if beforeVideo == nil && imgTime.Equal(start.Add(-1*time.Second)) {
 				beforeVideo = img
 			}
 		}
@@ -954,196 +1851,38 @@ func matchVideoThumbnails(media []MediaItem) {
 
 		// Set thumbnail URL if we found a match
 		if bestMatch != nil {
-			media[i].ThumbnailURL = "/api/proxy?url=" + url.QueryEscape(bestMatch.URL)
+			media[i].ThumbnailURL = cam.proxyURL(bestMatch.URL)
 		}
 	}
 }
 
-// mustParseTime parses a time or panics (for use in comparisons where we know format is valid)
-func mustParseTime(s string) time.Time {
-	t, err := time.Parse("2006-01-02 15:04:05", s)
-	if err != nil {
-		return time.Time{}
-	}
-	return t
-}
-
-func fetchDateMedia(datePath string) ([]MediaItem, error) {
+func (cam *Camera) fetchDateMedia(datePath string) ([]MediaItem, error) {
 	var media []MediaItem
 
-	entries, err := fetchDirectory(datePath)
+	entries, err := cam.source.ListMedia(datePath)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, entry := range entries {
-		if !entry.IsDirectory {
-			continue
-		}
-
-		dirName := strings.TrimSuffix(entry.Name, "/")
-
-		if dirName == "images000" {
-			images, err := fetchDirectory(entry.Path)
-			if err != nil {
-				log.Printf("Warning: failed to fetch images from %s: %v", entry.Path, err)
-				continue
-			}
-
-			for _, img := range images {
-				if strings.HasSuffix(img.Name, ".jpg") {
-					media = append(media, parseMedia(img, datePath, "image"))
-				}
-			}
-		} else if dirName == "record000" {
-			videos, err := fetchDirectory(entry.Path)
-			if err != nil {
-				log.Printf("Warning: failed to fetch videos from %s: %v", entry.Path, err)
-				continue
-			}
-
-			for _, vid := range videos {
-				if strings.HasSuffix(vid.Name, ".264") || strings.HasSuffix(vid.Name, ".265") {
-					media = append(media, parseMedia(vid, datePath, "video"))
-				}
-			}
+		if mediaType := mediaTypeForName(entry.Name); mediaType != "" {
+			media = append(media, cam.parseMedia(entry, datePath, mediaType))
 		}
 	}
 
+	// Settle which side of a DST fall-back each repeated wall-clock time is on
+	resolveFallBack(media)
+
 	// Match videos with their thumbnail images
-	matchVideoThumbnails(media)
+	cam.matchVideoThumbnails(media)
 
 	return media, nil
 }
 
-func fetchDirectory(path string) ([]DirectoryEntry, error) {
-	url := config.CameraURL + "/" + path
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Authorization", "Basic "+basicAuth(config.Username, config.Password))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	return parseDirectory(string(body), path), nil
-}
-
-func parseDirectory(htmlContent string, basePath string) []DirectoryEntry {
-	var entries []DirectoryEntry
-
-	doc, err := html.Parse(strings.NewReader(htmlContent))
-	if err != nil {
-		log.Printf("Error parsing HTML: %v", err)
-		return entries
-	}
-
-	var traverse func(*html.Node)
-	traverse = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "tr" {
-			entry := parseTableRow(n, basePath)
-			if entry != nil {
-				entries = append(entries, *entry)
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			traverse(c)
-		}
-	}
-
-	traverse(doc)
-	return entries
-}
-
-func parseTableRow(tr *html.Node, basePath string) *DirectoryEntry {
-	var cells []*html.Node
-
-	for c := tr.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode && c.Data == "td" {
-			cells = append(cells, c)
-		}
-	}
-
-	if len(cells) < 3 {
-		return nil
-	}
-
-	// Extract link from first cell
-	var link *html.Node
-	for c := cells[0].FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode && c.Data == "a" {
-			link = c
-			break
-		}
-	}
-
-	if link == nil {
-		return nil
-	}
-
-	name := getTextContent(link)
-	if name == "Parent directory" {
-		return nil
-	}
-
-	modified := strings.TrimSpace(getTextContent(cells[1]))
-	size := strings.TrimSpace(getTextContent(cells[2]))
-
-	// Build path without double slashes
-	path := name
-	if basePath != "" {
-		// Remove trailing slash from basePath and leading/trailing slash from name
-		cleanBase := strings.TrimSuffix(basePath, "/")
-		cleanName := strings.Trim(name, "/")
-		if strings.HasSuffix(name, "/") {
-			cleanName += "/"
-		}
-		path = cleanBase + "/" + cleanName
-	}
-
-	return &DirectoryEntry{
-		Name:        name,
-		Path:        path,
-		Modified:    modified,
-		Size:        size,
-		IsDirectory: strings.HasSuffix(name, "/"),
-	}
-}
-
-// generateDownloadFilename creates a filename in format: <camera>_yyyy-MM-dd_HH-mm-ss.ext
-func generateDownloadFilename(timestamp, originalName, mediaType string) string {
-	// Extract the start time from timestamp
-	// For images: "2025-11-21 21:23:56"
-	// For videos: "2025-11-21 21:23:56 - 21:24:10"
-	var timeStr string
-	if strings.Contains(timestamp, " - ") {
-		// Video: use start time
-		timeStr = strings.Split(timestamp, " - ")[0]
-	} else {
-		// Image: use the whole timestamp
-		timeStr = timestamp
-	}
-
-	// Parse the timestamp to reformat it
-	t, err := time.Parse("2006-01-02 15:04:05", timeStr)
-	if err != nil {
-		// If parsing fails, use the original name
+// generateDownloadFilename builds a friendly filename from the media's start
+// time, e.g. camera_2025-11-21_21-23-56.jpg, falling back to the original name
+func generateDownloadFilename(cameraName string, start *time.Time, originalName, mediaType string) string {
+	if start == nil {
 		return originalName
 	}
 
@@ -1162,84 +1901,49 @@ func generateDownloadFilename(timestamp, originalName, mediaType string) string
 	}
 
 	// Format as: camera_2025-11-21_21-23-56.ext
-	formatted := t.Format("2006-01-02_15-04-05")
-	return fmt.Sprintf("%s_%s%s", config.CameraName, formatted, ext)
+	formatted := start.Format("2006-01-02_15-04-05")
+	return fmt.Sprintf("%s_%s%s", cameraName, formatted, ext)
 }
 
-func parseMedia(entry DirectoryEntry, datePath string, mediaType string) MediaItem {
+func (cam *Camera) parseMedia(entry DirectoryEntry, datePath string, mediaType string) MediaItem {
 	name := entry.Name
 	trigger := "periodic"
 	if strings.HasPrefix(name, "A") {
 		trigger = "alarm"
 	}
 
-	timestamp := parseTimestamp(name, mediaType)
-
 	// Build proxy URL for videos
 	proxyURL := ""
 	if mediaType == "video" {
-		// URL-encode the path and add extensions
-		encodedPath := url.QueryEscape(entry.Path)
-		proxyURL = "/api/video/" + encodedPath + ".mp4"
-	}
-
-	// Generate download filename
-	downloadFilename := generateDownloadFilename(timestamp, name, mediaType)
-
-	return MediaItem{
-		Name:             name,
-		Path:             entry.Path,
-		URL:              config.CameraURL + "/" + entry.Path,
-		ProxyURL:         proxyURL,
-		DownloadFilename: downloadFilename,
-		Date:             strings.TrimSuffix(datePath, "/"),
-		Type:             mediaType,
-		Trigger:          trigger,
-		Timestamp:        timestamp,
-		Size:             entry.Size,
-		Modified:         entry.Modified,
-	}
-}
-
-func parseTimestamp(name string, mediaType string) string {
+		proxyURL = cam.videoURL(entry.Path)
+	}
+
+	item := MediaItem{
+		Camera:   cam.ID,
+		Name:     name,
+		Path:     entry.Path,
+		URL:      cam.source.URL(entry.Path),
+		ProxyURL: proxyURL,
+		Date:     strings.TrimSuffix(datePath, "/"),
+		Type:     mediaType,
+		Trigger:  trigger,
+		Size:     entry.Size,
+		Modified: entry.Modified,
+	}
+	setMediaTimes(&item, cam.location)
 	if mediaType == "image" {
-		// AYYMMDDHHMMSSXX.jpg
-		re := regexp.MustCompile(`[AP](\d{2})(\d{2})(\d{2})(\d{2})(\d{2})(\d{2})`)
-		matches := re.FindStringSubmatch(name)
-		if len(matches) == 7 {
-			return fmt.Sprintf("20%s-%s-%s %s:%s:%s",
-				matches[1], matches[2], matches[3], matches[4], matches[5], matches[6])
-		}
-	} else {
-		// AYYMMDDHHMMSSHHMMSSS.264
-		re := regexp.MustCompile(`[AP](\d{2})(\d{2})(\d{2})_(\d{2})(\d{2})(\d{2})_(\d{2})(\d{2})(\d{2})`)
-		matches := re.FindStringSubmatch(name)
-		if len(matches) == 10 {
-			return fmt.Sprintf("20%s-%s-%s %s:%s:%s - %s:%s:%s",
-				matches[1], matches[2], matches[3],
-				matches[4], matches[5], matches[6],
-				matches[7], matches[8], matches[9])
+		if seq, ok := parseImageSequence(name); ok {
+			item.Sequence = &seq
 		}
 	}
-
-	return ""
-}
-
-func getTextContent(n *html.Node) string {
-	if n.Type == html.TextNode {
-		return n.Data
+	if n, ok := parseSizeBytes(entry.Size); ok {
+		item.SizeBytes = n
 	}
 
-	var text string
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		text += getTextContent(c)
-	}
-	return text
-}
+	// Generate download filename
+	item.DownloadFilename = generateDownloadFilename(cam.Name, item.Start, name, mediaType)
 
-func basicAuth(username, password string) string {
-	auth := username + ":" + password
-	return base64.StdEncoding.EncodeToString([]byte(auth))
+	return item
 }
 
 func getEnv(key, defaultValue string) string {
@@ -1267,3 +1971,12 @@ func getEnvBool(key string, defaultValue bool) bool {
 	}
 	return value == "true" || value == "1" || value == "yes"
 }
+
+// defaultDataDir returns the per-user configuration directory for
+// ipcam-browser, or a directory under the working directory if there is none
+func defaultDataDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "ipcam-browser")
+	}
+	return "ipcam-browser-data"
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// mp4Timescale is the video track's timescale, matching MPEG's 90 kHz clock
+const mp4Timescale = 90000
+
+// mp4MovieTimescale is the timescale of the movie header, in milliseconds
+const mp4MovieTimescale = 1000
+
+// errNoKeyframe means a stream had no picture decoding could start from
+var errNoKeyframe = errors.New("stream has no keyframe")
+
+// mp4Sample is a video sample whose data has been written to the spool
+type mp4Sample struct {
+	size     uint32
+	time     int64 // 90 kHz ticks
+	keyframe bool
+}
+
+// mp4Muxer writes an H.264 or H.265 stream as an MP4 file with the movie
+// header ahead of the media data ("faststart"), so browsers can start
+// playing before the whole file has downloaded. Samples are spooled to a
+// file as they're written, which keeps memory use down to the sample table;
+// Finish then writes the MP4 with the sample data copied from the spool.
+// Cameras don't use B-frames, so samples are presented in decode order.
+type mp4Muxer struct {
+	codec   string
+	spool   *os.File
+	buf     *bufio.Writer
+	written int64
+
+	samples []mp4Sample
+	sps     []byte
+	pps     []byte
+	vps     []byte
+	params  videoParams
+	dropped int // samples before the first keyframe, which can't be decoded
+}
+
+// newMP4Muxer creates a muxer for "h264" or "hevc" video, spooling sample
+// data to spool
+func newMP4Muxer(codec string, spool *os.File) (*mp4Muxer, error) {
+	if codec != "h264" && codec != "hevc" {
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+	return &mp4Muxer{codec: codec, spool: spool, buf: bufio.NewWriter(spool)}, nil
+}
+
+// WriteSample adds an access unit to the video. Parameter sets are moved
+// into the sample description, which only has room for one of each, so a
+// stream whose parameter sets change is rejected.
+func (m *mp4Muxer) WriteSample(au accessUnit) error {
+	if len(m.samples) == 0 && !au.keyframe {
+		m.dropped++
+		return nil
+	}
+
+	var size int64
+	for _, nal := range au.nalus {
+		typ := nalType(m.codec, nal)
+		switch {
+		case isParameterSet(m.codec, typ):
+			if err := m.setParameterSet(typ, nal); err != nil {
+				return err
+			}
+			continue
+		case isAUD(m.codec, typ):
+			continue
+		}
+
+		// Samples hold NAL units prefixed by their length instead of start codes
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(nal)))
+		if _, err := m.buf.Write(length[:]); err != nil {
+			return err
+		}
+		if _, err := m.buf.Write(nal); err != nil {
+			return err
+		}
+		size += 4 + int64(len(nal))
+	}
+	if size == 0 {
+		return nil
+	}
+	if m.written+size > math.MaxUint32 {
+		return fmt.Errorf("video is too large")
+	}
+
+	// Presentation times must increase
+	time := au.time
+	if n := len(m.samples); n > 0 && time <= m.samples[n-1].time {
+		time = m.samples[n-1].time + 1
+	}
+	m.samples = append(m.samples, mp4Sample{size: uint32(size), time: time, keyframe: au.keyframe})
+	m.written += size
+	return nil
+}
+
+// setParameterSet records a parameter set, failing if it differs from one
+// seen earlier
+func (m *mp4Muxer) setParameterSet(typ int, nal []byte) error {
+	stored := &m.pps
+	switch typ {
+	case h264NALSPS, h265NALSPS:
+		stored = &m.sps
+	case h265NALVPS:
+		stored = &m.vps
+	}
+	if *stored == nil {
+		*stored = append([]byte(nil), nal...)
+		return nil
+	}
+	if !bytes.Equal(*stored, nal) {
+		return fmt.Errorf("parameter sets change mid-stream")
+	}
+	return nil
+}
+
+// SampleCount returns the number of samples written so far
+func (m *mp4Muxer) SampleCount() int {
+	return len(m.samples)
+}
+
+// Finish writes the MP4 to w. If fps is positive, samples are spaced evenly
+// at that rate; otherwise each is presented at the time it was written with.
+func (m *mp4Muxer) Finish(w io.Writer, fps float64) error {
+	if len(m.samples) == 0 {
+		return errNoKeyframe
+	}
+	if err := m.buf.Flush(); err != nil {
+		return err
+	}
+
+	var err error
+	switch m.codec {
+	case "h264":
+		if m.sps == nil || m.pps == nil {
+			return fmt.Errorf("stream has no SPS or PPS")
+		}
+		m.params, err = parseH264SPS(m.sps)
+	case "hevc":
+		if m.vps == nil || m.sps == nil || m.pps == nil {
+			return fmt.Errorf("stream has no VPS, SPS or PPS")
+		}
+		m.params, err = parseH265SPS(m.sps)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse SPS: %w", err)
+	}
+
+	durations := m.sampleDurations(fps)
+	ftyp := m.ftyp()
+
+	// The chunk offset depends on the size of the moov, which doesn't depend
+	// on the offset
+	moov := m.moov(durations, 0)
+	mdatOffset := uint32(len(ftyp) + len(moov) + 8)
+	moov = m.moov(durations, mdatOffset)
+
+	out := bufio.NewWriter(w)
+	if _, err := out.Write(ftyp); err != nil {
+		return err
+	}
+	if _, err := out.Write(moov); err != nil {
+		return err
+	}
+	var mdatHeader [8]byte
+	binary.BigEndian.PutUint32(mdatHeader[:4], uint32(8+m.written))
+	copy(mdatHeader[4:], "mdat")
+	if _, err := out.Write(mdatHeader[:]); err != nil {
+		return err
+	}
+	if _, err := m.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, m.spool, m.written); err != nil {
+		return fmt.Errorf("failed to copy samples: %w", err)
+	}
+	return out.Flush()
+}
+
+// sampleDurations returns each sample's duration in 90 kHz ticks
+func (m *mp4Muxer) sampleDurations(fps float64) []uint32 {
+	n := len(m.samples)
+	times := make([]int64, n)
+	for i := range m.samples {
+		if fps > 0 {
+			times[i] = int64(math.Round(float64(i) * mp4Timescale / fps))
+		} else {
+			times[i] = m.samples[i].time - m.samples[0].time
+		}
+	}
+
+	durations := make([]uint32, n)
+	for i := 0; i < n-1; i++ {
+		durations[i] = uint32(times[i+1] - times[i])
+	}
+	// The last sample lasts as long as the one before it
+	switch {
+	case n > 1:
+		durations[n-1] = durations[n-2]
+	case fps > 0:
+		durations[n-1] = uint32(math.Round(mp4Timescale / fps))
+	default:
+		durations[n-1] = mp4Timescale / defaultFPS
+	}
+	return durations
+}
+
+// ftyp returns the file type box
+func (m *mp4Muxer) ftyp() []byte {
+	brand := "avc1"
+	if m.codec == "hevc" {
+		brand = "hvc1"
+	}
+	return mp4Box("ftyp", []byte("isom"), be32(0x200), []byte("isom"), []byte("iso2"), []byte(brand), []byte("mp41"))
+}
+
+// moov returns the movie box, with the sample data at mdatOffset
+func (m *mp4Muxer) moov(durations []uint32, mdatOffset uint32) []byte {
+	var duration uint64
+	for _, d := range durations {
+		duration += uint64(d)
+	}
+	movieDuration := uint32(duration * mp4MovieTimescale / mp4Timescale)
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		be32(0), be32(0), // creation and modification times
+		be32(mp4MovieTimescale), be32(movieDuration),
+		be32(0x00010000), be16(0x0100), // rate 1.0, volume 1.0
+		make([]byte, 10), // reserved
+		mp4Matrix(),
+		make([]byte, 24), // pre_defined
+		be32(2),          // next track ID
+	)
+
+	tkhd := mp4FullBox("tkhd", 0, 0x3, // enabled, in movie
+		be32(0), be32(0), // creation and modification times
+		be32(1), be32(0), // track ID, reserved
+		be32(movieDuration),
+		make([]byte, 8),  // reserved
+		be16(0), be16(0), // layer, alternate group
+		be16(0), be16(0), // volume, reserved
+		mp4Matrix(),
+		be32(uint32(m.params.width)<<16), be32(uint32(m.params.height)<<16),
+	)
+
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		be32(0), be32(0), // creation and modification times
+		be32(mp4Timescale), be32(uint32(duration)),
+		be16(0x55c4), be16(0), // language "und", pre_defined
+	)
+	hdlr := mp4FullBox("hdlr", 0, 0,
+		be32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"),
+	)
+	vmhd := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+
+	stbl := mp4Box("stbl",
+		m.stsd(),
+		m.stts(durations),
+		m.stss(),
+		mp4FullBox("stsc", 0, 0, be32(1), be32(1), be32(uint32(len(m.samples))), be32(1)), // one chunk
+		m.stsz(),
+		mp4FullBox("stco", 0, 0, be32(1), be32(mdatOffset)),
+	)
+
+	minf := mp4Box("minf", vmhd, dinf, stbl)
+	mdia := mp4Box("mdia", mdhd, hdlr, minf)
+	trak := mp4Box("trak", tkhd, mdia)
+	return mp4Box("moov", mvhd, trak)
+}
+
+// stsd returns the sample description box
+func (m *mp4Muxer) stsd() []byte {
+	entryType, config := "avc1", mp4Box("avcC", m.avcC())
+	if m.codec == "hevc" {
+		entryType, config = "hvc1", mp4Box("hvcC", m.hvcC())
+	}
+	compressorName := make([]byte, 32)
+	entry := mp4Box(entryType,
+		make([]byte, 6), be16(1), // reserved, data reference index
+		make([]byte, 16), // pre_defined and reserved
+		be16(uint16(m.params.width)), be16(uint16(m.params.height)),
+		be32(0x00480000), be32(0x00480000), // 72 dpi
+		be32(0), // reserved
+		be16(1), // frame count
+		compressorName,
+		be16(0x0018), be16(0xffff), // depth, pre_defined
+		config,
+	)
+	return mp4FullBox("stsd", 0, 0, be32(1), entry)
+}
+
+// avcC returns the H.264 decoder configuration record
+func (m *mp4Muxer) avcC() []byte {
+	profile := m.sps[1]
+	record := []byte{
+		1,                           // configuration version
+		profile, m.sps[2], m.sps[3], // profile, compatibility, level
+		0xff, // 4-byte NAL unit lengths
+		0xe1, // one SPS
+	}
+	record = append(record, be16(uint16(len(m.sps)))...)
+	record = append(record, m.sps...)
+	record = append(record, 1) // one PPS
+	record = append(record, be16(uint16(len(m.pps)))...)
+	record = append(record, m.pps...)
+	if h264HasChromaFormat(profile) {
+		record = append(record,
+			0xfc|byte(m.params.chromaFormat),
+			0xf8|byte(m.params.bitDepthLuma-8),
+			0xf8|byte(m.params.bitDepthChroma-8),
+			0, // no SPS extensions
+		)
+	}
+	return record
+}
+
+// hvcC returns the H.265 decoder configuration record
+func (m *mp4Muxer) hvcC() []byte {
+	record := []byte{1} // configuration version
+	record = append(record, m.params.profileTierLevel...)
+	record = append(record,
+		0xf0, 0x00, // min_spatial_segmentation_idc
+		0xfc, // parallelism type unknown
+		0xfc|byte(m.params.chromaFormat),
+		0xf8|byte(m.params.bitDepthLuma-8),
+		0xf8|byte(m.params.bitDepthChroma-8),
+		0x00, 0x00, // average frame rate unspecified
+	)
+	nesting := byte(0)
+	if m.params.temporalNesting {
+		nesting = 1
+	}
+	record = append(record, byte(m.params.maxSubLayers&0x7)<<3|nesting<<2|0x3) // 4-byte NAL unit lengths
+
+	record = append(record, 3) // arrays of VPS, SPS and PPS
+	for _, ps := range []struct {
+		typ int
+		nal []byte
+	}{{h265NALVPS, m.vps}, {h265NALSPS, m.sps}, {h265NALPPS, m.pps}} {
+		record = append(record, 0x80|byte(ps.typ)) // array is complete
+		record = append(record, be16(1)...)
+		record = append(record, be16(uint16(len(ps.nal)))...)
+		record = append(record, ps.nal...)
+	}
+	return record
+}
+
+// stts returns the decoding time to sample box, run-length encoding the durations
+func (m *mp4Muxer) stts(durations []uint32) []byte {
+	var entries [][]byte
+	for i := 0; i < len(durations); {
+		j := i
+		for j < len(durations) && durations[j] == durations[i] {
+			j++
+		}
+		entries = append(entries, be32(uint32(j-i)), be32(durations[i]))
+		i = j
+	}
+	return mp4FullBox("stts", 0, 0, append([][]byte{be32(uint32(len(entries) / 2))}, entries...)...)
+}
+
+// stss returns the sync sample box, listing the keyframes
+func (m *mp4Muxer) stss() []byte {
+	var entries [][]byte
+	for i, sample := range m.samples {
+		if sample.keyframe {
+			entries = append(entries, be32(uint32(i+1)))
+		}
+	}
+	return mp4FullBox("stss", 0, 0, append([][]byte{be32(uint32(len(entries)))}, entries...)...)
+}
+
+// stsz returns the sample size box
+func (m *mp4Muxer) stsz() []byte {
+	sizes := make([]byte, 0, 4*len(m.samples))
+	for _, sample := range m.samples {
+		sizes = append(sizes, be32(sample.size)...)
+	}
+	return mp4FullBox("stsz", 0, 0, be32(0), be32(uint32(len(m.samples))), sizes)
+}
+
+// mp4Box builds a box from its type and contents
+func mp4Box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, part := range parts {
+		size += len(part)
+	}
+	box := make([]byte, 0, size)
+	box = append(box, be32(uint32(size))...)
+	box = append(box, typ...)
+	for _, part := range parts {
+		box = append(box, part...)
+	}
+	return box
+}
+
+// mp4FullBox builds a box with a version and flags
+func mp4FullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := be32(uint32(version)<<24 | flags&0xffffff)
+	return mp4Box(typ, append([][]byte{header}, parts...)...)
+}
+
+// mp4Matrix returns the identity transformation matrix
+func mp4Matrix() []byte {
+	matrix := make([]byte, 0, 36)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix = append(matrix, be32(v)...)
+	}
+	return matrix
+}
+
+func be16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func be32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// mp4Boxes splits data into its boxes, keyed by type
+func mp4Boxes(t *testing.T, data []byte) (types []string, boxes map[string][]byte) {
+	t.Helper()
+	boxes = make(map[string][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%d bytes left over after the boxes", len(data))
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("box %q has size %d, with %d bytes left", data[4:8], size, len(data))
+		}
+		typ := string(data[4:8])
+		types = append(types, typ)
+		boxes[typ] = data[8:size]
+		data = data[size:]
+	}
+	return types, boxes
+}
+
+// mp4Path returns the contents of the box at the end of a path of container
+// boxes
+func mp4Path(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for _, typ := range path {
+		_, boxes := mp4Boxes(t, data)
+		box, ok := boxes[typ]
+		if !ok {
+			t.Fatalf("no %s box in %v", typ, path)
+		}
+		data = box
+	}
+	return data
+}
+
+// mp4Table returns the entries of a sample table box, after the version,
+// flags and any fields before the entry count
+func mp4Table(t *testing.T, box []byte, skip int) []uint32 {
+	t.Helper()
+	box = box[4+skip:]
+	var table []uint32
+	for i := 4; i+4 <= len(box); i += 4 {
+		table = append(table, binary.BigEndian.Uint32(box[i:]))
+	}
+	return table
+}
+
+// lengthPrefixed joins NAL units as they're stored in MP4 samples
+func lengthPrefixed(nalus ...[]byte) []byte {
+	var sample []byte
+	for _, nal := range nalus {
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nal)))
+		sample = append(sample, nal...)
+	}
+	return sample
+}
+
+func TestMP4Muxer(t *testing.T) {
+	type frame struct {
+		nalus [][]byte
+		time  int64
+	}
+	tests := []struct {
+		name    string
+		codec   string
+		frames  []frame
+		fps     float64
+		dropped int
+		samples [][]byte // NAL units of each sample, length-prefixed
+		stts    []uint32 // sample count and duration pairs
+		stss    []uint32
+		config  string // type of the decoder configuration box
+		record  []byte
+	}{
+		{
+			name:  "h264",
+			codec: "h264",
+			frames: []frame{
+				{[][]byte{h264Slice}, 0}, // before the first keyframe
+				{[][]byte{h264HighSPS, h264PPS, h264IDR}, 9000},
+				{[][]byte{h264Slice}, 13500},
+				{[][]byte{{0x09, 0xf0}, h264Slice, h264Slice2}, 18000},
+				{[][]byte{h264Slice}, 27000},
+				{[][]byte{h264HighSPS, h264PPS, h264IDR}, 31500},
+			},
+			dropped: 1,
+			samples: [][]byte{
+				lengthPrefixed(h264IDR),
+				lengthPrefixed(h264Slice),
+				lengthPrefixed(h264Slice, h264Slice2),
+				lengthPrefixed(h264Slice),
+				lengthPrefixed(h264IDR),
+			},
+			stts:   []uint32{2, 4500, 1, 9000, 2, 4500},
+			stss:   []uint32{1, 5},
+			config: "avcC",
+			record: bytes.Join([][]byte{
+				{1, 0x64, 0x00, 0x28, 0xff, 0xe1, 0, byte(len(h264HighSPS))}, h264HighSPS,
+				{1, 0, byte(len(h264PPS))}, h264PPS,
+				{0xfd, 0xf8, 0xf8, 0}, // 4:2:0, 8-bit
+			}, nil),
+		},
+		{
+			name:  "h264 main at fixed rate",
+			codec: "h264",
+			frames: []frame{
+				{[][]byte{h264MainSPS, h264PPS, h264IDR}, 0},
+				{[][]byte{h264Slice}, 100},
+				{[][]byte{h264Slice}, 100},
+			},
+			fps: 15,
+			samples: [][]byte{
+				lengthPrefixed(h264IDR),
+				lengthPrefixed(h264Slice),
+				lengthPrefixed(h264Slice),
+			},
+			stts:   []uint32{3, 6000},
+			stss:   []uint32{1},
+			config: "avcC",
+			record: bytes.Join([][]byte{
+				{1, 0x4d, 0x00, 0x2a, 0xff, 0xe1, 0, byte(len(h264MainSPS))}, h264MainSPS,
+				{1, 0, byte(len(h264PPS))}, h264PPS,
+			}, nil),
+		},
+		{
+			name:  "h264 high 4:4:4",
+			codec: "h264",
+			frames: []frame{
+				{[][]byte{h264Hi444SPS, h264PPS, h264IDR}, 0},
+			},
+			samples: [][]byte{lengthPrefixed(h264IDR)},
+			stts:    []uint32{1, 4500},
+			stss:    []uint32{1},
+			config:  "avcC",
+			record: bytes.Join([][]byte{
+				{1, 0xf4, 0x00, 0x1f, 0xff, 0xe1, 0, byte(len(h264Hi444SPS))}, h264Hi444SPS,
+				{1, 0, byte(len(h264PPS))}, h264PPS,
+				{0xff, 0xfa, 0xfa, 0}, // 4:4:4, 10-bit
+			}, nil),
+		},
+		{
+			name:  "hevc",
+			codec: "hevc",
+			frames: []frame{
+				{[][]byte{h265VPS, h265SPS, h265PPS, h265IDR}, 0},
+				{[][]byte{h265Slice}, 3000},
+				{[][]byte{h265Slice}, 6000},
+				{[][]byte{h265VPS, h265SPS, h265PPS, h265IDR}, 9000},
+			},
+			samples: [][]byte{
+				lengthPrefixed(h265IDR),
+				lengthPrefixed(h265Slice),
+				lengthPrefixed(h265Slice),
+				lengthPrefixed(h265IDR),
+			},
+			stts:   []uint32{4, 3000},
+			stss:   []uint32{1, 4},
+			config: "hvcC",
+			record: bytes.Join([][]byte{
+				{1, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5d}, // profile, tier and level
+				{0xf0, 0x00, 0xfc, 0xfd, 0xf8, 0xf8, 0x00, 0x00, 0x0f},
+				{3, 0xa0, 0, 1, 0, byte(len(h265VPS))}, h265VPS,
+				{0xa1, 0, 1, 0, byte(len(h265SPS))}, h265SPS,
+				{0xa2, 0, 1, 0, byte(len(h265PPS))}, h265PPS,
+			}, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spool, err := os.CreateTemp(t.TempDir(), "mdat-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer spool.Close()
+			mux, err := newMP4Muxer(tt.codec, spool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range tt.frames {
+				keyframe := bytes.Equal(f.nalus[len(f.nalus)-1], h264IDR) || bytes.Equal(f.nalus[len(f.nalus)-1], h265IDR)
+				if err := mux.WriteSample(accessUnit{nalus: f.nalus, time: f.time, keyframe: keyframe}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if mux.SampleCount() != len(tt.samples) || mux.dropped != tt.dropped {
+				t.Errorf("%d samples, %d dropped; want %d, %d", mux.SampleCount(), mux.dropped, len(tt.samples), tt.dropped)
+			}
+			var out bytes.Buffer
+			if err := mux.Finish(&out, tt.fps); err != nil {
+				t.Fatal(err)
+			}
+			file := out.Bytes()
+
+			types, boxes := mp4Boxes(t, file)
+			if !reflect.DeepEqual(types, []string{"ftyp", "moov", "mdat"}) {
+				t.Fatalf("top-level boxes %v", types)
+			}
+			stbl := mp4Path(t, boxes["moov"], "trak", "mdia", "minf", "stbl")
+			_, table := mp4Boxes(t, stbl)
+
+			var sizes []uint32
+			for _, sample := range tt.samples {
+				sizes = append(sizes, uint32(len(sample)))
+			}
+			if got := mp4Table(t, table["stsz"], 4); !reflect.DeepEqual(got, sizes) {
+				t.Errorf("stsz %v, want %v", got, sizes)
+			}
+			if got := mp4Table(t, table["stts"], 0); !reflect.DeepEqual(got, tt.stts) {
+				t.Errorf("stts %v, want %v", got, tt.stts)
+			}
+			if got := mp4Table(t, table["stss"], 0); !reflect.DeepEqual(got, tt.stss) {
+				t.Errorf("stss %v, want %v", got, tt.stss)
+			}
+
+			// The chunk offset points at the samples, in the mdat
+			offset := binary.BigEndian.Uint32(table["stco"][8:])
+			mdat := bytes.Join(tt.samples, nil)
+			if !bytes.Equal(boxes["mdat"], mdat) || !bytes.Equal(file[offset:], mdat) {
+				t.Errorf("mdat at %d doesn't hold the samples", offset)
+			}
+
+			// The sample entry's boxes follow its 78 bytes of fields
+			entry := map[string]string{"avcC": "avc1", "hvcC": "hvc1"}[tt.config]
+			sampleEntry := mp4Path(t, table["stsd"][8:], entry)
+			record := mp4Path(t, sampleEntry[78:], tt.config)
+			if !bytes.Equal(record, tt.record) {
+				t.Errorf("%s\n got % x\nwant % x", tt.config, record, tt.record)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// MPEG transport stream constants. Only what's needed to carry one video
+// stream to ffmpeg is written: a PAT, a PMT and the video PES packets.
+const (
+	tsPacketSize  = 188
+	tsPayloadSize = tsPacketSize - 4
+	tsPIDPAT      = 0x0000
+	tsPIDPMT      = 0x1000
+	tsPIDVideo    = 0x0100
+	tsClockRate   = 90000 // PTS/PCR ticks per second
+
+	tsStreamTypeH264 = 0x1b
+	tsStreamTypeH265 = 0x24
+)
+
+// tsWriter writes Annex-B video frames as an MPEG transport stream. Unlike a
+// bare H.264/H.265 stream, a transport stream carries a timestamp for every
+// frame, so ffmpeg can remux variable frame rate video without re-timing it.
+type tsWriter struct {
+	w          io.Writer
+	streamType byte
+	continuity map[uint16]byte
+	packet     [tsPacketSize]byte
+	frames     int
+}
+
+// newTSWriter creates a transport stream writer for "h264" or "hevc" video
+func newTSWriter(w io.Writer, codec string) (*tsWriter, error) {
+	t := &tsWriter{w: w, continuity: make(map[uint16]byte)}
+	switch codec {
+	case "h264":
+		t.streamType = tsStreamTypeH264
+	case "hevc":
+		t.streamType = tsStreamTypeH265
+	default:
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+	return t, nil
+}
+
+// WriteFrame writes one video frame presented at pts, in 90 kHz ticks. The
+// program tables are repeated before every keyframe so the stream can be
+// read from any keyframe.
+func (t *tsWriter) WriteFrame(data []byte, pts int64, keyframe bool) error {
+	if t.frames == 0 || keyframe {
+		if err := t.writeTables(); err != nil {
+			return err
+		}
+	}
+	t.frames++
+
+	// Cameras don't use B-frames, so the decode time is the presentation time
+	pes := make([]byte, 0, 14+len(data))
+	pes = append(pes,
+		0x00, 0x00, 0x01, 0xe0, // start code, video stream 0
+		0x00, 0x00, // unbounded length, allowed for video
+		0x80, // marker bits
+		0x80, // PTS only
+		0x05, // header data length
+	)
+	pes = append(pes, tsTimestamp(0x20, pts)...)
+	pes = append(pes, data...)
+
+	first := true
+	for first || len(pes) > 0 {
+		// The first packet carries the program clock and marks keyframes
+		var adaptation []byte
+		if first {
+			flags := byte(0x10) // PCR present
+			if keyframe {
+				flags |= 0x40 // random access indicator
+			}
+			adaptation = append([]byte{flags}, tsPCR(pts)...)
+		}
+
+		space := tsPayloadSize
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+		n := len(pes)
+		if n > space {
+			n = space
+		}
+		// A short final packet is filled out with adaptation field stuffing
+		if stuffing := space - n; stuffing > 0 {
+			switch {
+			case adaptation != nil:
+				adaptation = append(adaptation, tsStuffing(stuffing)...)
+			case stuffing == 1:
+				adaptation = []byte{}
+			default:
+				adaptation = append([]byte{0x00}, tsStuffing(stuffing-2)...)
+			}
+		}
+
+		if err := t.writePacket(tsPIDVideo, first, adaptation, pes[:n]); err != nil {
+			return err
+		}
+		pes = pes[n:]
+		first = false
+	}
+	return nil
+}
+
+// writeTables writes the program association and program map tables
+func (t *tsWriter) writeTables() error {
+	pat := tsSection(0x00, 0x0001, []byte{
+		0x00, 0x01, // program 1
+		0xe0 | tsPIDPMT>>8, tsPIDPMT & 0xff,
+	})
+	if err := t.writePacket(tsPIDPAT, true, nil, pat); err != nil {
+		return err
+	}
+
+	pmt := tsSection(0x02, 0x0001, []byte{
+		0xe0 | tsPIDVideo>>8, tsPIDVideo & 0xff, // PCR PID
+		0xf0, 0x00, // no program descriptors
+		t.streamType,
+		0xe0 | tsPIDVideo>>8, tsPIDVideo & 0xff,
+		0xf0, 0x00, // no stream descriptors
+	})
+	return t.writePacket(tsPIDPMT, true, nil, pmt)
+}
+
+// writePacket writes a single transport stream packet. PSI payloads shorter
+// than a packet are padded with 0xff, as the standard allows.
+func (t *tsWriter) writePacket(pid uint16, start bool, adaptation, payload []byte) error {
+	p := t.packet[:]
+	p[0] = 0x47
+	p[1] = byte(pid>>8) & 0x1f
+	if start {
+		p[1] |= 0x40
+	}
+	p[2] = byte(pid)
+	control := byte(0x10) // payload only
+	if adaptation != nil {
+		control = 0x30 // adaptation field and payload
+	}
+	p[3] = control | t.continuity[pid]
+	t.continuity[pid] = (t.continuity[pid] + 1) & 0x0f
+
+	i := 4
+	if adaptation != nil {
+		p[i] = byte(len(adaptation))
+		i++
+		i += copy(p[i:], adaptation)
+	}
+	i += copy(p[i:], payload)
+	for ; i < tsPacketSize; i++ {
+		p[i] = 0xff
+	}
+
+	_, err := t.w.Write(p)
+	return err
+}
+
+// tsSection builds a PSI section for a single packet, with its pointer field
+// and CRC
+func tsSection(tableID byte, id uint16, body []byte) []byte {
+	length := 5 + len(body) + 4 // header after the length field, body and CRC
+	section := []byte{
+		0x00, // pointer field
+		tableID,
+		0xb0 | byte(length>>8), byte(length),
+		byte(id >> 8), byte(id),
+		0xc1, // version 0, current
+		0x00, // section number
+		0x00, // last section number
+	}
+	section = append(section, body...)
+	crc := crc32MPEG2(section[1:])
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// tsTimestamp encodes a 33-bit PES timestamp with the given 4-bit prefix
+func tsTimestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix | byte(ts>>29)&0x0e | 0x01,
+		byte(ts >> 22),
+		byte(ts>>14)&0xfe | 0x01,
+		byte(ts >> 7),
+		byte(ts<<1)&0xfe | 0x01,
+	}
+}
+
+// tsPCR encodes a program clock reference with no 27 MHz extension
+func tsPCR(base int64) []byte {
+	return []byte{
+		byte(base >> 25),
+		byte(base >> 17),
+		byte(base >> 9),
+		byte(base >> 1),
+		byte(base<<7)&0x80 | 0x7e,
+		0x00,
+	}
+}
+
+// tsStuffing returns n stuffing bytes
+func tsStuffing(n int) []byte {
+	stuffing := make([]byte, n)
+	for i := range stuffing {
+		stuffing[i] = 0xff
+	}
+	return stuffing
+}
+
+// crc32MPEG2 computes the CRC used by MPEG-2 PSI sections: polynomial
+// 0x04c11db7, not reflected, with no final XOR
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
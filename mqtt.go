@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT connection settings
+const (
+	mqttDialTimeout  = 10 * time.Second
+	mqttWriteTimeout = 10 * time.Second
+	mqttKeepAlive    = 60 * time.Second
+	mqttMinBackoff   = 2 * time.Second
+	mqttMaxBackoff   = 2 * time.Minute
+)
+
+// Payloads of the alarm binary sensor and availability topics
+const (
+	mqttAlarmOn  = "ON"
+	mqttAlarmOff = "OFF"
+	mqttOnline   = "online"
+	mqttOffline  = "offline"
+)
+
+// MQTTConfig holds the settings for publishing to an MQTT broker
+type MQTTConfig struct {
+	Broker          string // host:port, or a tcp://, mqtt://, ssl://, tls:// or mqtts:// URL
+	Username        string
+	Password        string
+	ClientID        string
+	TopicPrefix     string
+	Discovery       bool // publish Home Assistant discovery configs
+	DiscoveryPrefix string
+	AlarmOffDelay   time.Duration // how long the alarm sensor stays on after new alarm media
+}
+
+// loadMQTTConfig reads the MQTT settings from the environment. Publishing
+// is disabled if MQTT_BROKER is not set.
+func loadMQTTConfig() (MQTTConfig, error) {
+	cfg := MQTTConfig{
+		Broker:          getEnv("MQTT_BROKER", ""),
+		Username:        getEnv("MQTT_USERNAME", ""),
+		Password:        getEnv("MQTT_PASSWORD", ""),
+		ClientID:        getEnv("MQTT_CLIENT_ID", "ipcam-browser"),
+		TopicPrefix:     strings.Trim(getEnv("MQTT_TOPIC_PREFIX", "ipcam-browser"), "/"),
+		Discovery:       getEnvBool("MQTT_DISCOVERY_ENABLED", true),
+		DiscoveryPrefix: strings.Trim(getEnv("MQTT_DISCOVERY_PREFIX", "homeassistant"), "/"),
+		AlarmOffDelay:   time.Duration(getEnvInt("MQTT_ALARM_OFF_SECONDS", 60)) * time.Second,
+	}
+	if cfg.Broker == "" {
+		return cfg, nil
+	}
+	if _, _, err := parseBrokerAddress(cfg.Broker); err != nil {
+		return cfg, err
+	}
+	if cfg.TopicPrefix == "" {
+		return cfg, fmt.Errorf("MQTT_TOPIC_PREFIX must not be empty")
+	}
+	if cfg.AlarmOffDelay < time.Second {
+		log.Printf("Warning: MQTT_ALARM_OFF_SECONDS must be >= 1, using 1")
+		cfg.AlarmOffDelay = time.Second
+	}
+	return cfg, nil
+}
+
+// parseBrokerAddress returns the host:port to dial for a broker setting and
+// whether to use TLS
+func parseBrokerAddress(broker string) (addr string, useTLS bool, err error) {
+	port := "1883"
+	if strings.Contains(broker, "://") {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid MQTT broker %q: %w", broker, err)
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+			port = "8883"
+		default:
+			return "", false, fmt.Errorf("invalid MQTT broker %q: unsupported scheme %q", broker, u.Scheme)
+		}
+		broker = u.Host
+	}
+	if broker == "" {
+		return "", false, fmt.Errorf("invalid MQTT broker: no host")
+	}
+	if _, _, err := net.SplitHostPort(broker); err != nil {
+		broker = net.JoinHostPort(broker, port)
+	}
+	return broker, useTLS, nil
+}
+
+// MQTT 3.1.1 control packet types, shifted into the fixed header
+const (
+	mqttConnect    = 1 << 4
+	mqttConnAck    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPingReq    = 12 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// mqttMessage is a message to publish
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// MQTTClient is a minimal MQTT 3.1.1 client. It only publishes, at QoS 0,
+// which is all that's needed to feed state to home automation.
+type MQTTClient struct {
+	conn      net.Conn
+	writeMu   sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// DialMQTT connects to the broker. will, if not nil, is published by the
+// broker if the connection is lost without disconnecting.
+func DialMQTT(cfg MQTTConfig, will *mqttMessage) (*MQTTClient, error) {
+	addr, useTLS, err := parseBrokerAddress(cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var conn net.Conn
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	c := &MQTTClient{conn: conn, done: make(chan struct{})}
+	if err := c.connect(cfg, will); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	go c.pingLoop()
+	return c, nil
+}
+
+// connect sends the CONNECT packet and waits for the broker to accept it
+func (c *MQTTClient) connect(cfg MQTTConfig, will *mqttMessage) error {
+	var flags byte = 0x02 // clean session
+	payload := mqttString(cfg.ClientID)
+	if will != nil {
+		flags |= 0x04 // will flag, QoS 0
+		if will.Retain {
+			flags |= 0x20
+		}
+		payload = append(payload, mqttString(will.Topic)...)
+		payload = append(payload, mqttBytes(will.Payload)...)
+	}
+	if cfg.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(cfg.Username)...)
+		if cfg.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(cfg.Password)...)
+		}
+	}
+
+	body := mqttString("MQTT")
+	body = append(body, 4, flags) // protocol level 4 is MQTT 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = append(body, payload...)
+	if err := c.write(mqttPacket(mqttConnect, body)); err != nil {
+		return fmt.Errorf("failed to send MQTT CONNECT: %w", err)
+	}
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(mqttDialTimeout))
+	packetType, ack, err := readMQTTPacket(c.conn)
+	if err != nil {
+		return fmt.Errorf("failed to read MQTT CONNACK: %w", err)
+	}
+	if packetType != mqttConnAck || len(ack) != 2 {
+		return fmt.Errorf("unexpected MQTT packet 0x%02x while connecting", packetType)
+	}
+	switch ack[1] {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("MQTT broker refused connection: unacceptable protocol version")
+	case 2:
+		return fmt.Errorf("MQTT broker refused connection: client ID rejected")
+	case 3:
+		return fmt.Errorf("MQTT broker refused connection: server unavailable")
+	case 4:
+		return fmt.Errorf("MQTT broker refused connection: bad username or password")
+	case 5:
+		return fmt.Errorf("MQTT broker refused connection: not authorized")
+	default:
+		return fmt.Errorf("MQTT broker refused connection: code %d", ack[1])
+	}
+}
+
+// readLoop consumes packets from the broker, which for a publish-only client
+// are only ping responses, and closes the client once the connection fails or
+// the broker stops answering pings
+func (c *MQTTClient) readLoop() {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		if _, _, err := readMQTTPacket(c.conn); err != nil {
+			c.close()
+			return
+		}
+	}
+}
+
+// pingLoop keeps the connection alive while nothing is being published
+func (c *MQTTClient) pingLoop() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write([]byte{mqttPingReq, 0}); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Publish sends a message at QoS 0
+func (c *MQTTClient) Publish(msg mqttMessage) error {
+	var header byte = mqttPublish
+	if msg.Retain {
+		header |= 0x01
+	}
+	body := append(mqttString(msg.Topic), msg.Payload...)
+	return c.write(mqttPacket(header, body))
+}
+
+// Done is closed when the connection is lost or closed
+func (c *MQTTClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close disconnects cleanly, so the broker doesn't publish the will
+func (c *MQTTClient) Close() {
+	_ = c.write([]byte{mqttDisconnect, 0})
+	c.close()
+}
+
+// write sends a packet, closing the client if it can't be sent
+func (c *MQTTClient) write(packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	select {
+	case <-c.done:
+		return errors.New("MQTT connection closed")
+	default:
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	if _, err := c.conn.Write(packet); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *MQTTClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// mqttPacket frames a packet body with its fixed header
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttString encodes a length-prefixed UTF-8 string
+func mqttString(s string) []byte {
+	return mqttBytes([]byte(s))
+}
+
+// mqttBytes encodes length-prefixed binary data
+func mqttBytes(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
+// readMQTTPacket reads one packet, returning its type and body
+func readMQTTPacket(r io.Reader) (byte, []byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, nil, err
+	}
+	packetType := b[0] & 0xf0
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length += int(b[0]&0x7f) * multiplier
+		multiplier *= 128
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return packetType, body, nil
+}
+
+// MQTTMediaMessage is the JSON published for new media, and retained as a
+// camera's last alarm
+type MQTTMediaMessage struct {
+	Camera     string     `json:"camera"`
+	CameraName string     `json:"cameraName"`
+	DetectedAt time.Time  `json:"detectedAt"`
+	Item       MediaItem  `json:"item"`
+	Links      MediaLinks `json:"links"`
+}
+
+// mqttCameraState is what has been published for a camera, kept so it can
+// be republished after reconnecting
+type mqttCameraState struct {
+	alarm     string
+	lastAlarm []byte // JSON MQTTMediaMessage
+	snapshot  []byte // JPEG
+	offTimer  *time.Timer
+}
+
+// MQTTPublisher publishes new media from the change feed to an MQTT broker,
+// keeping a retained alarm state, last alarm and snapshot for each camera,
+// and announces the cameras to Home Assistant via MQTT discovery
+type MQTTPublisher struct {
+	cfg     MQTTConfig
+	baseURL string
+	cameras []*Camera
+
+	mu     sync.Mutex
+	client *MQTTClient // nil while disconnected
+	state  map[string]*mqttCameraState
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewMQTTPublisher creates a publisher for the given cameras. baseURL is the
+// externally reachable URL of ipcam-browser, used for media links.
+func NewMQTTPublisher(cfg MQTTConfig, baseURL string, cameras []*Camera) *MQTTPublisher {
+	p := &MQTTPublisher{
+		cfg:     cfg,
+		baseURL: baseURL,
+		cameras: cameras,
+		state:   make(map[string]*mqttCameraState),
+		stopCh:  make(chan struct{}),
+	}
+	for _, cam := range cameras {
+		p.state[cam.ID] = &mqttCameraState{alarm: mqttAlarmOff}
+	}
+	return p
+}
+
+// Start connects to the broker and begins following the change feed
+func (p *MQTTPublisher) Start() {
+	log.Printf("Starting MQTT publisher for broker %s", p.cfg.Broker)
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		p.run()
+	}()
+	go func() {
+		defer p.wg.Done()
+		changeFeed.Follow("MQTT", p.stopCh, p.handleChange)
+	}()
+}
+
+// Stop marks ipcam-browser offline and disconnects from the broker
+func (p *MQTTPublisher) Stop() {
+	close(p.stopCh)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	for _, state := range p.state {
+		if state.offTimer != nil {
+			state.offTimer.Stop()
+		}
+	}
+	p.mu.Unlock()
+	log.Println("MQTT publisher stopped")
+}
+
+// topic returns a topic under the configured prefix
+func (p *MQTTPublisher) topic(parts ...string) string {
+	return p.cfg.TopicPrefix + "/" + strings.Join(parts, "/")
+}
+
+// run keeps a connection to the broker open until stopped, reconnecting
+// with exponential backoff
+func (p *MQTTPublisher) run() {
+	will := &mqttMessage{Topic: p.topic("status"), Payload: []byte(mqttOffline), Retain: true}
+	backoff := mqttMinBackoff
+	for {
+		client, err := DialMQTT(p.cfg, will)
+		if err != nil {
+			log.Printf("MQTT: %v (retrying in %v)", err, backoff)
+			select {
+			case <-time.After(backoff):
+				backoff = min(backoff*2, mqttMaxBackoff)
+				continue
+			case <-p.stopCh:
+				return
+			}
+		}
+		backoff = mqttMinBackoff
+		log.Printf("MQTT: connected to %s", p.cfg.Broker)
+
+		p.mu.Lock()
+		p.client = client
+		p.announce()
+		p.mu.Unlock()
+
+		select {
+		case <-client.Done():
+			log.Printf("MQTT: lost connection to %s", p.cfg.Broker)
+		case <-p.stopCh:
+			_ = client.Publish(mqttMessage{Topic: p.topic("status"), Payload: []byte(mqttOffline), Retain: true})
+			client.Close()
+		}
+
+		p.mu.Lock()
+		p.client = nil
+		p.mu.Unlock()
+
+		select {
+		case <-p.stopCh:
+			return
+		default:
+		}
+	}
+}
+
+// announce publishes the discovery configs, availability and each camera's
+// current state after connecting. The caller must hold p.mu.
+func (p *MQTTPublisher) announce() {
+	if p.cfg.Discovery {
+		for _, cam := range p.cameras {
+			for _, msg := range p.discoveryMessages(cam) {
+				p.publish(msg)
+			}
+		}
+	}
+	p.publish(mqttMessage{Topic: p.topic("status"), Payload: []byte(mqttOnline), Retain: true})
+
+	for _, cam := range p.cameras {
+		state := p.state[cam.ID]
+		p.publish(mqttMessage{Topic: p.topic(cam.ID, "alarm"), Payload: []byte(state.alarm), Retain: true})
+		if state.lastAlarm != nil {
+			p.publish(mqttMessage{Topic: p.topic(cam.ID, "last_alarm"), Payload: state.lastAlarm, Retain: true})
+		}
+		if state.snapshot != nil {
+			p.publish(mqttMessage{Topic: p.topic(cam.ID, "snapshot"), Payload: state.snapshot, Retain: true})
+		}
+	}
+}
+
+// publish sends a message if connected. Messages published while
+// disconnected are dropped; retained state is republished on reconnect.
+// The caller must hold p.mu.
+func (p *MQTTPublisher) publish(msg mqttMessage) {
+	if p.client == nil {
+		return
+	}
+	if err := p.client.Publish(msg); err != nil {
+		log.Printf("MQTT: failed to publish to %s: %v", msg.Topic, err)
+	}
+}
+
+// discoveryMessages returns the Home Assistant discovery configs that make a
+// camera appear as a device with an alarm binary_sensor and an image entity
+// showing the last alarm snapshot
+func (p *MQTTPublisher) discoveryMessages(cam *Camera) []mqttMessage {
+	nodeID := "ipcam_browser_" + strings.ReplaceAll(cam.ID, "-", "_")
+	device := map[string]any{
+		"identifiers":       []string{nodeID},
+		"name":              cam.Name,
+		"manufacturer":      "ipcam-browser",
+		"sw_version":        version,
+		"configuration_url": p.baseURL,
+	}
+
+	configs := []struct {
+		component string
+		object    string
+		config    map[string]any
+	}{
+		{"binary_sensor", "alarm", map[string]any{
+			"name":                  "Alarm",
+			"device_class":          "motion",
+			"state_topic":           p.topic(cam.ID, "alarm"),
+			"payload_on":            mqttAlarmOn,
+			"payload_off":           mqttAlarmOff,
+			"json_attributes_topic": p.topic(cam.ID, "last_alarm"),
+		}},
+		{"image", "snapshot", map[string]any{
+			"name":         "Last alarm",
+			"image_topic":  p.topic(cam.ID, "snapshot"),
+			"content_type": "image/jpeg",
+		}},
+	}
+
+	var messages []mqttMessage
+	for _, c := range configs {
+		c.config["unique_id"] = nodeID + "_" + c.object
+		c.config["availability_topic"] = p.topic("status")
+		c.config["device"] = device
+		payload, err := json.Marshal(c.config)
+		if err != nil {
+			log.Printf("MQTT: failed to encode discovery config: %v", err)
+			continue
+		}
+		messages = append(messages, mqttMessage{
+			Topic:   p.cfg.DiscoveryPrefix + "/" + c.component + "/" + nodeID + "/" + c.object + "/config",
+			Payload: payload,
+			Retain:  true,
+		})
+	}
+	return messages
+}
+
+// handleChange publishes an event for each new item. New alarm media also
+// turns the camera's alarm sensor on and updates its last alarm and
+// snapshot, which for a video is the image matched to it.
+func (p *MQTTPublisher) handleChange(change MediaChange) {
+	if change.Type != ChangeAdded {
+		return
+	}
+	cam := lookupCamera(change.Camera)
+	if cam == nil {
+		return
+	}
+
+	payload, err := json.Marshal(MQTTMediaMessage{
+		Camera:     cam.ID,
+		CameraName: cam.Name,
+		DetectedAt: change.DetectedAt,
+		Item:       change.Item,
+		Links:      mediaLinks(cam, change.Item, p.baseURL),
+	})
+	if err != nil {
+		log.Printf("MQTT: failed to encode media message: %v", err)
+		return
+	}
+
+	// Fetch the snapshot before taking the lock, since it may mean a trip
+	// to the camera
+	var snapshot []byte
+	alarm := change.Item.Trigger == "alarm"
+	if alarm {
+		snapshot, err = cam.snapshot(change.Item)
+		if err != nil {
+			log.Printf("MQTT: failed to fetch snapshot %s: %v", change.Item.Path, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.publish(mqttMessage{Topic: p.topic(cam.ID, "events"), Payload: payload})
+	if !alarm {
+		return
+	}
+
+	state := p.state[cam.ID]
+	state.lastAlarm = payload
+	p.publish(mqttMessage{Topic: p.topic(cam.ID, "last_alarm"), Payload: payload, Retain: true})
+	if snapshot != nil {
+		state.snapshot = snapshot
+		p.publish(mqttMessage{Topic: p.topic(cam.ID, "snapshot"), Payload: snapshot, Retain: true})
+	}
+
+	if state.offTimer != nil {
+		state.offTimer.Stop()
+	}
+	state.offTimer = time.AfterFunc(p.cfg.AlarmOffDelay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		state.alarm = mqttAlarmOff
+		p.publish(mqttMessage{Topic: p.topic(cam.ID, "alarm"), Payload: []byte(mqttAlarmOff), Retain: true})
+	})
+	if state.alarm != mqttAlarmOn {
+		state.alarm = mqttAlarmOn
+		p.publish(mqttMessage{Topic: p.topic(cam.ID, "alarm"), Payload: []byte(mqttAlarmOn), Retain: true})
+	}
+}
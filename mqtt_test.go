@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokerPacket is a packet received by mqttBroker, with its whole fixed
+// header byte so the flags can be checked
+type brokerPacket struct {
+	header byte
+	body   []byte
+}
+
+// mqttBroker is an in-process stand-in for an MQTT broker. It accepts
+// connections with the given CONNACK return code and records every packet.
+type mqttBroker struct {
+	listener net.Listener
+	code     byte
+	packets  chan brokerPacket
+}
+
+// startMQTTBroker starts a broker on a local port, stopped when the test ends
+func startMQTTBroker(t *testing.T, code byte) *mqttBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &mqttBroker{listener: listener, code: code, packets: make(chan brokerPacket, 100)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		peeked, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		header := peeked[0]
+		packetType, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		b.packets <- brokerPacket{header: header, body: body}
+
+		switch packetType {
+		case mqttConnect:
+			_, _ = conn.Write([]byte{mqttConnAck, 2, 0, b.code})
+			if b.code != 0 {
+				return
+			}
+		case mqttPingReq:
+			_, _ = conn.Write([]byte{13 << 4, 0})
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// next returns the next packet the broker received
+func (b *mqttBroker) next(t *testing.T) brokerPacket {
+	t.Helper()
+	select {
+	case p := <-b.packets:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet received")
+		return brokerPacket{}
+	}
+}
+
+// nextPublish returns the next packet, which must be a QoS 0 PUBLISH
+func (b *mqttBroker) nextPublish(t *testing.T) (topic string, payload []byte, retain bool) {
+	t.Helper()
+	p := b.next(t)
+	if p.header&0xf0 != mqttPublish || p.header&0x0e != 0 {
+		t.Fatalf("got packet 0x%02x, want a QoS 0 PUBLISH", p.header)
+	}
+	n := int(p.body[0])<<8 | int(p.body[1])
+	return string(p.body[2 : 2+n]), p.body[2+n:], p.header&0x01 != 0
+}
+
+// lengthString encodes a string as MQTT does, spelled out for the tests
+func lengthString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{321, []byte{0xc1, 0x02}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+
+	for _, tt := range tests {
+		body := bytes.Repeat([]byte{0xa5}, tt.length)
+		packet := mqttPacket(mqttPublish|0x01, body)
+		if packet[0] != mqttPublish|0x01 || !bytes.Equal(packet[1:1+len(tt.want)], tt.want) {
+			t.Errorf("%d bytes: header %x, want 31%x", tt.length, packet[:1+len(tt.want)], tt.want)
+			continue
+		}
+
+		packetType, got, err := readMQTTPacket(bytes.NewReader(packet))
+		if err != nil || packetType != mqttPublish || !bytes.Equal(got, body) {
+			t.Errorf("%d bytes: read back type 0x%02x, %d bytes, %v", tt.length, packetType, len(got), err)
+		}
+	}
+
+	// The remaining length takes at most four bytes
+	if _, _, err := readMQTTPacket(bytes.NewReader([]byte{mqttPublish, 0xff, 0xff, 0xff, 0xff, 0x01})); err == nil {
+		t.Error("five-byte remaining length accepted")
+	}
+}
+
+func TestMQTTConnect(t *testing.T) {
+	keepAlive := []byte{0x00, 0x3c}
+	tests := []struct {
+		name    string
+		cfg     MQTTConfig
+		will    *mqttMessage
+		code    byte
+		want    []byte
+		wantErr string
+	}{
+		{
+			name: "anonymous",
+			cfg:  MQTTConfig{ClientID: "ipcam-browser"},
+			want: bytes.Join([][]byte{lengthString("MQTT"), {4, 0x02}, keepAlive, lengthString("ipcam-browser")}, nil),
+		},
+		{
+			name: "username only",
+			cfg:  MQTTConfig{ClientID: "cam", Username: "hass"},
+			want: bytes.Join([][]byte{lengthString("MQTT"), {4, 0x82}, keepAlive, lengthString("cam"), lengthString("hass")}, nil),
+		},
+		{
+			name: "credentials and retained will",
+			cfg:  MQTTConfig{ClientID: "cam", Username: "hass", Password: "secret"},
+			will: &mqttMessage{Topic: "ipcam-browser/status", Payload: []byte("offline"), Retain: true},
+			want: bytes.Join([][]byte{
+				lengthString("MQTT"), {4, 0xe6}, keepAlive, lengthString("cam"),
+				lengthString("ipcam-browser/status"), lengthString("offline"),
+				lengthString("hass"), lengthString("secret"),
+			}, nil),
+		},
+		{
+			name: "will not retained",
+			cfg:  MQTTConfig{ClientID: "cam"},
+			will: &mqttMessage{Topic: "t", Payload: []byte("x")},
+			want: bytes.Join([][]byte{lengthString("MQTT"), {4, 0x06}, keepAlive, lengthString("cam"), lengthString("t"), lengthString("x")}, nil),
+		},
+		{
+			name:    "refused",
+			cfg:     MQTTConfig{ClientID: "cam", Username: "hass", Password: "wrong"},
+			code:    4,
+			wantErr: "bad username or password",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := startMQTTBroker(t, tt.code)
+			tt.cfg.Broker = "tcp://" + broker.listener.Addr().String()
+
+			client, err := DialMQTT(tt.cfg, tt.will)
+			connect := broker.next(t)
+			if connect.header != mqttConnect {
+				t.Fatalf("first packet 0x%02x, want CONNECT", connect.header)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if !bytes.Equal(connect.body, tt.want) {
+				t.Errorf("CONNECT body:\n got %x\nwant %x", connect.body, tt.want)
+			}
+		})
+	}
+}
+
+func TestMQTTPublish(t *testing.T) {
+	broker := startMQTTBroker(t, 0)
+	client, err := DialMQTT(MQTTConfig{Broker: broker.listener.Addr().String(), ClientID: "cam"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.next(t) // CONNECT
+
+	messages := []mqttMessage{
+		{Topic: "ipcam-browser/front/events", Payload: []byte(`{"camera":"front"}`)},
+		{Topic: "ipcam-browser/front/snapshot", Payload: bytes.Repeat([]byte{0xff, 0xd8}, 10000), Retain: true}, // three-byte length
+		{Topic: "ipcam-browser/status", Payload: []byte{}, Retain: true},
+	}
+	for _, msg := range messages {
+		if err := client.Publish(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range messages {
+		topic, payload, retain := broker.nextPublish(t)
+		if topic != want.Topic || !bytes.Equal(payload, want.Payload) || retain != want.Retain {
+			t.Errorf("got %s (%d bytes, retain %v), want %s (%d bytes, retain %v)",
+				topic, len(payload), retain, want.Topic, len(want.Payload), want.Retain)
+		}
+	}
+
+	client.Close()
+	if p := broker.next(t); p.header != mqttDisconnect || len(p.body) != 0 {
+		t.Errorf("got packet 0x%02x after closing, want DISCONNECT", p.header)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Error("client not done after closing")
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	photo := testJPEG(t, 64, 48)
+	cam := newSDCardTestCamera(t, photo,
+		"20251121/images000/A25112121235800.jpg",
+		"20251121/record000/A251121_212356_212410.264",
+	)
+	oldCameras := cameras
+	cameras = []*Camera{cam}
+	t.Cleanup(func() { cameras = oldCameras })
+
+	broker := startMQTTBroker(t, 0)
+	p := NewMQTTPublisher(MQTTConfig{
+		Broker:          broker.listener.Addr().String(),
+		ClientID:        "ipcam-browser",
+		TopicPrefix:     "ipcam-browser",
+		Discovery:       true,
+		DiscoveryPrefix: "homeassistant",
+		AlarmOffDelay:   100 * time.Millisecond,
+	}, "http://ipcam.local", cameras)
+	p.Start()
+
+	if connect := broker.next(t); connect.header != mqttConnect {
+		t.Fatalf("first packet 0x%02x, want CONNECT", connect.header)
+	}
+
+	device := `"device": {"identifiers": ["ipcam_browser_front"], "name": "Front Door", "manufacturer": "ipcam-browser",
+		"sw_version": "` + version + `", "configuration_url": "http://ipcam.local"}`
+	type published struct {
+		topic   string
+		payload string
+		retain  bool
+	}
+	expect := func(want published) {
+		t.Helper()
+		topic, payload, retain := broker.nextPublish(t)
+		if topic != want.topic || retain != want.retain {
+			t.Fatalf("got %s (retain %v), want %s (retain %v)", topic, retain, want.topic, want.retain)
+		}
+		if strings.HasPrefix(want.payload, "{") {
+			var got, wantJSON any
+			if err := json.Unmarshal(payload, &got); err != nil {
+				t.Fatalf("%s: %v", topic, err)
+			}
+			if err := json.Unmarshal([]byte(want.payload), &wantJSON); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, wantJSON) {
+				t.Errorf("%s:\n got %s\nwant %s", topic, payload, want.payload)
+			}
+		} else if string(payload) != want.payload {
+			t.Errorf("%s: got %q, want %q", topic, payload, want.payload)
+		}
+	}
+
+	// Discovery configs, availability and the initial state on connecting
+	expect(published{"homeassistant/binary_sensor/ipcam_browser_front/alarm/config", `{
+		"name": "Alarm", "device_class": "motion",
+		"state_topic": "ipcam-browser/front/alarm", "payload_on": "ON", "payload_off": "OFF",
+		"json_attributes_topic": "ipcam-browser/front/last_alarm",
+		"unique_id": "ipcam_browser_front_alarm", "availability_topic": "ipcam-browser/status", ` + device + `}`, true})
+	expect(published{"homeassistant/image/ipcam_browser_front/snapshot/config", `{
+		"name": "Last alarm", "image_topic": "ipcam-browser/front/snapshot", "content_type": "image/jpeg",
+		"unique_id": "ipcam_browser_front_snapshot", "availability_topic": "ipcam-browser/status", ` + device + `}`, true})
+	expect(published{"ipcam-browser/status", mqttOnline, true})
+	expect(published{"ipcam-browser/front/alarm", mqttAlarmOff, true})
+
+	// A new alarm video publishes the image matched to it as the snapshot
+	var video MediaItem
+	for _, item := range cam.currentMedia(false) {
+		if item.Type == "video" {
+			video = item
+		}
+	}
+	if video.ThumbnailURL == "" {
+		t.Fatal("no thumbnail matched to the video")
+	}
+	p.handleChange(MediaChange{Type: ChangeAdded, Camera: cam.ID, DetectedAt: time.Now(), Item: video})
+
+	topic, event, retain := broker.nextPublish(t)
+	var msg MQTTMediaMessage
+	if err := json.Unmarshal(event, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if topic != "ipcam-browser/front/events" || retain || msg.Item.Path != video.Path || msg.Links.Thumbnail == "" {
+		t.Errorf("event on %s (retain %v): %s", topic, retain, event)
+	}
+	expect(published{"ipcam-browser/front/last_alarm", string(event), true})
+	expect(published{"ipcam-browser/front/snapshot", string(photo), true})
+	expect(published{"ipcam-browser/front/alarm", mqttAlarmOn, true})
+	expect(published{"ipcam-browser/front/alarm", mqttAlarmOff, true}) // after AlarmOffDelay
+
+	p.Stop()
+	expect(published{"ipcam-browser/status", mqttOffline, true})
+	if p := broker.next(t); p.header != mqttDisconnect {
+		t.Errorf("got packet 0x%02x after stopping, want DISCONNECT", p.header)
+	}
+}
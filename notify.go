@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyTimeout bounds a single request to a notification service
+const notifyTimeout = 15 * time.Second
+
+// defaultPushoverURL is Pushover's message API
+const defaultPushoverURL = "https://api.pushover.net/1/messages.json"
+
+// NotifierConfig holds the settings for one notification service and the
+// rules deciding which media it's told about
+type NotifierConfig struct {
+	ID       string
+	Provider string // "ntfy", "gotify" or "pushover"
+	URL      string // ntfy topic URL, Gotify server URL or Pushover API URL
+	Token    string // ntfy access token, Gotify app token or Pushover app token
+	User     string // Pushover user key
+	Priority *int   // provider-specific; the service's default if nil
+
+	Trigger    string   // "alarm", "periodic" or filterAny
+	Type       string   // "image", "video" or filterAny
+	Cameras    []string // camera IDs; all cameras if empty
+	QuietHours *quietHours
+	MinGap     time.Duration // per camera
+}
+
+// matches reports whether a notifier's rules select an item
+func (cfg NotifierConfig) matches(cam *Camera, item MediaItem) bool {
+	if cfg.Trigger != filterAny && cfg.Trigger != item.Trigger {
+		return false
+	}
+	if cfg.Type != filterAny && cfg.Type != item.Type {
+		return false
+	}
+	if len(cfg.Cameras) == 0 {
+		return true
+	}
+	for _, id := range cfg.Cameras {
+		if id == cam.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// quietHours is a daily window during which notifications are suppressed.
+// A window whose end is before its start spans midnight.
+type quietHours struct {
+	start, end int // minutes after midnight
+}
+
+// parseQuietHours parses a window such as "22:00-07:00"
+func parseQuietHours(value string) (*quietHours, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid quiet hours %q (expected HH:MM-HH:MM)", value)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours %q (expected HH:MM-HH:MM)", value)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours %q (expected HH:MM-HH:MM)", value)
+	}
+	return &quietHours{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+// contains reports whether t's time of day falls in the window
+func (q quietHours) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// loadNotifierConfigs reads notifier settings from the environment. If
+// NOTIFIERS is set (e.g. "phone,family"), each notifier is configured via
+// NOTIFY_<ID>_PROVIDER, NOTIFY_<ID>_URL, etc. Otherwise a single notifier is
+// configured from NOTIFY_PROVIDER, NOTIFY_URL, etc., if NOTIFY_PROVIDER is
+// set. The unprefixed settings are defaults for every notifier.
+func loadNotifierConfigs() ([]NotifierConfig, error) {
+	var ids []string
+	if list := getEnv("NOTIFIERS", ""); list != "" {
+		ids = strings.Split(list, ",")
+	} else if getEnv("NOTIFY_PROVIDER", "") != "" {
+		ids = []string{""}
+	}
+
+	var configs []NotifierConfig
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		id = strings.ToLower(strings.TrimSpace(id))
+		prefix := "NOTIFY_"
+		if id != "" {
+			if !cameraIDPattern.MatchString(id) {
+				return nil, fmt.Errorf("invalid notifier ID %q: must contain only a-z, 0-9, '-' and '_'", id)
+			}
+			if seen[id] {
+				return nil, fmt.Errorf("duplicate notifier ID %q", id)
+			}
+			seen[id] = true
+			prefix += strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		} else {
+			id = "default"
+		}
+
+		// Per-notifier settings fall back to the unprefixed ones
+		get := func(key, defaultValue string) string {
+			return getEnv(prefix+key, getEnv("NOTIFY_"+key, defaultValue))
+		}
+
+		cfg := NotifierConfig{
+			ID:       id,
+			Provider: strings.ToLower(get("PROVIDER", "")),
+			URL:      strings.TrimSuffix(get("URL", ""), "/"),
+			Token:    get("TOKEN", ""),
+			User:     get("USER", ""),
+			Trigger:  strings.ToLower(get("TRIGGER", "alarm")),
+			Type:     strings.ToLower(get("TYPE", "video")),
+		}
+		if value := get("PRIORITY", ""); value != "" {
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("notifier %s: invalid priority %q", id, value)
+			}
+			cfg.Priority = &priority
+		}
+		for _, cam := range strings.Split(get("CAMERAS", ""), ",") {
+			if cam = strings.ToLower(strings.TrimSpace(cam)); cam != "" {
+				cfg.Cameras = append(cfg.Cameras, cam)
+			}
+		}
+		if value := get("QUIET_HOURS", ""); value != "" {
+			quiet, err := parseQuietHours(value)
+			if err != nil {
+				return nil, fmt.Errorf("notifier %s: %w", id, err)
+			}
+			cfg.QuietHours = quiet
+		}
+		gap, err := strconv.Atoi(get("MIN_GAP_SECONDS", "300"))
+		if err != nil || gap < 0 {
+			return nil, fmt.Errorf("notifier %s: invalid minimum gap", id)
+		}
+		cfg.MinGap = time.Duration(gap) * time.Second
+
+		switch cfg.Provider {
+		case "ntfy", "gotify":
+			if cfg.URL == "" {
+				return nil, fmt.Errorf("notifier %s: no URL configured", id)
+			}
+		case "pushover":
+			if cfg.URL == "" {
+				cfg.URL = defaultPushoverURL
+			}
+			if cfg.Token == "" || cfg.User == "" {
+				return nil, fmt.Errorf("notifier %s: pushover needs a token and a user key", id)
+			}
+		default:
+			return nil, fmt.Errorf("notifier %s: invalid provider %q (expected ntfy, gotify or pushover)", id, cfg.Provider)
+		}
+		if cfg.Provider == "gotify" && cfg.Token == "" {
+			return nil, fmt.Errorf("notifier %s: gotify needs an app token", id)
+		}
+		switch cfg.Trigger {
+		case "alarm", "periodic", filterAny:
+		default:
+			return nil, fmt.Errorf("notifier %s: invalid trigger %q (expected alarm, periodic or any)", id, cfg.Trigger)
+		}
+		switch cfg.Type {
+		case "image", "video", filterAny:
+		default:
+			return nil, fmt.Errorf("notifier %s: invalid type %q (expected image, video or any)", id, cfg.Type)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// Notification is a message to push to a phone
+type Notification struct {
+	Title    string
+	Message  string
+	ClickURL string // opened when the notification is tapped
+	ImageURL string // absolute URL of the snapshot, for services that fetch it
+	Image    []byte // JPEG snapshot, nil if there is none
+}
+
+// Notifier sends notifications through a push notification service
+type Notifier interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// newNotifier returns the Notifier for a config's provider
+func newNotifier(cfg NotifierConfig, client *http.Client) Notifier {
+	switch cfg.Provider {
+	case "gotify":
+		return &GotifyNotifier{cfg: cfg, client: client}
+	case "pushover":
+		return &PushoverNotifier{cfg: cfg, client: client}
+	default:
+		return &NtfyNotifier{cfg: cfg, client: client}
+	}
+}
+
+// NtfyNotifier publishes to an ntfy topic, attaching the snapshot
+type NtfyNotifier struct {
+	cfg    NotifierConfig
+	client *http.Client
+}
+
+// Send implements Notifier
+func (n *NtfyNotifier) Send(ctx context.Context, notification Notification) error {
+	// With an attachment, the body is the file and the message goes in a header
+	body := []byte(notification.Message)
+	if notification.Image != nil {
+		body = notification.Image
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// ntfy decodes RFC 2047 encoded headers, allowing non-ASCII camera names
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", notification.Title))
+	if notification.Image != nil {
+		req.Header.Set("Message", mime.QEncoding.Encode("utf-8", notification.Message))
+		req.Header.Set("Filename", "snapshot.jpg")
+	}
+	if notification.ClickURL != "" {
+		req.Header.Set("Click", notification.ClickURL)
+	}
+	if n.cfg.Priority != nil {
+		req.Header.Set("Priority", strconv.Itoa(*n.cfg.Priority))
+	}
+	if n.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.cfg.Token)
+	}
+	return doNotifyRequest(n.client, req)
+}
+
+// GotifyNotifier posts a message to a Gotify server. Gotify can't take
+// attachments, so the snapshot is linked for the client to fetch.
+type GotifyNotifier struct {
+	cfg    NotifierConfig
+	client *http.Client
+}
+
+// Send implements Notifier
+func (n *GotifyNotifier) Send(ctx context.Context, notification Notification) error {
+	message := map[string]any{
+		"title":   notification.Title,
+		"message": notification.Message,
+	}
+	if n.cfg.Priority != nil {
+		message["priority"] = *n.cfg.Priority
+	}
+	extras := map[string]any{}
+	clientNotification := map[string]any{}
+	if notification.ClickURL != "" {
+		clientNotification["click"] = map[string]string{"url": notification.ClickURL}
+	}
+	if notification.ImageURL != "" {
+		clientNotification["bigImageUrl"] = notification.ImageURL
+	}
+	if len(clientNotification) > 0 {
+		extras["client::notification"] = clientNotification
+		message["extras"] = extras
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", n.cfg.Token)
+	return doNotifyRequest(n.client, req)
+}
+
+// PushoverNotifier sends a message through Pushover or a compatible API,
+// attaching the snapshot
+type PushoverNotifier struct {
+	cfg    NotifierConfig
+	client *http.Client
+}
+
+// Send implements Notifier
+func (n *PushoverNotifier) Send(ctx context.Context, notification Notification) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"token":   n.cfg.Token,
+		"user":    n.cfg.User,
+		"title":   notification.Title,
+		"message": notification.Message,
+	}
+	if notification.ClickURL != "" {
+		fields["url"] = notification.ClickURL
+		fields["url_title"] = "Open in ipcam-browser"
+	}
+	if n.cfg.Priority != nil {
+		fields["priority"] = strconv.Itoa(*n.cfg.Priority)
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	if notification.Image != nil {
+		part, err := form.CreatePart(map[string][]string{
+			"Content-Disposition": {`form-data; name="attachment"; filename="snapshot.jpg"`},
+			"Content-Type":        {"image/jpeg"},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(notification.Image); err != nil {
+			return err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return doNotifyRequest(n.client, req)
+}
+
+// doNotifyRequest sends a request to a notification service, returning an
+// error with the start of the response body for non-2xx responses
+func doNotifyRequest(client *http.Client, req *http.Request) error {
+	req.Header.Set("User-Agent", "ipcam-browser/"+version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// NotificationResult is the outcome of sending a notification through one
+// notifier
+type NotificationResult struct {
+	Notifier string `json:"notifier"`
+	Sent     bool   `json:"sent"`
+	Error    string `json:"error,omitempty"`
+}
+
+// configuredNotifier pairs a notifier with its config
+type configuredNotifier struct {
+	cfg      NotifierConfig
+	notifier Notifier
+}
+
+// NotificationDispatcher pushes notifications for new media from the change
+// feed, applying each notifier's routing rules
+type NotificationDispatcher struct {
+	notifiers []configuredNotifier
+	baseURL   string
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time // by notifier and camera ID
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewNotificationDispatcher creates a dispatcher for the given notifiers.
+// baseURL is the externally reachable URL of ipcam-browser, used for links.
+func NewNotificationDispatcher(configs []NotifierConfig, baseURL string) *NotificationDispatcher {
+	client := &http.Client{Timeout: notifyTimeout}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &NotificationDispatcher{
+		baseURL:  baseURL,
+		lastSent: make(map[string]time.Time),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for _, cfg := range configs {
+		d.notifiers = append(d.notifiers, configuredNotifier{cfg: cfg, notifier: newNotifier(cfg, client)})
+	}
+	return d
+}
+
+// Start begins following the change feed
+func (d *NotificationDispatcher) Start() {
+	log.Printf("Starting notifications with %d notifier(s)", len(d.notifiers))
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		changeFeed.Follow("Notifications", d.ctx.Done(), d.handleChange)
+	}()
+}
+
+// Stop stops following the change feed and cancels notifications in flight
+func (d *NotificationDispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+	log.Println("Notifications stopped")
+}
+
+// handleChange notifies each notifier whose rules select a new item
+func (d *NotificationDispatcher) handleChange(change MediaChange) {
+	if change.Type != ChangeAdded {
+		return
+	}
+	cam := lookupCamera(change.Camera)
+	if cam == nil {
+		return
+	}
+
+	var targets []configuredNotifier
+	for _, n := range d.notifiers {
+		if n.cfg.matches(cam, change.Item) && d.allow(n.cfg, cam, time.Now()) {
+			targets = append(targets, n)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	notification := d.notification(cam, change.Item)
+	for _, n := range targets {
+		d.wg.Add(1)
+		go func(n configuredNotifier) {
+			defer d.wg.Done()
+			if err := d.send(n, notification); err != nil {
+				log.Printf("Notifier %s: failed to notify about %s: %v", n.cfg.ID, change.Item.Path, err)
+			}
+		}(n)
+	}
+}
+
+// allow applies a notifier's quiet hours and minimum gap, recording the
+// notification as sent if it's allowed. Quiet hours are in the camera's
+// time zone.
+func (d *NotificationDispatcher) allow(cfg NotifierConfig, cam *Camera, now time.Time) bool {
+	if cfg.QuietHours != nil && cfg.QuietHours.contains(now.In(cam.location)) {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := cfg.ID + "/" + cam.ID
+	if last, ok := d.lastSent[key]; ok && now.Sub(last) < cfg.MinGap {
+		return false
+	}
+	d.lastSent[key] = now
+	return true
+}
+
+// notification builds the notification for an item, with the image matched
+// to it as the snapshot and a link to the MP4 for videos
+func (d *NotificationDispatcher) notification(cam *Camera, item MediaItem) Notification {
+	links := mediaLinks(cam, item, d.baseURL)
+	n := Notification{
+		Title:    cam.Name,
+		Message:  fmt.Sprintf("New %s %s: %s", item.Trigger, item.Type, item.Timestamp),
+		ClickURL: links.Media,
+		ImageURL: links.Thumbnail,
+	}
+	if item.Type == "image" {
+		n.ImageURL = links.Media
+	}
+
+	image, err := cam.snapshot(item)
+	if err != nil {
+		log.Printf("Notifications: failed to fetch snapshot for %s: %v", item.Path, err)
+	}
+	n.Image = image
+	return n
+}
+
+// send sends a notification through one notifier
+func (d *NotificationDispatcher) send(n configuredNotifier, notification Notification) error {
+	ctx, cancel := context.WithTimeout(d.ctx, notifyTimeout)
+	defer cancel()
+	return n.notifier.Send(ctx, notification)
+}
+
+// SendTest sends a sample notification through the given notifier, or all
+// notifiers if id is empty, ignoring their rules. The sample describes the
+// camera's most recent media matching each notifier's trigger and type, if
+// there is any.
+func (d *NotificationDispatcher) SendTest(id string, cam *Camera) ([]NotificationResult, error) {
+	var targets []configuredNotifier
+	for _, n := range d.notifiers {
+		if id == "" || n.cfg.ID == id {
+			targets = append(targets, n)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("unknown notifier %q", id)
+	}
+
+	media := cam.currentMedia(false)
+	results := make([]NotificationResult, len(targets))
+	var wg sync.WaitGroup
+	for i, n := range targets {
+		notification := Notification{
+			Title:   cam.Name,
+			Message: "Test notification from ipcam-browser",
+		}
+		var latest *MediaItem
+		for j := range media {
+			if n.cfg.matches(cam, media[j]) && (latest == nil || keyFor(media[j]).compare(keyFor(*latest)) > 0) {
+				latest = &media[j]
+			}
+		}
+		if latest != nil {
+			notification = d.notification(cam, *latest)
+			notification.Message = "Test: " + notification.Message
+		}
+
+		wg.Add(1)
+		go func(i int, n configuredNotifier) {
+			defer wg.Done()
+			results[i] = NotificationResult{Notifier: n.cfg.ID, Sent: true}
+			if err := d.send(n, notification); err != nil {
+				results[i].Sent = false
+				results[i].Error = err.Error()
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sort orders accepted by /api/media
+const (
+	SortAsc  = "asc"  // oldest first
+	SortDesc = "desc" // newest first
+)
+
+// MediaQuery holds the filters, sort order and page requested from /api/media
+type MediaQuery struct {
+	Date    string // YYYYMMDD date directory
+	Type    string
+	Trigger string
+	Sort    string
+	Limit   int // 0 for no limit
+	Cursor  *mediaKey
+	Bursts  bool // collapse image bursts into single items
+
+	Tags     []string // items must have all of these tags
+	Favorite bool     // only favorites
+
+	// The time window is either absolute (From/To) or a time of day
+	// (FromTOD/ToTOD, in seconds since midnight, -1 when unset)
+	From, To       time.Time
+	FromTOD, ToTOD int
+}
+
+// mediaKey is the position of an item in the sort order
+type mediaKey struct {
+	date, start, path string
+}
+
+// keyFor returns an item's sort key: its date directory, start time and path.
+// Start times are compared in UTC so that the hour repeated when clocks fall
+// back sorts in the order it was recorded.
+func keyFor(item MediaItem) mediaKey {
+	var start string
+	if item.Start != nil {
+		start = item.Start.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	return mediaKey{date: item.Date, start: start, path: item.Path}
+}
+
+// compare orders keys by date directory, then start time, then path
+func (k mediaKey) compare(other mediaKey) int {
+	for _, pair := range [][2]string{{k.date, other.date}, {k.start, other.start}, {k.path, other.path}} {
+		if c := strings.Compare(pair[0], pair[1]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// encode returns the key as an opaque cursor
+func (k mediaKey) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(k.date + "\x00" + k.start + "\x00" + k.path))
+}
+
+// decodeCursor parses a cursor returned in nextCursor
+func decodeCursor(cursor string) (*mediaKey, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.Split(string(data), "\x00")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &mediaKey{date: parts[0], start: parts[1], path: parts[2]}, nil
+}
+
+// parseMediaQuery reads the /api/media query parameters. Relative times in
+// from/to (e.g. "-2h") are resolved against now, and times without a zone
+// are in loc, the camera's time zone.
+func parseMediaQuery(values url.Values, now time.Time, loc *time.Location) (*MediaQuery, error) {
+	q := &MediaQuery{
+		Date:    strings.ReplaceAll(values.Get("date"), "-", ""),
+		Type:    values.Get("type"),
+		Trigger: values.Get("trigger"),
+		Sort:    values.Get("sort"),
+		Bursts:  values.Get("bursts") == "true",
+		FromTOD: -1,
+		ToTOD:   -1,
+
+		Tags:     parseTagParams(values),
+		Favorite: values.Get("favorite") == "true",
+	}
+
+	if q.Date != "" {
+		if _, err := time.Parse("20060102", q.Date); err != nil {
+			return nil, fmt.Errorf("invalid date %q (expected YYYY-MM-DD or YYYYMMDD)", values.Get("date"))
+		}
+	}
+
+	switch q.Type {
+	case "", "image", "video":
+	default:
+		return nil, fmt.Errorf("invalid type %q (expected image or video)", q.Type)
+	}
+
+	switch q.Trigger {
+	case "", "alarm", "periodic":
+	default:
+		return nil, fmt.Errorf("invalid trigger %q (expected alarm or periodic)", q.Trigger)
+	}
+
+	switch q.Sort {
+	case "":
+		q.Sort = SortAsc
+	case SortAsc, SortDesc:
+	default:
+		return nil, fmt.Errorf("invalid sort %q (expected asc or desc)", q.Sort)
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit %q", v)
+		}
+		q.Limit = limit
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		q.Cursor = cursor
+	}
+
+	var err error
+	if q.From, q.FromTOD, err = parseTimeBound(values.Get("from"), false, now, loc); err != nil {
+		return nil, fmt.Errorf("invalid from: %w", err)
+	}
+	if q.To, q.ToTOD, err = parseTimeBound(values.Get("to"), true, now, loc); err != nil {
+		return nil, fmt.Errorf("invalid to: %w", err)
+	}
+
+	return q, nil
+}
+
+// parseTagParams reads the repeatable tag query parameter
+func parseTagParams(values url.Values) []string {
+	var tags []string
+	for _, tag := range values["tag"] {
+		if tag = strings.Join(strings.Fields(tag), " "); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// timeBoundLayouts are the absolute time formats accepted in from/to.
+// Times without a zone are in the camera's time zone, like media timestamps.
+var timeBoundLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTimeBound parses a from/to value. It returns either an absolute time,
+// or a time of day in seconds since midnight for values like "21:30". Times
+// of day without seconds include the whole minute when used as an end bound.
+func parseTimeBound(value string, isEnd bool, now time.Time, loc *time.Location) (time.Time, int, error) {
+	if value == "" {
+		return time.Time{}, -1, nil
+	}
+
+	// Relative to now, e.g. "-2h"
+	if strings.HasPrefix(value, "-") {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return time.Time{}, -1, fmt.Errorf("invalid duration %q", value)
+		}
+		return now.Add(d), -1, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, -1, nil
+	}
+	for _, layout := range timeBoundLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			if isEnd && layout == "2006-01-02" {
+				// A bare end date includes the whole day, which isn't
+				// always 24 hours long
+				t = t.AddDate(0, 0, 1).Add(-time.Second)
+			}
+			return t, -1, nil
+		}
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 || len(parts) == 3 {
+		var hms [3]int
+		if isEnd {
+			hms[2] = 59
+		}
+		valid := true
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || (i == 0 && n > 23) || (i > 0 && n > 59) {
+				valid = false
+				break
+			}
+			hms[i] = n
+		}
+		if valid {
+			return time.Time{}, hms[0]*3600 + hms[1]*60 + hms[2], nil
+		}
+	}
+
+	return time.Time{}, -1, fmt.Errorf("unrecognized time %q (expected RFC 3339, YYYY-MM-DD[THH:MM[:SS]], HH:MM[:SS] or a negative duration like -2h)", value)
+}
+
+// matches reports whether an item passes the query's filters
+func (q *MediaQuery) matches(item MediaItem) bool {
+	if q.Date != "" && item.Date != q.Date {
+		return false
+	}
+	if q.Type != "" && item.Type != q.Type {
+		return false
+	}
+	if q.Trigger != "" && item.Trigger != q.Trigger {
+		return false
+	}
+	if !q.matchesAnnotation(item) {
+		return false
+	}
+	return q.matchesTime(mediaStartTime(item, time.Time{}))
+}
+
+// matchesAnnotation reports whether an item has the query's tags, and is a
+// favorite if only favorites were asked for
+func (q *MediaQuery) matchesAnnotation(item MediaItem) bool {
+	if q.Favorite && !item.Favorite {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !hasTag(item.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTimeWindow reports whether the query restricts start times
+func (q *MediaQuery) hasTimeWindow() bool {
+	return !q.From.IsZero() || !q.To.IsZero() || q.FromTOD >= 0 || q.ToTOD >= 0
+}
+
+// matchesTime reports whether a start time falls within the query's time
+// window. The zero time, for media without a parseable timestamp, only
+// matches when there is no window.
+func (q *MediaQuery) matchesTime(start time.Time) bool {
+	if !q.hasTimeWindow() {
+		return true
+	}
+	if start.IsZero() {
+		return false
+	}
+	if !q.From.IsZero() && start.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && start.After(q.To) {
+		return false
+	}
+
+	tod := start.Hour()*3600 + start.Minute()*60 + start.Second()
+	if q.FromTOD >= 0 && q.ToTOD >= 0 && q.FromTOD > q.ToTOD {
+		// The window wraps around midnight, e.g. 22:00 to 06:00
+		return tod >= q.FromTOD || tod <= q.ToTOD
+	}
+	if q.FromTOD >= 0 && tod < q.FromTOD {
+		return false
+	}
+	if q.ToTOD >= 0 && tod > q.ToTOD {
+		return false
+	}
+	return true
+}
+
+// MediaPage is one page of media matching a MediaQuery
+type MediaPage struct {
+	Items      []MediaItem
+	Total      int            // matching items across all pages
+	Counts     map[string]int // matching items by type
+	NextCursor string         // empty on the last page
+}
+
+// Apply filters, sorts and paginates items
+func (q *MediaQuery) Apply(items []MediaItem) MediaPage {
+	page := MediaPage{Counts: map[string]int{"image": 0, "video": 0}}
+
+	var matched []MediaItem
+	for _, item := range items {
+		if q.matches(item) {
+			matched = append(matched, item)
+		}
+	}
+	if q.Bursts {
+		matched = groupBursts(matched)
+	}
+	for _, item := range matched {
+		page.Counts[item.Type]++
+	}
+	page.Total = len(matched)
+
+	page.Items, page.NextCursor = paginate(q, matched, keyFor)
+	if page.Items == nil {
+		page.Items = []MediaItem{}
+	}
+	return page
+}
+
+// paginate sorts values by key in the query's sort order and returns the
+// page after the query's cursor, along with the cursor for the next page
+func paginate[T any](q *MediaQuery, values []T, key func(T) mediaKey) ([]T, string) {
+	desc := q.Sort == SortDesc
+	sort.SliceStable(values, func(i, j int) bool {
+		c := key(values[i]).compare(key(values[j]))
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	if q.Cursor != nil {
+		// Skip everything up to and including the cursor's position
+		start := sort.Search(len(values), func(i int) bool {
+			c := key(values[i]).compare(*q.Cursor)
+			if desc {
+				return c < 0
+			}
+			return c > 0
+		})
+		values = values[start:]
+	}
+
+	if q.Limit > 0 && len(values) > q.Limit {
+		values = values[:q.Limit]
+		return values, key(values[len(values)-1]).encode()
+	}
+	return values, ""
+}
+
+// mediaDates returns the distinct date directories of items, in ascending order
+func mediaDates(items []MediaItem) []string {
+	seen := make(map[string]bool)
+	dates := []string{}
+	for _, item := range items {
+		if !seen[item.Date] {
+			seen[item.Date] = true
+			dates = append(dates, item.Date)
+		}
+	}
+	sort.Strings(dates)
+	return dates
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Video remuxing engines, selected via REMUX_ENGINE
+const (
+	RemuxEngineNative = "native" // built-in MP4 muxer, which can't convert the audio
+	RemuxEngineFFmpeg = "ffmpeg"
+)
+
+// loadRemuxEngine reads REMUX_ENGINE. By default ffmpeg is used if it's
+// installed, as only ffmpeg can convert the camera's audio for browsers.
+func loadRemuxEngine() (string, error) {
+	engine := strings.ToLower(getEnv("REMUX_ENGINE", ""))
+	switch engine {
+	case "":
+		if !ffmpegInstalled() {
+			return RemuxEngineNative, nil
+		}
+		return RemuxEngineFFmpeg, nil
+	case RemuxEngineNative, RemuxEngineFFmpeg:
+		return engine, nil
+	}
+	return "", fmt.Errorf("REMUX_ENGINE must be native or ffmpeg, not %q", engine)
+}
+
+// ffmpegInstalled reports whether ffmpeg is in the PATH
+func ffmpegInstalled() bool {
+	_, err := exec.LookPath("ffmpeg")
+	return err == nil
+}
+
+// remuxNative converts a recording's video to MP4 with the built-in muxer,
+// reading it from the spool a frame or NAL unit at a time, and returns how
+// its frames were timed. A recording with per-frame timestamps keeps them; a
+// bare stream is timed by its filename once its frames have been counted.
+func (cam *Camera) remuxNative(sourceURL, destPath string, clip *spooledRecording, timing VideoTiming, timed bool) (VideoTiming, error) {
+	if err := clip.rewindVideo(); err != nil {
+		return timing, err
+	}
+	// The movie header goes first but lists every sample's size, so the
+	// samples are held in a spool until they've all been seen
+	spool, err := os.CreateTemp(clip.dir, "temp-mdat-*")
+	if err != nil {
+		return timing, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(spool.Name())
+	}()
+	defer spool.Close()
+
+	mux, err := newMP4Muxer(clip.codec, spool)
+	if err != nil {
+		return timing, err
+	}
+	builder := newAccessUnitBuilder(clip.codec, mux.WriteSample)
+	if timing.times != nil {
+		err = clip.hxvs.readVideoFrames(clip.video, func(i int, frame HXVSFrame) error {
+			for _, nal := range splitNALUnits(frame.Data) {
+				if err := builder.Push(nal, timing.times[i]*mp4Timescale/1000); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return timing, err
+		}
+	} else {
+		nals := newNALReader(clip.video)
+		for {
+			nal, err := nals.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return timing, fmt.Errorf("failed to read video: %w", err)
+			}
+			if err := builder.Push(nal, 0); err != nil {
+				return timing, err
+			}
+		}
+	}
+	if err := builder.Flush(); err != nil {
+		return timing, err
+	}
+	if mux.dropped > 0 {
+		log.Printf("Dropped %d frames before the first keyframe of %s", mux.dropped, sourceURL)
+	}
+
+	if !timed {
+		var ok bool
+		if timing, ok = cam.durationTiming(sourceURL, mux.SampleCount()); !ok {
+			timing = VideoTiming{Source: TimingDefault, FPS: defaultFPS}
+		}
+	}
+	fps := 0.0
+	if timing.times == nil {
+		fps = timing.FPS
+	}
+
+	out, err := os.Create(destPath)
+	if err != nil {
+		return timing, err
+	}
+	if err := mux.Finish(out, fps); err != nil {
+		out.Close()
+		return timing, err
+	}
+	return timing, out.Close()
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Media source types, selected via CAMERA_SOURCE
+const (
+	SourceHTTP  = "http"  // crawl the camera's SD card web pages
+	SourceLocal = "local" // read a mounted or copied SD card from disk
+	SourceFTP   = "ftp"   // read the files the camera uploaded to the FTP receiver
+)
+
+// MediaSource provides the dates and media files recorded by a camera.
+// Paths are relative to the root of the SD card, e.g.
+// "20251121/images000/A25112121235600.jpg".
+type MediaSource interface {
+	// URL returns the absolute URL identifying a path within this source.
+	// It's used as MediaItem.URL and as the media cache key.
+	URL(path string) string
+	// ListDates lists the date directories
+	ListDates() ([]DirectoryEntry, error)
+	// ListMedia lists the files in the image and video directories of a date
+	ListMedia(datePath string) ([]DirectoryEntry, error)
+	// Open opens a media file for reading
+	Open(path string) (io.ReadCloser, error)
+}
+
+// mediaDirPattern matches the per-date image and video directories,
+// e.g. images000 and record000
+var mediaDirPattern = regexp.MustCompile(`^(images|record)\d{3}$`)
+
+// dateDirPattern matches the YYYYMMDD date directories at the root of the SD card
+var dateDirPattern = regexp.MustCompile(`^\d{8}$`)
+
+// mediaTypeForName returns "image" or "video" based on a file's extension,
+// or "" if it isn't a media file
+func mediaTypeForName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".jpg"):
+		return "image"
+	case strings.HasSuffix(name, ".264"), strings.HasSuffix(name, ".265"):
+		return "video"
+	default:
+		return ""
+	}
+}
+
+// sourcePath returns the path within src that targetURL refers to, or false
+// if the URL doesn't belong to src or escapes its root
+func sourcePath(src MediaSource, targetURL string) (string, bool) {
+	base := src.URL("")
+	if !strings.HasPrefix(targetURL, base) {
+		return "", false
+	}
+	p := strings.TrimPrefix(targetURL, base)
+	if p == "" || path.IsAbs(p) || strings.HasPrefix(path.Clean(p), "..") {
+		return "", false
+	}
+	return p, true
+}
+
+// HTTPSource crawls a camera's SD card web pages
+type HTTPSource struct {
+	baseURL string
+	client  *http.Client    // applies the camera's auth scheme to every request
+	parser  DirectoryParser // nil to detect the listing format per response
+	loc     *time.Location  // the camera's time zone
+}
+
+// NewHTTPSource creates a source for the SD card pages at baseURL
+func NewHTTPSource(baseURL string, client *http.Client, parser DirectoryParser, loc *time.Location) *HTTPSource {
+	return &HTTPSource{
+		baseURL: baseURL,
+		client:  client,
+		parser:  parser,
+		loc:     loc,
+	}
+}
+
+// URL implements MediaSource
+func (s *HTTPSource) URL(path string) string {
+	return s.baseURL + "/" + path
+}
+
+// ListDates implements MediaSource
+func (s *HTTPSource) ListDates() ([]DirectoryEntry, error) {
+	entries, err := s.fetchDirectory("")
+	if err != nil {
+		return nil, err
+	}
+
+	var dates []DirectoryEntry
+	for _, entry := range entries {
+		if entry.IsDirectory {
+			dates = append(dates, entry)
+		}
+	}
+	return dates, nil
+}
+
+// ListMedia implements MediaSource
+func (s *HTTPSource) ListMedia(datePath string) ([]DirectoryEntry, error) {
+	entries, err := s.fetchDirectory(datePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []DirectoryEntry
+	for _, entry := range entries {
+		if !entry.IsDirectory || !mediaDirPattern.MatchString(strings.TrimSuffix(entry.Name, "/")) {
+			continue
+		}
+
+		dirEntries, err := s.fetchDirectory(entry.Path)
+		if err != nil {
+			log.Printf("Warning: failed to fetch %s: %v", entry.Path, err)
+			continue
+		}
+		for _, f := range dirEntries {
+			if !f.IsDirectory {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// Open implements MediaSource
+func (s *HTTPSource) Open(path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.URL(path), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from camera: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("camera returned status %d", resp.StatusCode)
+	}
+
+	return resp.Body, nil
+}
+
+func (s *HTTPSource) fetchDirectory(path string) ([]DirectoryEntry, error) {
+	url := s.URL(path)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := s.parser
+	if parser == nil {
+		parser = detectDirectoryParser(resp.Header.Get("Content-Type"), body)
+	}
+	entries, err := parser.Parse(body, path, s.loc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s listing: %w", parser.Name(), err)
+	}
+	return entries, nil
+}
+
+// LocalSource reads a camera's SD card from a local directory, such as a
+// mounted card or a copy of one, laid out as YYYYMMDD/images000 and YYYYMMDD/record000
+type LocalSource struct {
+	root string
+}
+
+// NewLocalSource creates a source for the SD card contents under root
+func NewLocalSource(root string) (*LocalSource, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", abs)
+	}
+	return &LocalSource{root: abs}, nil
+}
+
+// URL implements MediaSource
+func (s *LocalSource) URL(path string) string {
+	return "file://" + filepath.ToSlash(s.root) + "/" + path
+}
+
+// ListDates implements MediaSource
+func (s *LocalSource) ListDates() ([]DirectoryEntry, error) {
+	entries, err := s.readDir("")
+	if err != nil {
+		return nil, err
+	}
+
+	var dates []DirectoryEntry
+	for _, entry := range entries {
+		if entry.IsDirectory && dateDirPattern.MatchString(strings.TrimSuffix(entry.Name, "/")) {
+			dates = append(dates, entry)
+		}
+	}
+	return dates, nil
+}
+
+// ListMedia implements MediaSource
+func (s *LocalSource) ListMedia(datePath string) ([]DirectoryEntry, error) {
+	entries, err := s.readDir(datePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []DirectoryEntry
+	for _, entry := range entries {
+		if !entry.IsDirectory || !mediaDirPattern.MatchString(strings.TrimSuffix(entry.Name, "/")) {
+			continue
+		}
+
+		dirEntries, err := s.readDir(entry.Path)
+		if err != nil {
+			log.Printf("Warning: failed to read %s: %v", entry.Path, err)
+			continue
+		}
+		for _, f := range dirEntries {
+			if !f.IsDirectory {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
+
+// Open implements MediaSource
+func (s *LocalSource) Open(path string) (io.ReadCloser, error) {
+	return os.Open(s.fsPath(path))
+}
+
+// fsPath maps an SD card path to a filesystem path. Cleaning the path
+// against "/" keeps ".." elements from escaping the root.
+func (s *LocalSource) fsPath(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// readDir lists a directory using the same conventions as the camera's
+// web pages: directory names end in "/" and paths are relative to the root.
+// Directories are listed by name and files in the order they were written,
+// which tells apart recordings made in the hour repeated when clocks fall back.
+func (s *LocalSource) readDir(dirPath string) ([]DirectoryEntry, error) {
+	dirEntries, err := os.ReadDir(s.fsPath(dirPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []DirectoryEntry
+	modTimes := make(map[string]time.Time)
+	for _, d := range dirEntries {
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+
+		name := d.Name()
+		size := "-"
+		if d.IsDir() {
+			name += "/"
+		} else {
+			size = formatSize(info.Size())
+		}
+		entries = append(entries, newListingEntry(name, dirPath, info.ModTime().Format("2006-01-02 15:04:05"), size))
+		modTimes[name] = info.ModTime()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDirectory != b.IsDirectory {
+			return a.IsDirectory
+		}
+		if !a.IsDirectory && !modTimes[a.Name].Equal(modTimes[b.Name]) {
+			return modTimes[a.Name].Before(modTimes[b.Name])
+		}
+		return a.Name < b.Name
+	})
+	return entries, nil
+}
+
+// formatSize formats a byte count the way camera listings do, e.g. "245K" or "1.8M"
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%dK", n>>10)
+	default:
+		return fmt.Sprintf("%d", n)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// spooledRecording is a recording downloaded from the camera with its video
+// and audio separated into temp files in the camera's cache directory. The
+// whole recording has to be on hand before remuxing: its frames are timed
+// from all of their timestamps, and ffmpeg reads the audio as a second input.
+type spooledRecording struct {
+	hxvs  *HXVSRecording // nil for a bare video stream
+	codec string         // ffmpeg input format: "h264" or "hevc"
+	dir   string         // where the spool files are created
+	video *os.File
+	audio *os.File // nil if there's no audio, or it's dropped
+}
+
+// spoolRecording downloads a recording from the camera, demuxing it as it
+// arrives, so only one frame at a time is held in memory however long the
+// clip is. The camera request slot is released once the download finishes.
+func (cam *Camera) spoolRecording(sourceURL string) (*spooledRecording, error) {
+	body, err := cam.openFromCamera(sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch video: %w", err)
+	}
+	defer body.Close()
+
+	input := bufio.NewReaderSize(body, 64*1024)
+	demux, err := newHXVSReader(input)
+	clip := &spooledRecording{dir: cam.cache.dir}
+	switch {
+	case err == nil:
+		clip.hxvs, clip.codec = demux.rec, demux.rec.Codec
+	case errors.Is(err, errNotHXVS):
+		log.Printf("%s has no HXVS header, treating it as a raw video stream", sourceURL)
+		// Without a header to say otherwise, determine input format based on file extension
+		clip.codec = "h264"
+		if strings.HasSuffix(sourceURL, ".265") {
+			clip.codec = "hevc"
+		}
+	default:
+		return nil, fmt.Errorf("failed to parse recording: %w", err)
+	}
+
+	clip.video, err = os.CreateTemp(clip.dir, "temp-video-*."+clip.codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	if demux == nil {
+		if _, err := io.Copy(clip.video, input); err != nil {
+			clip.Close()
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		return clip, nil
+	}
+
+	if err := clip.demux(demux, cam.AudioFormat); err != nil {
+		clip.Close()
+		return nil, err
+	}
+	rec := clip.hxvs
+	videoFrames, keyframes, audioFrames := rec.Counts()
+	log.Printf("Parsed %s: %s %dx%d, %d video frames (%d keyframes), %d audio frames",
+		sourceURL, rec.Codec, rec.Width, rec.Height, videoFrames, keyframes, audioFrames)
+	if len(rec.Problems) > 0 {
+		log.Printf("Recording %s is damaged, skipped %d bytes: %s",
+			sourceURL, rec.Skipped, strings.Join(rec.Problems, "; "))
+	}
+	if videoFrames == 0 {
+		clip.Close()
+		return nil, fmt.Errorf("recording has no video frames")
+	}
+	return clip, nil
+}
+
+// demux writes the video frames of an HXVS recording to the video spool and,
+// unless audioFormat is off, the G.711 audio to an audio spool
+func (clip *spooledRecording) demux(demux *hxvsReader, audioFormat string) error {
+	video := bufio.NewWriter(clip.video)
+	var audio *bufio.Writer
+	for {
+		frame, err := demux.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read recording: %w", err)
+		}
+
+		if !frame.Audio {
+			if _, err := video.Write(frame.Data); err != nil {
+				return fmt.Errorf("failed to write video: %w", err)
+			}
+			continue
+		}
+		if audioFormat == AudioFormatOff {
+			continue
+		}
+		if audio == nil {
+			if clip.audio, err = os.CreateTemp(clip.dir, "temp-audio-*."+audioFormat); err != nil {
+				return fmt.Errorf("failed to create temp file: %w", err)
+			}
+			audio = bufio.NewWriter(clip.audio)
+		}
+		if _, err := audio.Write(g711Payload(frame.Data)); err != nil {
+			return fmt.Errorf("failed to write audio: %w", err)
+		}
+	}
+
+	if err := video.Flush(); err != nil {
+		return fmt.Errorf("failed to write video: %w", err)
+	}
+	if audio != nil {
+		if err := audio.Flush(); err != nil {
+			return fmt.Errorf("failed to write audio: %w", err)
+		}
+	}
+	return nil
+}
+
+// pipeTimedVideo runs cmd, streaming the video to its stdin as a transport
+// stream timed by times
+func (clip *spooledRecording) pipeTimedVideo(cmd *exec.Cmd, times []int64) error {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	writeErr := writeTimedVideo(stdin, clip.codec, clip.hxvs, clip.video, times)
+	stdin.Close()
+	// If ffmpeg exits early, its error explains the failed write
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return fmt.Errorf("failed to write video: %w", writeErr)
+	}
+	return nil
+}
+
+// rewindVideo positions the video spool at its start, to be read again
+func (clip *spooledRecording) rewindVideo() error {
+	if _, err := clip.video.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind video: %w", err)
+	}
+	return nil
+}
+
+// Close removes the spool files
+func (clip *spooledRecording) Close() {
+	for _, f := range []*os.File{clip.video, clip.audio} {
+		if f != nil {
+			f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// generatedRecording produces an HXVS recording of any length from one
+// video and one audio frame, without holding it in memory or allocating
+type generatedRecording struct {
+	header       []byte
+	video, audio []byte // frames with headers, timestamps rewritten per frame
+	frames       int    // video frames, each followed by an audio frame
+	n            int    // frames produced so far, audio included
+	pending      []byte // rest of the frame being read
+}
+
+func (g *generatedRecording) Read(p []byte) (int, error) {
+	if len(g.header) > 0 {
+		n := copy(p, g.header)
+		g.header = g.header[n:]
+		return n, nil
+	}
+	if len(g.pending) == 0 {
+		if g.n == 2*g.frames {
+			return 0, io.EOF
+		}
+		g.pending = g.video
+		if g.n%2 == 1 {
+			g.pending = g.audio
+		}
+		binary.LittleEndian.PutUint32(g.pending[8:], uint32(1000+g.n*25))
+		g.n++
+	}
+	n := copy(p, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
+
+func TestSpoolDemuxMemory(t *testing.T) {
+	const frames = 1500
+	payload := make([]byte, 40*1024)
+	copy(payload, testPFrame)
+	for i := len(testPFrame); i < len(payload); i++ {
+		payload[i] = byte(i % 251)
+	}
+	recording := &generatedRecording{
+		header: hxvsFileHeader(hxvsTagH264, 1920, 1080),
+		video:  hxvsFrame(hxvsTagVideo, 0, false, payload),
+		audio:  hxvsFrame(hxvsTagAudio, 0, false, testAudio),
+		frames: frames,
+	}
+	size := frames * (len(recording.video) + len(recording.audio))
+
+	dir := t.TempDir()
+	video, err := os.CreateTemp(dir, "temp-video-*.h264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clip := &spooledRecording{codec: "h264", dir: dir, video: video}
+	defer clip.Close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	demux, err := newHXVSReader(bufio.NewReaderSize(recording, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clip.demux(demux, AudioFormatALaw); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+
+	// Demuxing allocates a frame buffer and the frame index, not the
+	// recording. Everything allocated is counted, so this bounds the peak.
+	allocated := after.TotalAlloc - before.TotalAlloc
+	t.Logf("demuxed %d MB, allocating %d KB", size>>20, allocated>>10)
+	if allocated > uint64(size/16) {
+		t.Errorf("demuxing %d bytes allocated %d bytes", size, allocated)
+	}
+
+	if videoFrames, _, audioFrames := demux.rec.Counts(); videoFrames != frames || audioFrames != frames {
+		t.Errorf("counted %d video and %d audio frames, want %d of each", videoFrames, audioFrames, frames)
+	}
+	if err := clip.rewindVideo(); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(clip.video)
+	got := make([]byte, len(payload))
+	for i := 0; i < frames; i++ {
+		if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("video frame %d spooled wrongly: %v", i, err)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Error("video spool longer than the video frames")
+	}
+
+	if clip.audio == nil {
+		t.Fatal("no audio spooled")
+	}
+	info, err := clip.audio.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(frames * len(g711Payload(testAudio))); info.Size() != want {
+		t.Errorf("audio spool is %d bytes, want %d", info.Size(), want)
+	}
+}
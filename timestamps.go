@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filename timestamp patterns. Images are named like A25112121235600.jpg
+// (YYMMDDHHMMSS plus a two-digit sequence number) and videos like
+// A251121_212356_212410.264 (date, start time and end time).
+var (
+	imageNamePattern = regexp.MustCompile(`[AP](\d{2})(\d{2})(\d{2})(\d{2})(\d{2})(\d{2})(\d{2})?`)
+	videoNamePattern = regexp.MustCompile(`[AP](\d{2})(\d{2})(\d{2})_(\d{2})(\d{2})(\d{2})_(\d{2})(\d{2})(\d{2})`)
+)
+
+// parseMediaTimes extracts the start and end times encoded in a media
+// filename, interpreting them in the camera's time zone. Images have no end
+// time. A video whose end time is earlier than its start time either spans
+// the clocks falling back or crossed midnight, ending on the following day.
+func parseMediaTimes(name string, mediaType string, loc *time.Location) (start, end time.Time, ok bool) {
+	if mediaType == "image" {
+		m := imageNamePattern.FindStringSubmatch(name)
+		if m == nil {
+			return time.Time{}, time.Time{}, false
+		}
+		start, ok = filenameTime(m[1], m[2], m[3], m[4], m[5], m[6], loc)
+		return start, time.Time{}, ok
+	}
+
+	m := videoNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	start, ok = filenameTime(m[1], m[2], m[3], m[4], m[5], m[6], loc)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	end, ok = filenameTime(m[1], m[2], m[3], m[7], m[8], m[9], loc)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	if end.Before(start) {
+		if _, late, ok := fallBackTimes(end); ok && !late.Before(start) {
+			end = late
+		} else {
+			y, mo, d := end.Date()
+			end = time.Date(y, mo, d+1, end.Hour(), end.Minute(), end.Second(), 0, loc)
+		}
+	}
+	return start, end, true
+}
+
+// fallBackTimes reports whether t's wall-clock time occurs twice in its
+// location because the clocks were set back, returning the instant before
+// the change (early) and the one after it (late)
+func fallBackTimes(t time.Time) (early, late time.Time, ok bool) {
+	_, before := t.Add(-12 * time.Hour).Zone()
+	_, after := t.Add(12 * time.Hour).Zone()
+	if before <= after {
+		return t, t, false
+	}
+
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	early = wall.Add(-time.Duration(before) * time.Second).In(t.Location())
+	late = wall.Add(-time.Duration(after) * time.Second).In(t.Location())
+	if !sameWallClock(early, t) || !sameWallClock(late, t) {
+		return t, t, false
+	}
+	return early, late, true
+}
+
+// sameWallClock reports whether a and b show the same date and time of day
+func sameWallClock(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd &&
+		a.Hour() == b.Hour() && a.Minute() == b.Minute() && a.Second() == b.Second()
+}
+
+// resolveFallBack settles the start times of media recorded during the hour
+// that repeats when clocks fall back, which filenames alone can't tell apart.
+// media must be in listing order: cameras list each directory in the order
+// files were written, so once the wall-clock times within the repeated hour
+// go backwards, the rest of that directory's repeated-hour media was
+// recorded after the change.
+func resolveFallBack(media []MediaItem) {
+	last := make(map[string]time.Time) // directory -> previous repeated-hour start
+	fellBack := make(map[string]bool)
+
+	for i := range media {
+		item := &media[i]
+		if item.Start == nil {
+			continue
+		}
+		early, late, ok := fallBackTimes(*item.Start)
+		if !ok {
+			continue
+		}
+
+		dir := path.Dir(item.Path)
+		if prev, seen := last[dir]; seen && early.Before(prev) {
+			fellBack[dir] = true
+		}
+		last[dir] = early
+
+		start := early
+		if fellBack[dir] {
+			start = late
+		}
+		setStartTime(item, start)
+	}
+}
+
+// setStartTime moves an item's start time to another instant with the same
+// wall-clock time, keeping its end time on or after the new start
+func setStartTime(item *MediaItem, start time.Time) {
+	item.Start = &start
+	if item.End == nil {
+		return
+	}
+
+	end := *item.End
+	if early, late, ok := fallBackTimes(end); ok {
+		end = early
+		if end.Before(start) {
+			end = late
+		}
+	}
+	item.End = &end
+	item.DurationSeconds = int(end.Sub(start).Seconds())
+}
+
+// parseImageSequence extracts the sequence number that follows the
+// timestamp in an image filename, numbering the frames of a burst taken
+// within the same second
+func parseImageSequence(name string) (int, bool) {
+	m := imageNamePattern.FindStringSubmatch(name)
+	if m == nil || m[7] == "" {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(m[7])
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+// filenameTime builds a time from the two-digit fields of a filename
+// timestamp, rejecting out-of-range values rather than normalizing them
+func filenameTime(yy, mo, dd, hh, mi, ss string, loc *time.Location) (time.Time, bool) {
+	t, err := time.ParseInLocation("060102150405", yy+mo+dd+hh+mi+ss, loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// sizePattern matches the sizes printed in camera listings, such as
+// "245K", "1.8M", "1.2 MB", "512KiB" or a plain byte count
+var sizePattern = regexp.MustCompile(`(?i)^([0-9][0-9.,]*)\s*([KMGT]?)(I?B)?$`)
+
+// parseSizeBytes converts a listing's size text to bytes. Listings use
+// binary multiples, so "1K" is 1024 bytes. It returns false for sizes it
+// can't interpret, such as the "-" shown for directories.
+func parseSizeBytes(size string) (int64, bool) {
+	m := sizePattern.FindStringSubmatch(strings.TrimSpace(size))
+	if m == nil {
+		return 0, false
+	}
+
+	n, err := strconv.ParseFloat(strings.ReplaceAll(m[1], ",", ""), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	switch strings.ToUpper(m[2]) {
+	case "K":
+		n *= 1 << 10
+	case "M":
+		n *= 1 << 20
+	case "G":
+		n *= 1 << 30
+	case "T":
+		n *= 1 << 40
+	}
+	return int64(math.Round(n)), true
+}
+
+// setMediaTimes fills in an item's structured start, end and duration from
+// its filename, along with the display Timestamp kept for compatibility
+func setMediaTimes(item *MediaItem, loc *time.Location) {
+	start, end, ok := parseMediaTimes(item.Name, item.Type, loc)
+	if !ok {
+		return
+	}
+
+	item.Start = &start
+	if item.Type != "video" {
+		item.Timestamp = start.Format("2006-01-02 15:04:05")
+		return
+	}
+
+	item.End = &end
+	item.DurationSeconds = int(end.Sub(start).Seconds())
+	item.Timestamp = fmt.Sprintf("%s - %s", start.Format("2006-01-02 15:04:05"), end.Format("15:04:05"))
+}
+
+// loadCameraLocation returns the time zone for an IANA name such as
+// "America/New_York", or the server's local time zone if name is empty
+func loadCameraLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// locationID identifies a time zone, to notice when it changes. The
+// server's local zone is always named "Local", so it's identified by what it
+// resolves to: TZ, the /etc/localtime link or, failing those, its UTC
+// offsets over a span of years.
+func locationID(loc *time.Location) string {
+	if loc != time.Local {
+		return loc.String()
+	}
+	if tz, ok := os.LookupEnv("TZ"); ok {
+		if tz = strings.TrimPrefix(tz, ":"); tz == "" {
+			return "UTC"
+		}
+		return tz
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok {
+			return name
+		}
+	}
+	var id strings.Builder
+	id.WriteString("Local")
+	for year := 2020; year <= 2035; year++ {
+		for _, month := range []time.Month{time.January, time.July} {
+			_, offset := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).In(loc).Zone()
+			fmt.Fprintf(&id, " %d", offset)
+		}
+	}
+	return id.String()
+}
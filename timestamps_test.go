@@ -0,0 +1,230 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newYork is where the DST tests take place. Clocks fell back from 02:00
+// EDT to 01:00 EST on 2025-11-02 and sprang forward from 02:00 EST to 03:00
+// EDT on 2025-03-09.
+func newYork(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	return loc
+}
+
+// utc parses an RFC 3339 time, for writing instants unambiguously
+func utc(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+// formatUTC formats an optional time for comparing with utc strings
+func formatUTC(tm *time.Time) string {
+	if tm == nil {
+		return ""
+	}
+	return tm.UTC().Format(time.RFC3339)
+}
+
+// testMediaItem builds an item for a camera file path, with its times
+// parsed from the filename
+func testMediaItem(p string, loc *time.Location) MediaItem {
+	item := MediaItem{Name: path.Base(p), Path: p, Type: "image"}
+	if strings.HasSuffix(p, ".264") {
+		item.Type = "video"
+	}
+	setMediaTimes(&item, loc)
+	return item
+}
+
+func TestFallBackTimes(t *testing.T) {
+	ny := newYork(t)
+	tests := []struct {
+		name        string
+		t           string // UTC
+		loc         *time.Location
+		early, late string // UTC, empty if the time doesn't repeat
+	}{
+		{"start of the first 1:00", "2025-11-02T05:00:00Z", ny, "2025-11-02T05:00:00Z", "2025-11-02T06:00:00Z"},
+		{"first 1:30", "2025-11-02T05:30:00Z", ny, "2025-11-02T05:30:00Z", "2025-11-02T06:30:00Z"},
+		{"second 1:30", "2025-11-02T06:30:00Z", ny, "2025-11-02T05:30:00Z", "2025-11-02T06:30:00Z"},
+		{"end of the second 1:00", "2025-11-02T06:59:59Z", ny, "2025-11-02T05:59:59Z", "2025-11-02T06:59:59Z"},
+		{"just before the repeated hour", "2025-11-02T04:59:59Z", ny, "", ""},
+		{"2:00 after the change", "2025-11-02T07:00:00Z", ny, "", ""},
+		{"1:30 the day before", "2025-11-01T05:30:00Z", ny, "", ""},
+		{"1:30 before springing forward", "2025-03-09T06:30:00Z", ny, "", ""},
+		{"3:30 after springing forward", "2025-03-09T07:30:00Z", ny, "", ""},
+		{"UTC", "2025-11-02T05:30:00Z", time.UTC, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			early, late, ok := fallBackTimes(utc(t, tt.t).In(tt.loc))
+			if tt.early == "" {
+				if ok {
+					t.Errorf("got %v and %v, want no repeat", early, late)
+				}
+				return
+			}
+			if !ok || formatUTC(&early) != tt.early || formatUTC(&late) != tt.late {
+				t.Errorf("got %s, %s, %v, want %s, %s", formatUTC(&early), formatUTC(&late), ok, tt.early, tt.late)
+			}
+		})
+	}
+}
+
+func TestParseMediaTimesDST(t *testing.T) {
+	ny := newYork(t)
+	tests := []struct {
+		name       string
+		path       string
+		start, end string // UTC
+		duration   int
+	}{
+		{
+			name:  "midnight",
+			path:  "20251121/record000/A251121_235950_000020.264",
+			start: "2025-11-22T04:59:50Z", end: "2025-11-22T05:00:20Z", duration: 30,
+		},
+		{
+			name:  "midnight into the fall-back day",
+			path:  "20251101/record000/A251101_235950_000020.264",
+			start: "2025-11-02T03:59:50Z", end: "2025-11-02T04:00:20Z", duration: 30,
+		},
+		{
+			// The filename alone reads as the first 1:55, ending after
+			// the change
+			name:  "across falling back",
+			path:  "20251102/record000/A251102_015500_010500.264",
+			start: "2025-11-02T05:55:00Z", end: "2025-11-02T06:05:00Z", duration: 600,
+		},
+		{
+			name:  "after falling back",
+			path:  "20251102/record000/A251102_020500_021000.264",
+			start: "2025-11-02T07:05:00Z", end: "2025-11-02T07:10:00Z", duration: 300,
+		},
+		{
+			name:  "across springing forward",
+			path:  "20250309/record000/A250309_015950_030010.264",
+			start: "2025-03-09T06:59:50Z", end: "2025-03-09T07:00:10Z", duration: 20,
+		},
+		{
+			name:  "image after springing forward",
+			path:  "20250309/images000/A25030903000000.jpg",
+			start: "2025-03-09T07:00:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := testMediaItem(tt.path, ny)
+			if got := formatUTC(item.Start); got != tt.start {
+				t.Errorf("start %s, want %s", got, tt.start)
+			}
+			if got := formatUTC(item.End); got != tt.end {
+				t.Errorf("end %s, want %s", got, tt.end)
+			}
+			if item.DurationSeconds != tt.duration {
+				t.Errorf("duration %d, want %d", item.DurationSeconds, tt.duration)
+			}
+		})
+	}
+}
+
+func TestResolveFallBack(t *testing.T) {
+	ny := newYork(t)
+
+	// Listing order, with the start and end each item should end up with
+	tests := []struct {
+		path       string
+		start, end string // UTC
+	}{
+		{"20251102/images000/A25110200590000.jpg", "2025-11-02T04:59:00Z", ""},
+		{"20251102/images000/A25110201300000.jpg", "2025-11-02T05:30:00Z", ""},
+		{"20251102/images000/A25110201300001.jpg", "2025-11-02T05:30:00Z", ""},
+		{"20251102/images000/A25110201450000.jpg", "2025-11-02T05:45:00Z", ""},
+		{"20251102/images000/A25110201100000.jpg", "2025-11-02T06:10:00Z", ""}, // went backwards: after the change
+		{"20251102/images000/A25110201500000.jpg", "2025-11-02T06:50:00Z", ""},
+		{"20251102/images000/A25110202100000.jpg", "2025-11-02T07:10:00Z", ""},
+
+		// Each directory is ordered on its own
+		{"20251102/images001/A25110201200000.jpg", "2025-11-02T05:20:00Z", ""},
+
+		{"20251102/record000/A251102_013000_014000.264", "2025-11-02T05:30:00Z", "2025-11-02T05:40:00Z"},
+		{"20251102/record000/A251102_015500_010500.264", "2025-11-02T05:55:00Z", "2025-11-02T06:05:00Z"}, // across the change
+		{"20251102/record000/A251102_011000_011500.264", "2025-11-02T06:10:00Z", "2025-11-02T06:15:00Z"},
+		{"20251102/record000/A251102_015500_020500.264", "2025-11-02T06:55:00Z", "2025-11-02T07:05:00Z"},
+	}
+
+	var media []MediaItem
+	for _, tt := range tests {
+		media = append(media, testMediaItem(tt.path, ny))
+	}
+	resolveFallBack(media)
+
+	for i, tt := range tests {
+		item := media[i]
+		if start, end := formatUTC(item.Start), formatUTC(item.End); start != tt.start || end != tt.end {
+			t.Errorf("%s: got %s - %s, want %s - %s", tt.path, start, end, tt.start, tt.end)
+		}
+		if item.End != nil && item.DurationSeconds != int(item.End.Sub(*item.Start).Seconds()) {
+			t.Errorf("%s: duration %d doesn't match", tt.path, item.DurationSeconds)
+		}
+	}
+}
+
+func TestSetStartTime(t *testing.T) {
+	ny := newYork(t)
+	tests := []struct {
+		name     string
+		path     string
+		start    string // UTC
+		end      string // UTC
+		duration int
+	}{
+		{
+			name:  "within the repeated hour",
+			path:  "20251102/record000/A251102_013000_014000.264",
+			start: "2025-11-02T06:30:00Z", end: "2025-11-02T06:40:00Z", duration: 600,
+		},
+		{
+			name:  "ending after the repeated hour",
+			path:  "20251102/record000/A251102_015000_021000.264",
+			start: "2025-11-02T06:50:00Z", end: "2025-11-02T07:10:00Z", duration: 1200,
+		},
+		{
+			name:  "across the change, moved earlier",
+			path:  "20251102/record000/A251102_015500_010500.264",
+			start: "2025-11-02T05:55:00Z", end: "2025-11-02T06:05:00Z", duration: 600,
+		},
+		{
+			name:  "image",
+			path:  "20251102/images000/A25110201300000.jpg",
+			start: "2025-11-02T06:30:00Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := testMediaItem(tt.path, ny)
+			setStartTime(&item, utc(t, tt.start).In(ny))
+			if start, end := formatUTC(item.Start), formatUTC(item.End); start != tt.start || end != tt.end {
+				t.Errorf("got %s - %s, want %s - %s", start, end, tt.start, tt.end)
+			}
+			if item.DurationSeconds != tt.duration {
+				t.Errorf("duration %d, want %d", item.DurationSeconds, tt.duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// Sources of a converted video's frame timing, from most to least accurate
+const (
+	TimingTimestamps = "timestamps" // the camera's per-frame HXVF timestamps
+	TimingDuration   = "duration"   // frame count over the clip length in the filename
+	TimingProbe      = "probe"      // frame rate reported by ffprobe
+	TimingDefault    = "default"    // nothing better was available
+)
+
+// defaultFPS is assumed when a video's frame rate can't be worked out
+const defaultFPS = 20
+
+// Frame rates outside this range mean the timing information is bogus
+const (
+	minPlausibleFPS = 1
+	maxPlausibleFPS = 120
+)
+
+// videoTimingSuffix is the cache suffix of the timing recorded for a converted video
+const videoTimingSuffix = ".timing.json"
+
+// VideoTiming records how a converted video's frames were timed
+type VideoTiming struct {
+	Source   string  `json:"source"`
+	FPS      float64 `json:"fps"`                // average frame rate
+	Variable bool    `json:"variable,omitempty"` // frame intervals vary; timestamps only
+	Frames   int     `json:"frames,omitempty"`   // video frames, if known
+
+	rate        string  // ffmpeg -framerate value, for a constant frame rate
+	times       []int64 // each video frame's time in ms from the first; timestamps only
+	audioOffset int64   // ms from the first video frame to the first audio frame; timestamps only
+}
+
+// String describes the timing for logs
+func (t VideoTiming) String() string {
+	s := fmt.Sprintf("%.2f fps from %s", t.FPS, t.Source)
+	if t.Variable {
+		s += ", variable"
+	}
+	return s
+}
+
+// VideoTimes returns each video frame's time in milliseconds from the first
+// frame, reporting false if the recording's timestamps can't be trusted.
+// Timestamps wrap around after 49 days, which is allowed for. A few frames
+// sharing a timestamp are nudged apart, but timestamps that go backwards or
+// mostly stand still mean the camera doesn't fill them in properly.
+func (rec *HXVSRecording) VideoTimes() ([]int64, bool) {
+	var times []int64
+	var last uint32
+	var elapsed int64
+	repeats := 0
+	for _, frame := range rec.Frames {
+		if frame.Audio {
+			continue
+		}
+		if times != nil {
+			delta := int64(int32(frame.Timestamp - last))
+			if delta < 0 {
+				return nil, false
+			}
+			if delta == 0 {
+				repeats++
+				delta = 1
+			}
+			elapsed += delta
+		}
+		last = frame.Timestamp
+		times = append(times, elapsed)
+	}
+	if len(times) < 2 || repeats > len(times)/2 {
+		return nil, false
+	}
+	return times, true
+}
+
+// timingFromTimestamps times frames by the recording's HXVF timestamps
+func timingFromTimestamps(rec *HXVSRecording) (VideoTiming, bool) {
+	times, ok := rec.VideoTimes()
+	if !ok {
+		return VideoTiming{}, false
+	}
+	span := times[len(times)-1]
+	average := float64(span) / float64(len(times)-1) // ms per frame
+	fps := 1000 / average
+	if fps < minPlausibleFPS || fps > maxPlausibleFPS {
+		return VideoTiming{}, false
+	}
+
+	// Encoders jitter by a millisecond or two; an interval more than a
+	// quarter away from the typical one is a real change of rate
+	intervals := make([]int64, len(times)-1)
+	for i := range intervals {
+		intervals[i] = times[i+1] - times[i]
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	typical := float64(intervals[len(intervals)/2])
+	variable := math.Abs(float64(intervals[0])-typical) > typical/4 ||
+		math.Abs(float64(intervals[len(intervals)-1])-typical) > typical/4
+	return VideoTiming{
+		Source:      TimingTimestamps,
+		FPS:         fps,
+		Variable:    variable,
+		Frames:      len(times),
+		times:       times,
+		audioOffset: rec.audioOffset(),
+	}, true
+}
+
+// audioOffset returns the time in ms from the first video frame to the first
+// audio frame, or 0 if audio comes first or there isn't any
+func (rec *HXVSRecording) audioOffset() int64 {
+	var video, audio *HXVSFrame
+	for i := range rec.Frames {
+		frame := &rec.Frames[i]
+		if frame.Audio && audio == nil {
+			audio = frame
+		} else if !frame.Audio && video == nil {
+			video = frame
+		}
+	}
+	if video == nil || audio == nil {
+		return 0
+	}
+	offset := int64(int32(audio.Timestamp - video.Timestamp))
+	if offset < 0 || offset > 10000 {
+		return 0
+	}
+	return offset
+}
+
+// writeTimedVideo writes a recording's video frames, read back from video,
+// as a transport stream, each presented at its time in ms from times
+func writeTimedVideo(w io.Writer, codec string, rec *HXVSRecording, video io.Reader, times []int64) error {
+	buf := bufio.NewWriter(w)
+	ts, err := newTSWriter(buf, codec)
+	if err != nil {
+		return err
+	}
+	err = rec.readVideoFrames(video, func(i int, frame HXVSFrame) error {
+		return ts.WriteFrame(frame.Data, times[i]*tsClockRate/1000, frame.Keyframe)
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// timingFromDuration spreads a clip's frames evenly over the time range in
+// its filename, which is only accurate to the second
+func timingFromDuration(frames int, start, end int64) (VideoTiming, bool) {
+	seconds := end - start
+	if frames < 2 || seconds <= 0 {
+		return VideoTiming{}, false
+	}
+	fps := float64(frames) / float64(seconds)
+	if fps < minPlausibleFPS || fps > maxPlausibleFPS {
+		return VideoTiming{}, false
+	}
+	return VideoTiming{Source: TimingDuration, FPS: fps, Frames: frames, rate: fmt.Sprintf("%d/%d", frames, seconds)}, true
+}
+
+// frameTiming works out how to time a recording's frames without running
+// ffprobe, from its timestamps or else its filename
+func (cam *Camera) frameTiming(sourceURL string, rec *HXVSRecording) (VideoTiming, bool) {
+	if rec == nil {
+		return VideoTiming{}, false
+	}
+	if timing, ok := timingFromTimestamps(rec); ok {
+		return timing, true
+	}
+	frames, _, _ := rec.Counts()
+	return cam.durationTiming(sourceURL, frames)
+}
+
+// durationTiming spreads frames evenly over the time range in a video's filename
+func (cam *Camera) durationTiming(sourceURL string, frames int) (VideoTiming, bool) {
+	start, end, ok := parseMediaTimes(path.Base(sourceURL), "video", cam.location)
+	if !ok {
+		return VideoTiming{}, false
+	}
+	return timingFromDuration(frames, start.Unix(), end.Unix())
+}
+
+// timingFromProbe asks ffprobe for a video file's frame rate, falling back
+// to defaultFPS
+func timingFromProbe(videoPath string) VideoTiming {
+	if fps := detectFPS(videoPath); fps > 0 {
+		return VideoTiming{Source: TimingProbe, FPS: float64(fps), rate: strconv.Itoa(fps)}
+	}
+	return VideoTiming{Source: TimingDefault, FPS: defaultFPS, rate: strconv.Itoa(defaultFPS)}
+}
+
+// saveVideoTiming records the timing of a converted video in the cache
+func (c *MediaCache) saveVideoTiming(url string, timing VideoTiming) error {
+	data, err := json.Marshal(timing)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.getCachePath(url, videoTimingSuffix), data, 0644)
+}
+
+// loadVideoTiming returns the recorded timing of a converted video
+func (c *MediaCache) loadVideoTiming(url string) (VideoTiming, bool) {
+	data, err := os.ReadFile(c.getCachePath(url, videoTimingSuffix))
+	if err != nil {
+		return VideoTiming{}, false
+	}
+	var timing VideoTiming
+	if err := json.Unmarshal(data, &timing); err != nil {
+		return VideoTiming{}, false
+	}
+	return timing, true
+}
+
+// setVideoTimingHeaders reports how a converted video was timed
+func setVideoTimingHeaders(w http.ResponseWriter, timing VideoTiming) {
+	w.Header().Set("X-Video-Timing", timing.Source)
+	w.Header().Set("X-Video-Frame-Rate", strconv.FormatFloat(timing.FPS, 'f', 2, 64))
+	if timing.Variable {
+		w.Header().Set("X-Video-Variable-Frame-Rate", "true")
+	}
+}
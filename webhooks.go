@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook delivery settings
+const (
+	webhookMaxAttempts   = 5
+	webhookRetryBackoff  = 2 * time.Second // doubled after each failed attempt
+	webhookTimeout       = 10 * time.Second
+	maxWebhookDeliveries = 200 // deliveries kept in the log
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// filterAny matches every trigger or type in a webhook filter
+const filterAny = "any"
+
+// WebhookConfig holds the settings for a single outgoing webhook
+type WebhookConfig struct {
+	ID      string
+	URL     string
+	Secret  string // signs payloads with HMAC-SHA256 if set
+	Trigger string // "alarm", "periodic" or filterAny
+	Type    string // "image", "video" or filterAny
+}
+
+// matches reports whether a webhook wants to hear about an item
+func (cfg WebhookConfig) matches(item MediaItem) bool {
+	return (cfg.Trigger == filterAny || cfg.Trigger == item.Trigger) &&
+		(cfg.Type == filterAny || cfg.Type == item.Type)
+}
+
+// loadWebhookConfigs reads webhook settings from the environment. If
+// WEBHOOKS is set (e.g. "ha,slack"), each webhook is configured via
+// WEBHOOK_<ID>_URL, WEBHOOK_<ID>_SECRET, WEBHOOK_<ID>_TRIGGER and
+// WEBHOOK_<ID>_TYPE. Otherwise a single webhook is configured from
+// WEBHOOK_URL, WEBHOOK_SECRET, etc., if WEBHOOK_URL is set.
+func loadWebhookConfigs() ([]WebhookConfig, error) {
+	defaults := WebhookConfig{
+		ID:      "default",
+		URL:     getEnv("WEBHOOK_URL", ""),
+		Secret:  getEnv("WEBHOOK_SECRET", ""),
+		Trigger: strings.ToLower(getEnv("WEBHOOK_TRIGGER", "alarm")),
+		Type:    strings.ToLower(getEnv("WEBHOOK_TYPE", filterAny)),
+	}
+
+	var configs []WebhookConfig
+	ids := getEnv("WEBHOOKS", "")
+	if ids == "" {
+		if defaults.URL != "" {
+			configs = append(configs, defaults)
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, id := range strings.Split(ids, ",") {
+			id = strings.ToLower(strings.TrimSpace(id))
+			if id == "" {
+				continue
+			}
+			if !cameraIDPattern.MatchString(id) {
+				return nil, fmt.Errorf("invalid webhook ID %q: must contain only a-z, 0-9, '-' and '_'", id)
+			}
+			if seen[id] {
+				return nil, fmt.Errorf("duplicate webhook ID %q", id)
+			}
+			seen[id] = true
+
+			prefix := "WEBHOOK_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+			cfg := WebhookConfig{
+				ID:      id,
+				URL:     getEnv(prefix+"URL", ""),
+				Secret:  getEnv(prefix+"SECRET", defaults.Secret),
+				Trigger: strings.ToLower(getEnv(prefix+"TRIGGER", defaults.Trigger)),
+				Type:    strings.ToLower(getEnv(prefix+"TYPE", defaults.Type)),
+			}
+			if cfg.URL == "" {
+				return nil, fmt.Errorf("webhook %s: no URL configured", id)
+			}
+			configs = append(configs, cfg)
+		}
+	}
+
+	for _, cfg := range configs {
+		switch cfg.Trigger {
+		case "alarm", "periodic", filterAny:
+		default:
+			return nil, fmt.Errorf("webhook %s: invalid trigger %q (expected alarm, periodic or any)", cfg.ID, cfg.Trigger)
+		}
+		switch cfg.Type {
+		case "image", "video", filterAny:
+		default:
+			return nil, fmt.Errorf("webhook %s: invalid type %q (expected image, video or any)", cfg.ID, cfg.Type)
+		}
+	}
+	return configs, nil
+}
+
+// MediaLinks are absolute URLs for fetching a media item through ipcam-browser
+type MediaLinks struct {
+	Media     string `json:"media"`               // /api/proxy for images, /api/video for videos
+	Video     string `json:"video,omitempty"`     // converted MP4, videos only
+	Thumbnail string `json:"thumbnail,omitempty"` // matched thumbnail image, videos only
+}
+
+// mediaLinks returns the absolute links for an item, relative to baseURL
+func mediaLinks(cam *Camera, item MediaItem, baseURL string) MediaLinks {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	links := MediaLinks{Media: baseURL + cam.proxyURL(item.URL)}
+	if item.Type == "video" {
+		links.Video = baseURL + item.ProxyURL
+		links.Media = links.Video
+		if item.ThumbnailURL != "" {
+			links.Thumbnail = baseURL + item.ThumbnailURL
+		}
+	}
+	return links
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks
+type WebhookPayload struct {
+	Event      string     `json:"event"` // "media.added"
+	DeliveryID string     `json:"deliveryId"`
+	Camera     string     `json:"camera"`
+	CameraName string     `json:"cameraName"`
+	DetectedAt time.Time  `json:"detectedAt"`
+	Item       MediaItem  `json:"item"`
+	Links      MediaLinks `json:"links"`
+}
+
+// WebhookDelivery records the attempts to deliver one payload to one webhook
+type WebhookDelivery struct {
+	ID          string     `json:"id"`
+	Webhook     string     `json:"webhook"`
+	Camera      string     `json:"camera"`
+	Path        string     `json:"path"` // camera path of the media
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	StatusCode  int        `json:"statusCode,omitempty"` // from the last attempt
+	Error       string     `json:"error,omitempty"`      // from the last attempt
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// WebhookDispatcher POSTs new media from the change feed to the configured
+// webhooks, retrying failed deliveries with exponential backoff
+type WebhookDispatcher struct {
+	webhooks []WebhookConfig
+	baseURL  string
+	client   *http.Client
+
+	mu         sync.Mutex
+	deliveries []*WebhookDelivery // newest last, at most maxWebhookDeliveries
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // in-flight deliveries
+	doneCh chan struct{}
+}
+
+// NewWebhookDispatcher creates a dispatcher for the given webhooks. baseURL
+// is the externally reachable URL of ipcam-browser, used for media links.
+func NewWebhookDispatcher(webhooks []WebhookConfig, baseURL string) *WebhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookDispatcher{
+		webhooks: webhooks,
+		baseURL:  baseURL,
+		client:   &http.Client{Timeout: webhookTimeout},
+		ctx:      ctx,
+		cancel:   cancel,
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Start begins following the change feed
+func (d *WebhookDispatcher) Start() {
+	log.Printf("Starting webhook dispatcher with %d webhook(s)", len(d.webhooks))
+	go func() {
+		defer close(d.doneCh)
+		changeFeed.Follow("Webhooks", d.ctx.Done(), d.handleChange)
+	}()
+}
+
+// Stop stops following the change feed and abandons pending retries
+func (d *WebhookDispatcher) Stop() {
+	d.cancel()
+	<-d.doneCh
+	d.wg.Wait()
+	log.Println("Webhook dispatcher stopped")
+}
+
+// handleChange starts a delivery to each webhook interested in an added item
+func (d *WebhookDispatcher) handleChange(change MediaChange) {
+	if change.Type != ChangeAdded {
+		return
+	}
+	cam := lookupCamera(change.Camera)
+	if cam == nil {
+		return
+	}
+
+	for _, webhook := range d.webhooks {
+		if !webhook.matches(change.Item) {
+			continue
+		}
+
+		delivery := &WebhookDelivery{
+			ID:        newDeliveryID(),
+			Webhook:   webhook.ID,
+			Camera:    cam.ID,
+			Path:      change.Item.Path,
+			Status:    DeliveryPending,
+			CreatedAt: time.Now(),
+		}
+		payload := WebhookPayload{
+			Event:      "media.added",
+			DeliveryID: delivery.ID,
+			Camera:     cam.ID,
+			CameraName: cam.Name,
+			DetectedAt: change.DetectedAt,
+			Item:       change.Item,
+			Links:      mediaLinks(cam, change.Item, d.baseURL),
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Webhook %s: failed to encode payload: %v", webhook.ID, err)
+			continue
+		}
+
+		d.record(delivery)
+		d.wg.Add(1)
+		go func(webhook WebhookConfig) {
+			defer d.wg.Done()
+			d.deliver(webhook, delivery, body)
+		}(webhook)
+	}
+}
+
+// deliver POSTs body to a webhook until it succeeds or runs out of attempts
+func (d *WebhookDispatcher) deliver(webhook WebhookConfig, delivery *WebhookDelivery, body []byte) {
+	backoff := webhookRetryBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		statusCode, err := d.post(webhook, delivery.ID, body)
+
+		d.mu.Lock()
+		delivery.Attempts = attempt
+		delivery.StatusCode = statusCode
+		delivery.Error = ""
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		done := err == nil || attempt == webhookMaxAttempts
+		if done {
+			now := time.Now()
+			delivery.CompletedAt = &now
+			delivery.Status = DeliveryDelivered
+			if err != nil {
+				delivery.Status = DeliveryFailed
+			}
+		}
+		d.mu.Unlock()
+
+		if err == nil {
+			return
+		}
+		if done {
+			log.Printf("Webhook %s: giving up on %s after %d attempts: %v", webhook.ID, delivery.Path, attempt, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// post makes a single delivery attempt, returning the response status code
+func (d *WebhookDispatcher) post(webhook WebhookConfig, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ipcam-browser/"+version)
+	req.Header.Set("X-Ipcam-Event", "media.added")
+	req.Header.Set("X-Ipcam-Delivery", deliveryID)
+	if webhook.Secret != "" {
+		req.Header.Set("X-Ipcam-Signature", "sha256="+signPayload(webhook.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record adds a delivery to the log, discarding the oldest if it's full
+func (d *WebhookDispatcher) record(delivery *WebhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > maxWebhookDeliveries {
+		d.deliveries = append([]*WebhookDelivery(nil), d.deliveries[len(d.deliveries)-maxWebhookDeliveries:]...)
+	}
+}
+
+// Deliveries returns the logged deliveries, newest first, optionally only
+// those for one webhook
+func (d *WebhookDispatcher) Deliveries(webhook string) []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		if webhook == "" || d.deliveries[i].Webhook == webhook {
+			deliveries = append(deliveries, *d.deliveries[i])
+		}
+	}
+	return deliveries
+}
+
+// signPayload returns the hex HMAC-SHA256 of body keyed by secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newDeliveryID returns a random delivery ID
+func newDeliveryID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}